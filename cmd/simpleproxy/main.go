@@ -0,0 +1,58 @@
+// Command simpleproxy is a caching reverse proxy, serving files from an
+// upstream server and storing them on disk.
+//
+// Run as simpleproxy warm --from FILE, it fetches the URIs listed in FILE
+// into the cache and exits, priming a node before it serves clients.
+//
+// Run as simpleproxy cache ls|show|rm|stats, it inspects and manages the
+// entries in --cache-dir without running the proxy.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+
+	"github.com/ronoaldo/simpleproxy/proxy"
+)
+
+func main() {
+	cfg := new(proxy.Config)
+	cfg.RegisterFlags(flag.CommandLine)
+	if len(os.Args) > 1 && os.Args[1] == "warm" {
+		from := flag.String("from", "-", "Read the URIs to warm from `FILE`, one per line, or stdin with -")
+		flag.CommandLine.Parse(os.Args[2:])
+		if err := warm(cfg, *from); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		// Flags follow the subcommand, as in cache ls --cache-dir DIR
+		var args []string
+		if len(os.Args) > 2 {
+			flag.CommandLine.Parse(os.Args[3:])
+			args = append([]string{os.Args[2]}, flag.Args()...)
+		}
+		if err := proxy.CacheCommand(cfg, args, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	flag.Parse()
+	proxy.Run(cfg)
+}
+
+func warm(cfg *proxy.Config, from string) error {
+	var list io.Reader = os.Stdin
+	if from != "-" {
+		f, err := os.Open(from)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		list = f
+	}
+	return proxy.Warm(cfg, list)
+}
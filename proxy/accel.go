@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const accelRedirectHeader = "X-Accel-Redirect"
+
+// accelRedirect handles nginx-style internal redirects: when upstream
+// answers with an X-Accel-Redirect header, the target path is fetched from
+// upstream (or from cache) and served in place of the original response.
+//
+// The target is cached under its own key, while the original response,
+// usually gated by authentication, is never cached.
+func (c *CachedTransport) accelRedirect(w *http.Response) error {
+	target := w.Header.Get(accelRedirectHeader)
+	u, err := url.Parse(target)
+	if err != nil || u.IsAbs() || u.Host != "" || !strings.HasPrefix(u.Path, "/") {
+		return fmt.Errorf("invalid %v: %q", accelRedirectHeader, target)
+	}
+	log.Printf("[accel] Internal redirect '%v' => '%v'", w.Request.URL.RequestURI(), target)
+
+	r := w.Request.Clone(w.Request.Context())
+	r.Method = http.MethodGet
+	r.URL.Path, r.URL.RawPath, r.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	r.RequestURI = r.URL.RequestURI()
+	// The key URI kept from the client request, as with
+	// --upstream-path-rewrite, would store the target under the gated URI
+	key := keyURI(&http.Request{URL: r.URL, RequestURI: r.RequestURI})
+	r = r.WithContext(context.WithValue(r.Context(), keyURIKey, key))
+	r.Body, r.ContentLength = nil, 0
+	for _, k := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "Content-Type"} {
+		r.Header.Del(k)
+	}
+	sub, err := c.RoundTrip(r)
+	if err != nil {
+		return err
+	}
+	// Never follow redirects in chain.
+	sub.Header.Del(accelRedirectHeader)
+	if err := c.cacheResponse(sub); err != nil {
+		sub.Body.Close()
+		return err
+	}
+
+	w.Body.Close()
+	w.Status, w.StatusCode = sub.Status, sub.StatusCode
+	w.Header, w.Body, w.ContentLength = sub.Header, sub.Body, sub.ContentLength
+	return nil
+}
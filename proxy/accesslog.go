@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// accessLogger writes one line per request, in the Apache combined format,
+// followed by the cache status, upstream and latency, or as JSON.
+type accessLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// accessLog is set with --access-log.
+var accessLog *accessLogger
+
+// accessEntry collects what is only known deep in the request handling.
+type accessEntry struct {
+	mu       sync.Mutex
+	upstream string
+}
+
+// newAccessLogger writes to the file at path, appending to it, or to the
+// standard output if path is "-".
+func newAccessLogger(path, format string) (*accessLogger, error) {
+	switch format {
+	case "combined", "json":
+	default:
+		return nil, fmt.Errorf("invalid --log-format %q: use combined or json", format)
+	}
+	if path == "-" {
+		return &accessLogger{w: os.Stdout, format: format}, nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &accessLogger{w: f, format: format}, nil
+}
+
+// recordUpstream notes that r was sent to the upstream host, for the
+// access log.
+func recordUpstream(r *http.Request, host string) {
+	if e, ok := r.Context().Value(accessKey).(*accessEntry); ok {
+		e.mu.Lock()
+		e.upstream = host
+		e.mu.Unlock()
+	}
+}
+
+// logAccess logs the requests handled by next.
+func (l *accessLogger) logAccess(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		e := &accessEntry{}
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessKey, e)))
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		e.mu.Lock()
+		upstream := e.upstream
+		e.mu.Unlock()
+		cacheStatus := w.Header().Get("x-cache")
+		if cacheStatus == "" {
+			cacheStatus = "MISS"
+		}
+		l.write(r, rec, start, cacheStatus, upstream)
+	})
+}
+
+func (l *accessLogger) write(r *http.Request, rec *statusRecorder, start time.Time, cacheStatus, upstream string) {
+	latency := time.Since(start)
+	client := clientIP(r)
+	var line []byte
+	if l.format == "json" {
+		line, _ = json.Marshal(map[string]interface{}{
+			"time":       start.UTC().Format(time.RFC3339Nano),
+			"client":     client,
+			"method":     r.Method,
+			"host":       r.Host,
+			"uri":        r.RequestURI,
+			"proto":      r.Proto,
+			"status":     rec.code,
+			"bytes":      rec.bytes,
+			"latency":    latency.Seconds(),
+			"cache":      cacheStatus,
+			"upstream":   upstream,
+			"referer":    r.Referer(),
+			"user_agent": r.UserAgent(),
+		})
+		line = append(line, '\n')
+	} else {
+		dash := func(s string) string {
+			if s == "" {
+				return "-"
+			}
+			return s
+		}
+		size := "-"
+		if rec.bytes > 0 {
+			size = strconv.FormatInt(rec.bytes, 10)
+		}
+		line = []byte(fmt.Sprintf("%s - - [%s] %s %d %s %s %s %s %s %.6f\n",
+			dash(client), start.Format("02/Jan/2006:15:04:05 -0700"),
+			strconv.Quote(r.Method+" "+r.RequestURI+" "+r.Proto), rec.code, size,
+			strconv.Quote(dash(r.Referer())), strconv.Quote(dash(r.UserAgent())),
+			cacheStatus, dash(upstream), latency.Seconds()))
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.w.Write(line)
+}
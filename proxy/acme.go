@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager returns the manager obtaining and renewing certificates for
+// the --acme-domains from Let's Encrypt, kept in --acme-cache-dir.
+func acmeManager() *autocert.Manager {
+	var domains []string
+	for _, d := range strings.Split(conf.ACMEDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(domains...),
+		Cache:      autocert.DirCache(conf.ACMECacheDir),
+		Email:      conf.ACMEEmail,
+	}
+}
+
+// acmeTLSConfig returns the TLS configuration getting certificates from m,
+// which also answers TLS-ALPN-01 challenges on the HTTPS listeners.
+func acmeTLSConfig(m *autocert.Manager) *tls.Config {
+	return &tls.Config{
+		GetCertificate: m.GetCertificate,
+		NextProtos:     []string{acme.ALPNProto},
+	}
+}
@@ -0,0 +1,368 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// newAdminMux returns the handlers served by the admin listener, which
+// should not be exposed to the public. Probes are always open, while the
+// other endpoints require the --metrics-auth-* credentials, if set.
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	mux.Handle("/stats", requireAuth(statsHandler))
+	mux.Handle("/metrics", requireAuth(metricsHandler))
+	mux.Handle("/admin/flush-tenant", requireAuth(flushTenantHandler))
+	mux.Handle("/admin/pin", requireAuth(pinHandler(pins.Pin)))
+	mux.Handle("/admin/unpin", requireAuth(pinHandler(pins.Unpin)))
+	mux.Handle("/admin/pins", requireAuth(pinsHandler))
+	mux.Handle("/admin/decode", requireAuth(decodeHandler))
+	mux.Handle("/_cache/", requireAuth(purgeHandler))
+	mux.Handle("/admin/encode", requireAuth(encodeHandler))
+	mux.Handle("/admin/entries", requireAuth(entriesHandler))
+	mux.Handle("/admin/purge", requireAuth(purgeEntriesHandler))
+	mux.Handle("/admin/flush", requireAuth(flushHandler))
+	mux.Handle("/admin/warm", requireAuth(warmHandler))
+	mux.Handle("/admin/offline", requireAuth(offlineHandler))
+	return mux
+}
+
+// requireAuth wraps h so it is only served to authorized requests.
+func requireAuth(h http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !authorized(r) {
+			if conf.MetricsAuthBasic != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="simpleproxy"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="simpleproxy"`)
+			}
+			http.Error(w, "401 Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// authorized reports whether r carries the --metrics-auth-token bearer
+// token or the --metrics-auth-basic credentials. Without either flag,
+// every request is authorized.
+func authorized(r *http.Request) bool {
+	if conf.MetricsAuthToken == "" && conf.MetricsAuthBasic == "" {
+		return true
+	}
+	ok := false
+	auth := r.Header.Get("Authorization")
+	if conf.MetricsAuthToken != "" && strings.HasPrefix(auth, "Bearer ") {
+		ok = secureCompare(strings.TrimPrefix(auth, "Bearer "), conf.MetricsAuthToken)
+	}
+	if user, pass, basic := r.BasicAuth(); basic && conf.MetricsAuthBasic != "" {
+		ok = secureCompare(user+":"+pass, conf.MetricsAuthBasic)
+	}
+	return ok
+}
+
+// secureCompare compares a and b in constant time.
+func secureCompare(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// healthzHandler reports that the process is alive, as a liveness probe,
+// along with whether the upstreams were healthy when last checked, which
+// only /readyz acts upon. The health of each upstream is only listed for
+// authorized requests.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := healthStatuses()
+	healthy := true
+	for _, s := range statuses {
+		healthy = healthy && s.Healthy
+	}
+	resp := map[string]interface{}{
+		"alive":             true,
+		"upstreams_healthy": healthy,
+	}
+	if authorized(r) {
+		resp["upstreams"] = statuses
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// cacheChecker is implemented by caches that can verify they are usable:
+// a writable directory, or a reachable server.
+type cacheChecker interface {
+	Check() error
+}
+
+// readyzHandler reports whether the proxy is ready to serve: startup tasks
+// are done, the cache is usable and the upstream is reachable, unless
+// running --offline.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&ready) == 0 {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"ready":  false,
+			"reason": "starting up",
+		})
+		return
+	}
+	if c, ok := cache.(cacheChecker); ok {
+		if err := c.Check(); err != nil {
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+				"ready":  false,
+				"reason": "cache is not writable",
+				"error":  err.Error(),
+			})
+			return
+		}
+	}
+	if !isOffline() {
+		if statuses, healthy := upstreamStatus(r.Context()); !healthy {
+			resp := map[string]interface{}{
+				"ready":  false,
+				"reason": "upstream is unhealthy",
+			}
+			if authorized(r) {
+				resp["upstreams"] = statuses
+			}
+			writeJSON(w, http.StatusServiceUnavailable, resp)
+			return
+		}
+		if upstreamErrors.Degraded() {
+			rate, _ := upstreamErrors.Rate()
+			writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{
+				"ready":      false,
+				"reason":     "upstream error rate is too high",
+				"error_rate": rate,
+			})
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ready": true})
+}
+
+// upstreamStatus returns the health of every upstream, probing them first
+// if health checks are not running in the background, and whether all of
+// them are healthy, for /readyz.
+func upstreamStatus(ctx context.Context) ([]healthStatus, bool) {
+	statuses, healthy := []healthStatus{}, true
+	for _, h := range healthCheckers() {
+		if conf.UpstreamHealthInterval <= 0 && !isOffline() {
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			h.Check(ctx)
+			cancel()
+		}
+		s := h.Status()
+		if p := upstreamPools[h.target]; p != nil {
+			// Healthy as long as a backend can take requests
+			s.Healthy = p.Available()
+		}
+		statuses = append(statuses, s)
+		healthy = healthy && s.Healthy
+	}
+	return statuses, healthy
+}
+
+// flushTenantHandler removes all cache entries of the tenant in the query.
+func flushTenantHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	tenant := r.URL.Query().Get("tenant")
+	if tenant == "" {
+		http.Error(w, "400 Bad Request: missing tenant", http.StatusBadRequest)
+		return
+	}
+	f, ok := cache.(tenantFlusher)
+	if conf.TenantHeader == "" || !ok {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": errNoTenants.Error()})
+		return
+	}
+	if err := f.FlushTenant(tenant); err != nil {
+		log.Printf("[admin] error flushing tenant %q: %v", tenant, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	log.Printf("[admin] Flushed tenant %q", tenant)
+	writeJSON(w, http.StatusOK, map[string]string{"flushed": tenantDir(tenant)})
+}
+
+// pinHandler calls update with the uri in the query, to pin or unpin it.
+func pinHandler(update func(uri string) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		uri := r.URL.Query().Get("uri")
+		if uri == "" {
+			http.Error(w, "400 Bad Request: missing uri", http.StatusBadRequest)
+			return
+		}
+		if err := update(uri); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		log.Printf("[admin] Updated pins with %v %q", r.URL.Path, uri)
+		writeJSON(w, http.StatusOK, map[string]interface{}{"pinned": pins.List()})
+	}
+}
+
+// pinsHandler lists the pinned URIs.
+func pinsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pinned": pins.List()})
+}
+
+// purgeHandler removes the cache entry for the URI following /_cache, as
+// requested by clients, on DELETE or PURGE requests. With --tenant-header,
+// the entry of the tenant in the same header of the request is removed,
+// and with routed upstreams, the one for its Host header.
+func purgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete && r.Method != "PURGE" {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	target := &url.URL{Path: strings.TrimPrefix(r.URL.Path, "/_cache"), RawQuery: r.URL.RawQuery}
+	req, err := http.NewRequest(http.MethodGet, target.RequestURI(), nil)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if conf.TenantHeader != "" {
+		req.Header.Set(conf.TenantHeader, r.Header.Get(conf.TenantHeader))
+	}
+	req.Host = r.Host
+	if requestUpstream(req) == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no upstream for host " + r.Host})
+		return
+	}
+	uri := keyURI(req)
+	key := requestKey(req, uri)
+	switch err := cache.Flush(key); {
+	case os.IsNotExist(err):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "not in cache", "uri": uri})
+	case err != nil:
+		log.Printf("[admin] error purging '%v': %v", uri, err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		log.Printf("[admin] Purged '%v' => '%v'", uri, key)
+		writeJSON(w, http.StatusOK, map[string]string{"purged": uri, "key": key})
+	}
+}
+
+// statsHandler dumps the proxy internal state as JSON.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	rate, requests := upstreamErrors.Rate()
+	stats := map[string]interface{}{
+		"upstream_health": healthStatuses(),
+		"upstream": map[string]int64{
+			"fetches":   upstreamFetches.Value(),
+			"coalesced": coalescedRequests.Value(),
+			"inflight":  upstreamInflight.Value(),
+		},
+		"upstream_conns": connStats(),
+		"upstream_errors": map[string]interface{}{
+			"rate":     rate,
+			"requests": requests,
+			"window":   upstreamErrors.window.String(),
+		},
+		"cache_writes": map[string]int64{
+			"inflight": cacheWritesInflight.Value(),
+			"skipped":  cacheWritesSkipped.Value(),
+			"invalid":  invalidResponses.Value(),
+		},
+	}
+	if tracer != nil {
+		stats["tracing"] = tracer.Stats()
+	}
+	if events != nil {
+		stats["events"] = events.Stats()
+	}
+	if disk != nil {
+		stats["disk"] = disk.Stats()
+	}
+	next := cache
+	if m, ok := cache.(*memCache); ok {
+		stats["mem_cache"] = m.Stats()
+		next = m.next
+	}
+	if fs, ok := next.(*FsCache); ok && fs.lru != nil {
+		stats["cache"] = fs.Stats()
+	}
+	if conns != nil {
+		stats["top_client_conns"] = conns.Top(10)
+	}
+	if breaker != nil {
+		stats["open_circuits"] = breaker.Open()
+	}
+	if len(upstreamPools) > 0 {
+		backends := make(map[string]interface{})
+		for u, p := range upstreamPools {
+			backends[u.String()] = p.Status()
+		}
+		stats["upstream_backends"] = backends
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// connStats reports how often upstream connections are reused.
+func connStats() map[string]interface{} {
+	reused, created := upstreamConnsReused.Value(), upstreamConnsNew.Value()
+	ratio := 0.0
+	if reused+created > 0 {
+		ratio = float64(reused) / float64(reused+created)
+	}
+	return map[string]interface{}{
+		"reused":      reused,
+		"new":         created,
+		"reuse_ratio": ratio,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("[admin] error writing response: %v", err)
+	}
+}
+
+// warmHandler fetches the URIs in the request body, one per line, into the
+// cache, responding once done. The concurrency parameter overrides
+// --warm-concurrency.
+func warmHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if isOffline() {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "offline mode never fetches"})
+		return
+	}
+	concurrency := conf.WarmConcurrency
+	if v := r.URL.Query().Get("concurrency"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "400 Bad Request: invalid concurrency", http.StatusBadRequest)
+			return
+		}
+		concurrency = n
+	}
+	uris, err := readURIList(r.Body)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	res := warmer.Warm(r.Context(), uris, concurrency)
+	log.Printf("[admin] Warmed %d URIs, %d already cached, %d failed", res.Fetched, res.Cached, len(res.Failed))
+	writeJSON(w, http.StatusOK, res)
+}
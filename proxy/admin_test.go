@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPurgeRoutedEntry(t *testing.T) {
+	var n int32
+	u := newTestUpstream(t, &n)
+	api := *u
+	api.Path = "/v2"
+	h := newTestHandler(t, newTestConfig(t, u, "--upstream=/api="+api.String()))
+	if rec := get(h, "/api/users"); rec.Body.String() != "path=/v2/users" {
+		t.Fatalf("routed request got %q, want path=/v2/users", rec.Body.String())
+	}
+	if rec := get(h, "/api/users"); rec.Header().Get("x-cache") != CacheHit {
+		t.Fatalf("routed entry not cached under its public path")
+	}
+
+	rec := httptest.NewRecorder()
+	purgeHandler(rec, httptest.NewRequest("PURGE", "/_cache/api/users", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("purge got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := get(h, "/api/users"); rec.Header().Get("x-cache") != "" {
+		t.Errorf("purged entry served with x-cache %q", rec.Header().Get("x-cache"))
+	}
+	if got := atomic.LoadInt32(&n); got != 2 {
+		t.Errorf("upstream got %d requests, want 2", got)
+	}
+}
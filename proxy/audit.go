@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// uriHeader is stored along with the cached headers, recording the URI the
+// entry key was derived from, so keys can be mapped back to URIs. It is
+// never sent to clients.
+const uriHeader = "X-Simpleproxy-Uri"
+
+var errInvalidKey = errors.New("invalid cache key")
+
+// uriResolver is implemented by caches that can map keys back to URIs.
+type uriResolver interface {
+	URI(key string) (string, error)
+}
+
+// URI returns the URI of the entry stored at key. Keys may omit the tenant
+// and upstream directories, in which case the first one holding the key is
+// used.
+func (c *FsCache) URI(key string) (string, error) {
+	if !validKey(key) {
+		return "", errInvalidKey
+	}
+	if e, ok := c.index.get(key); ok && e.URI != "" {
+		return e.URI, nil
+	}
+	name := c.path(key) + ".headers"
+	if (conf.TenantHeader != "" || len(conf.UpstreamRoutes) > 0) && !strings.Contains(key, "/") {
+		shard := filepath.Join(shardDir(key), key, blobFile+".headers")
+		matches, _ := filepath.Glob(filepath.Join(c.dir, "*", shard))
+		if len(matches) == 0 {
+			matches, _ = filepath.Glob(filepath.Join(c.dir, "*", "*", shard))
+		}
+		if len(matches) == 0 {
+			return "", os.ErrNotExist
+		}
+		name = matches[0]
+	}
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	h := make(http.Header)
+	if err := json.Unmarshal(b, &h); err != nil {
+		return "", err
+	}
+	if uri := h.Get(uriHeader); uri != "" {
+		return uri, nil
+	}
+	return "", errors.New("entry was stored without its URI")
+}
+
+// validKey reports whether key is a relative name within the cache, and
+// not one of its internal files.
+func validKey(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsAny(part, `\`) {
+			return false
+		}
+	}
+	return true
+}
+
+// decodeKey returns the URI for key. Reversible base64 keys are decoded
+// directly, while hashed keys are looked up in the cache.
+func decodeKey(key string) (string, error) {
+	if conf.CacheKeyHash == "base64" {
+		if b, err := base64.URLEncoding.DecodeString(key[strings.LastIndex(key, "/")+1:]); err == nil {
+			return string(b), nil
+		}
+	}
+	r, ok := cache.(uriResolver)
+	if !ok {
+		return "", errors.New("cache does not support decoding keys")
+	}
+	return r.URI(key)
+}
+
+// decodeHandler maps the cache key in the query back to its URI.
+func decodeHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "400 Bad Request: missing key", http.StatusBadRequest)
+		return
+	}
+	uri, err := decodeKey(key)
+	switch {
+	case errors.Is(err, errInvalidKey):
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case os.IsNotExist(err):
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "key not found"})
+	case err != nil:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusOK, map[string]string{"key": key, "uri": uri})
+	}
+}
+
+// encodeHandler returns the cache key for the uri in the query, as
+// requested by clients, optionally for the given tenant and host.
+func encodeHandler(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Query().Get("uri")
+	if uri == "" {
+		http.Error(w, "400 Bad Request: missing uri", http.StatusBadRequest)
+		return
+	}
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if conf.TenantHeader != "" {
+		req.Header.Set(conf.TenantHeader, r.URL.Query().Get("tenant"))
+	}
+	if host := r.URL.Query().Get("host"); host != "" {
+		req.Host = host
+	}
+	if requestUpstream(req) == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no upstream for host " + req.Host})
+		return
+	}
+	keyed := keyURI(req)
+	writeJSON(w, http.StatusOK, map[string]string{"uri": keyed, "key": requestKey(req, keyed)})
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// authenticator requires clients to authenticate before any request is
+// served or cached, with the --auth-basic or --auth-htpasswd credentials,
+// or an --auth-bearer-token.
+type authenticator struct {
+	users  map[string]string // user to plain password, or htpasswd hash
+	tokens []string
+
+	// verified caches the credentials matching an htpasswd hash, as
+	// bcrypt is deliberately slow.
+	verified sync.Map
+}
+
+// clientAuth authenticates clients, or is nil unless credentials are set.
+var clientAuth *authenticator
+
+// newAuthenticator returns an authenticator for the USER:PASSWORD pairs
+// in basic, the users in the htpasswd file, if set, and tokens. Only
+// bcrypt and SHA-1 htpasswd hashes are supported.
+func newAuthenticator(basic []string, htpasswd string, tokens []string) (*authenticator, error) {
+	a := &authenticator{users: make(map[string]string), tokens: tokens}
+	for _, pair := range basic {
+		i := strings.Index(pair, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid --auth-basic %q, use USER:PASSWORD", pair)
+		}
+		a.users[pair[:i]] = "{PLAIN}" + pair[i+1:]
+	}
+	if htpasswd != "" {
+		f, err := os.Open(htpasswd)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		s := bufio.NewScanner(f)
+		for n := 1; s.Scan(); n++ {
+			line := strings.TrimSpace(s.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			i := strings.Index(line, ":")
+			if i <= 0 {
+				return nil, fmt.Errorf("%v:%d: invalid entry, use USER:HASH", htpasswd, n)
+			}
+			hash := line[i+1:]
+			if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+				return nil, fmt.Errorf("%v:%d: unsupported hash for %v, use bcrypt (htpasswd -B)", htpasswd, n, line[:i])
+			}
+			a.users[line[:i]] = hash
+		}
+		if err := s.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+// authHeaders returns the request header holding credentials, the response
+// header asking for them, and the status of requests without them. Clients
+// of a forward proxy send theirs in Proxy-Authorization.
+func authHeaders() (credentials, challenge string, status int) {
+	if forwardMode() {
+		return "Proxy-Authorization", "Proxy-Authenticate", http.StatusProxyAuthRequired
+	}
+	return "Authorization", "WWW-Authenticate", http.StatusUnauthorized
+}
+
+// Allowed reports whether r carries valid credentials.
+func (a *authenticator) Allowed(r *http.Request) bool {
+	header, _, _ := authHeaders()
+	auth := r.Header.Get(header)
+	if strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for _, t := range a.tokens {
+			if secureCompare(token, t) {
+				return true
+			}
+		}
+		return false
+	}
+	// BasicAuth only parses the Authorization header
+	user, pass, ok := (&http.Request{Header: http.Header{"Authorization": {auth}}}).BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, ok := a.users[user]
+	if !ok {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(hash, "{PLAIN}"):
+		return secureCompare(pass, strings.TrimPrefix(hash, "{PLAIN}"))
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(pass))
+		return secureCompare(base64.StdEncoding.EncodeToString(sum[:]), strings.TrimPrefix(hash, "{SHA}"))
+	}
+	key := sha256.Sum256([]byte(user + "\x00" + pass + "\x00" + hash))
+	if _, ok := a.verified.Load(key); ok {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) != nil {
+		return false
+	}
+	a.verified.Store(key, true)
+	return true
+}
+
+// Wrap returns next rejecting requests without valid credentials with 401.
+// The credentials of authenticated requests are removed, so they are not
+// sent upstream, nor prevent caching.
+func (a *authenticator) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header, challenge, status := authHeaders()
+		if !a.Allowed(r) {
+			if len(a.users) > 0 {
+				w.Header().Add(challenge, `Basic realm="simpleproxy"`)
+			}
+			if len(a.tokens) > 0 {
+				w.Header().Add(challenge, `Bearer realm="simpleproxy"`)
+			}
+			http.Error(w, fmt.Sprintf("%d %s", status, http.StatusText(status)), status)
+			return
+		}
+		r.Header.Del(header)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,193 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamPool balances the requests for an upstream among its backends:
+// the upstream URL itself, and the ones added by repeating --upstream.
+// Entries are cached for the upstream, whichever backend served them.
+type upstreamPool struct {
+	backends []*backend
+	next     uint32 // round-robin position
+}
+
+// backend is an upstream server in a pool.
+type backend struct {
+	url    *url.URL
+	health *healthChecker // nil unless checked in the background
+
+	active int64 // requests in flight
+
+	mu        sync.Mutex
+	downUntil time.Time
+	lastErr   error
+}
+
+// upstreamPools maps the upstreams with several backends to their pool.
+var upstreamPools = make(map[*url.URL]*upstreamPool)
+
+// initPools creates the pools of upstreams with several backends, checking
+// the health of each one every interval, unless zero, with t, until ctx is
+// done.
+func initPools(ctx context.Context, t http.RoundTripper, interval time.Duration) {
+	upstreamPools = make(map[*url.URL]*upstreamPool)
+	add := func(u *url.URL, extra []*url.URL) {
+		if u == nil || len(extra) == 0 {
+			return
+		}
+		p := &upstreamPool{}
+		for _, b := range append([]*url.URL{u}, extra...) {
+			p.backends = append(p.backends, &backend{url: b})
+		}
+		if interval > 0 {
+			for _, b := range p.backends {
+				if b.url == u {
+					// Already checked
+					b.health = healthOf(u)
+					continue
+				}
+				b.health = newHealthChecker(b.url, t)
+				go b.health.Run(ctx, interval)
+			}
+		}
+		upstreamPools[u] = p
+		log.Printf("[balancer] Balancing %v among %d backends (%v)", u, len(p.backends), conf.Balance)
+	}
+	add(upstreamUrl, conf.UpstreamBackends[""])
+	for _, host := range conf.UpstreamRoutes.Hosts() {
+		add(conf.UpstreamRoutes[host], conf.UpstreamBackends[host])
+	}
+}
+
+// available reports whether b can take requests: it has not failed
+// recently, nor its last health check.
+func (b *backend) available() bool {
+	if b.health != nil && !b.health.Healthy() {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return time.Now().After(b.downUntil)
+}
+
+// fail takes b out of the pool for --upstream-fail-timeout.
+func (b *backend) fail(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().After(b.downUntil) {
+		log.Printf("[balancer] Backend %v failed, unavailable for %v: %v", b.url, conf.UpstreamFailTimeout, err)
+	}
+	b.downUntil = time.Now().Add(conf.UpstreamFailTimeout)
+	b.lastErr = err
+}
+
+// Pick returns the next available backend, per --balance, or nil if none
+// is.
+func (p *upstreamPool) Pick() *backend {
+	n := len(p.backends)
+	start := int(atomic.AddUint32(&p.next, 1)-1) % n
+	var picked *backend
+	for i := 0; i < n; i++ {
+		b := p.backends[(start+i)%n]
+		if !b.available() {
+			continue
+		}
+		if conf.Balance == "round-robin" {
+			return b
+		}
+		if picked == nil || atomic.LoadInt64(&b.active) < atomic.LoadInt64(&picked.active) {
+			picked = b
+		}
+	}
+	return picked
+}
+
+// Available reports whether any backend can take requests.
+func (p *upstreamPool) Available() bool {
+	for _, b := range p.backends {
+		if b.available() {
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns the state of each backend, for /stats.
+func (p *upstreamPool) Status() []map[string]interface{} {
+	var s []map[string]interface{}
+	for _, b := range p.backends {
+		st := map[string]interface{}{
+			"url":       b.url.String(),
+			"available": b.available(),
+			"active":    atomic.LoadInt64(&b.active),
+		}
+		b.mu.Lock()
+		if b.lastErr != nil {
+			st["error"] = b.lastErr.Error()
+		}
+		b.mu.Unlock()
+		s = append(s, st)
+	}
+	return s
+}
+
+// balance directs r to a backend of its upstream pool, if it has one,
+// returning it so the result is reported with done. It fails if no
+// backend is available.
+func balance(r *http.Request) (*backend, error) {
+	p := upstreamPools[requestUpstream(r)]
+	if p == nil {
+		return nil, nil
+	}
+	b := p.Pick()
+	if b == nil {
+		return nil, errUpstreamUnhealthy
+	}
+	r.URL.Scheme = b.url.Scheme
+	r.URL.Host = b.url.Host
+	r.Host = b.url.Host
+	atomic.AddInt64(&b.active, 1)
+	debugf("[balancer] Sending '%v' to %v", r.URL.RequestURI(), b.url)
+	return b, nil
+}
+
+// done records the result of r, sent to b, keeping it counted as active
+// until the body of w is closed. Requests canceled by clients are not
+// failures of b.
+func (b *backend) done(r *http.Request, w *http.Response, err error) {
+	if err != nil && r.Context().Err() == nil {
+		b.fail(err)
+	}
+	if err != nil || w.StatusCode == http.StatusSwitchingProtocols {
+		atomic.AddInt64(&b.active, -1)
+		return
+	}
+	w.Body = &backendBody{ReadCloser: w.Body, b: b}
+}
+
+// backendBody ends a request to a backend once its body is closed.
+type backendBody struct {
+	io.ReadCloser
+	b    *backend
+	once sync.Once
+}
+
+func (body *backendBody) Close() error {
+	body.once.Do(func() { atomic.AddInt64(&body.b.active, -1) })
+	return body.ReadCloser.Close()
+}
+
+// retryable reports whether r can be sent again to another backend: it is
+// idempotent and has no body to replay.
+func retryable(r *http.Request) bool {
+	return (r.Method == http.MethodGet || r.Method == http.MethodHead) &&
+		(r.Body == nil || r.Body == http.NoBody) && r.Context().Err() == nil
+}
@@ -0,0 +1,206 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// defaultRewriteBodyTypes are the media types rewritten by --rewrite-body,
+// unless set by --rewrite-body-types.
+const defaultRewriteBodyTypes = "text/html,text/css,text/javascript,application/javascript,application/json"
+
+// rewriteBody replaces the absolute URLs of the upstream of w, or any of
+// its backends, in its body, with paths relative to the proxy, or URLs on
+// --rewrite-body-origin, so apps emitting absolute links keep working
+// behind the proxy. Cookies for the upstream domain are moved to the proxy
+// one too. Only bodies of --rewrite-body-types are rewritten, and stored
+// as such in the cache.
+func rewriteBody(w *http.Response) error {
+	u := requestUpstream(w.Request)
+	if u == nil || w.Request.Method == http.MethodHead {
+		return nil
+	}
+	switch w.StatusCode {
+	case http.StatusPartialContent, http.StatusNotModified, http.StatusSwitchingProtocols:
+		return nil
+	}
+	targets := []*url.URL{u}
+	if p := upstreamPools[u]; p != nil {
+		targets = targets[:0]
+		for _, b := range p.backends {
+			targets = append(targets, b.url)
+		}
+	}
+	rewriteCookieDomains(w.Header, targets)
+	if !matchMediaType(w.Header.Get("Content-Type"), conf.RewriteBodyTypes) {
+		return nil
+	}
+	switch strings.ToLower(w.Header.Get("Content-Encoding")) {
+	case "", "identity", "gzip", "x-gzip", "deflate":
+		if err := decodeBody(w); err != nil {
+			return err
+		}
+	default:
+		// Left as it is, rather than failing
+		return nil
+	}
+	// Paths under a routed prefix are mapped back, as for Location headers
+	base, prefix := "", ""
+	if p := routedPrefix(u); p != "" && u.Path != "" {
+		base, prefix = strings.TrimSuffix(u.EscapedPath(), "/"), strings.TrimSuffix(p, "/")
+	}
+	to := strings.TrimSuffix(conf.RewriteBodyOrigin, "/") + prefix
+	var rules []urlRewrite
+	for _, t := range targets {
+		host := strings.ToLower(t.Host)
+		for _, from := range []string{strings.ToLower(t.Scheme) + "://" + host + base, "//" + host + base} {
+			rules = append(rules,
+				urlRewrite{from: from, to: to, slash: "/"},
+				// Escaped in JSON strings
+				urlRewrite{from: strings.ReplaceAll(from, "/", `\/`), to: strings.ReplaceAll(to, "/", `\/`), slash: `\/`})
+		}
+	}
+	w.Body = newURLRewriter(w.Body, rules)
+	w.ContentLength = -1
+	w.Header.Del("Content-Length")
+	if etag := w.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		w.Header.Set("ETag", "W/"+etag)
+	}
+	return nil
+}
+
+// rewriteCookieDomains moves the cookies set for the domain of targets to
+// the host of --rewrite-body-origin, or makes them host-only, so they are
+// sent back to the proxy.
+func rewriteCookieDomains(h http.Header, targets []*url.URL) {
+	domain := ""
+	if o, err := url.Parse(conf.RewriteBodyOrigin); err == nil {
+		domain = o.Hostname()
+	}
+	cookies := h.Values("Set-Cookie")
+	for i, c := range cookies {
+		parts := strings.Split(c, ";")
+		out := parts[:1]
+		for _, p := range parts[1:] {
+			attr := strings.TrimSpace(p)
+			if strings.HasPrefix(strings.ToLower(attr), "domain=") {
+				d := strings.TrimPrefix(strings.ToLower(attr[len("domain="):]), ".")
+				for _, t := range targets {
+					if d == strings.ToLower(t.Hostname()) {
+						attr = ""
+						if domain != "" {
+							attr = "Domain=" + domain
+						}
+						break
+					}
+				}
+				if attr == "" {
+					continue
+				}
+			}
+			out = append(out, " "+attr)
+		}
+		cookies[i] = strings.Join(out, ";")
+	}
+}
+
+// urlRewrite replaces the URL prefix from by to, followed by slash if to
+// is empty and the URL has no path of its own.
+type urlRewrite struct {
+	from, to, slash string
+}
+
+// urlRewriter applies urlRewrites to a body as it is read. URLs must end
+// at a delimiter, so a rule for example.com leaves example.com.evil alone.
+type urlRewriter struct {
+	body  io.ReadCloser
+	rules []urlRewrite
+	keep  int // input held back, as it may start a URL
+
+	buf, in, out []byte
+	last         byte // the byte before in
+	err          error
+}
+
+func newURLRewriter(body io.ReadCloser, rules []urlRewrite) *urlRewriter {
+	keep := 0
+	for _, r := range rules {
+		if n := len(r.from) + len(r.slash); n > keep {
+			keep = n
+		}
+	}
+	return &urlRewriter{body: body, rules: rules, keep: keep, buf: make([]byte, 32<<10)}
+}
+
+func (u *urlRewriter) Read(p []byte) (int, error) {
+	for len(u.out) == 0 && u.err == nil {
+		n, err := u.body.Read(u.buf)
+		u.in = append(u.in, u.buf[:n]...)
+		u.err = err
+		u.rewrite(err != nil)
+	}
+	if len(u.out) > 0 {
+		n := copy(p, u.out)
+		u.out = u.out[n:]
+		return n, nil
+	}
+	return 0, u.err
+}
+
+func (u *urlRewriter) Close() error {
+	return u.body.Close()
+}
+
+// rewrite moves the input to the output, replacing URLs, and holding back
+// its end unless final.
+func (u *urlRewriter) rewrite(final bool) {
+	limit := len(u.in)
+	if !final {
+		limit -= u.keep
+	}
+	start := 0
+	for i := 0; i < limit; i++ {
+		if c := u.in[i]; c != '/' && c != '\\' && c != 'h' {
+			continue
+		}
+		prev := u.last
+		if i > 0 {
+			prev = u.in[i-1]
+		}
+		if isURLByte(prev) {
+			// Within another URL, or a longer scheme
+			continue
+		}
+		for _, r := range u.rules {
+			end := i + len(r.from)
+			if !bytes.HasPrefix(u.in[i:], []byte(r.from)) || end < len(u.in) && isURLByte(u.in[end]) {
+				continue
+			}
+			u.out = append(u.out, u.in[start:i]...)
+			to := r.to
+			if to == "" && !bytes.HasPrefix(u.in[end:], []byte(r.slash)) {
+				to = r.slash
+			}
+			u.out = append(u.out, to...)
+			start, i = end, end-1
+			break
+		}
+	}
+	if start < limit {
+		u.out = append(u.out, u.in[start:limit]...)
+		start = limit
+	}
+	if start > 0 {
+		u.last = u.in[start-1]
+		u.in = append(u.in[:0], u.in[start:]...)
+	}
+}
+
+// isURLByte reports whether c continues a host name, port or path segment.
+func isURLByte(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		strings.IndexByte("-._~:%", c) >= 0
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// circuitOpenError is returned for requests not sent to an upstream while
+// its circuit breaker is open.
+type circuitOpenError struct {
+	host string
+	wait time.Duration
+}
+
+func (e *circuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %v is open for %v", e.host, e.wait.Round(time.Second))
+}
+
+// circuitBreaker stops sending requests to an upstream host after
+// --circuit-breaker-failures consecutive failures, during
+// --circuit-breaker-cooldown. A single request is then let through to probe
+// the host: its success closes the circuit, while its failure opens it
+// again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	probe     time.Time // when the last probe was let through
+}
+
+// breaker tracks upstream failures, or is nil unless
+// --circuit-breaker-failures is set.
+var breaker *circuitBreaker
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{threshold: threshold, cooldown: cooldown, hosts: make(map[string]*circuit)}
+}
+
+// Allow returns an error unless a request can be sent to host. Once the
+// cooldown is over, one request at a time is let through as a probe, until
+// one of them completes.
+func (cb *circuitBreaker) Allow(host string) error {
+	if cb == nil {
+		return nil
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c, ok := cb.hosts[host]
+	if !ok || c.failures < cb.threshold {
+		return nil
+	}
+	now := time.Now()
+	if wait := c.openUntil.Sub(now); wait > 0 {
+		return &circuitOpenError{host: host, wait: wait}
+	}
+	if now.Sub(c.probe) < cb.cooldown {
+		// Another probe is in flight
+		return &circuitOpenError{host: host, wait: c.probe.Add(cb.cooldown).Sub(now)}
+	}
+	c.probe = now
+	return nil
+}
+
+// Record records the outcome of a request sent to host.
+func (cb *circuitBreaker) Record(host string, failed bool) {
+	if cb == nil {
+		return
+	}
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	c, ok := cb.hosts[host]
+	if !failed {
+		if ok && c.failures >= cb.threshold {
+			log.Printf("[breaker] Closing the circuit for %v", host)
+		}
+		delete(cb.hosts, host)
+		return
+	}
+	if !ok {
+		c = &circuit{}
+		cb.hosts[host] = c
+	}
+	if c.failures++; c.failures >= cb.threshold {
+		if c.failures == cb.threshold || !c.probe.IsZero() {
+			log.Printf("[breaker] Opening the circuit for %v for %v, after %d consecutive failures", host, cb.cooldown, c.failures)
+		}
+		c.openUntil, c.probe = time.Now().Add(cb.cooldown), time.Time{}
+	}
+}
+
+// Open returns the hosts whose circuit is open.
+func (cb *circuitBreaker) Open() []string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	var hosts []string
+	for host, c := range cb.hosts {
+		if c.failures >= cb.threshold {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// retryFetch reports whether the upstream response w, or error err, is a
+// transient failure worth retrying.
+func retryFetch(w *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled)
+	}
+	switch w.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// backoff waits before the retry attempt of r, doubling
+// --upstream-retry-backoff after each one. It reports false if r is
+// canceled meanwhile.
+func backoff(r *http.Request, attempt int) bool {
+	d := conf.UpstreamRetryBackoff << (attempt - 1)
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// proxyError replies to requests that could not be sent upstream: with a
+// 503 while the circuit breaker is open, or else with a 502, as
+// httputil.ReverseProxy does.
+func proxyError(w http.ResponseWriter, r *http.Request, err error) {
+	var open *circuitOpenError
+	if errors.As(err, &open) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(open.wait.Seconds()))))
+		http.Error(w, "503 Service Unavailable: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if errors.Is(err, errForbiddenTarget) {
+		http.Error(w, "403 Forbidden: "+errForbiddenTarget.Error(), http.StatusForbidden)
+		return
+	}
+	log.Printf("http: proxy error: %v", err)
+	w.WriteHeader(http.StatusBadGateway)
+}
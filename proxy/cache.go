@@ -0,0 +1,474 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// expiresHeader is stored along with the cached headers, recording when
+// the entry expires. It is never sent to clients.
+const expiresHeader = "X-Simpleproxy-Expires"
+
+// statusHeader is stored along with the cached headers for responses
+// other than 200 OK, recording their status code.
+const statusHeader = "X-Simpleproxy-Status"
+
+var errExpired = errors.New("cache entry expired")
+
+// CacheManager is a helper interface to abstract the FS cache
+type CacheManager interface {
+	// Put stores a file and relevant HTTP headers.
+	Put(key string, blob io.ReadCloser, h http.Header) error
+
+	// Get retrieves both file and metadata.
+	Get(key string) (blob io.ReadCloser, h http.Header, err error)
+
+	// Flush expires the cached file from underlying storage.
+	Flush(key string) error
+}
+
+// FsCache cache files in the local filesystem at dir.
+//
+// Each entry is a directory holding the blob and its headers. Entries are
+// written to a staging directory first, and only moved into the committed
+// tree once complete; evicted entries are moved to a trash directory
+// before being removed. Both live in dir, so moves are atomic renames
+// within the same filesystem. Committed entries are sharded into
+// subdirectories by the hash of their key, and indexed in memory.
+type FsCache struct {
+	dir   string
+	index *fsIndex
+	locks keyLocks
+
+	// maxSize and lru are set by SetMaxSize.
+	maxSize int64
+	lru     *lruIndex
+
+	// maxAge and usedGranularity are set by SetMaxAge, whose janitor
+	// runs until stopSweep is closed by Close.
+	maxAge          time.Duration
+	usedGranularity time.Duration
+	stopSweep       chan struct{}
+}
+
+const (
+	stagingDir = ".staging"
+	trashDir   = ".trash"
+
+	// blobFile is the name of the blob in the directory of an entry,
+	// next to blobFile.headers.
+	blobFile = "blob"
+)
+
+// Ensures we implement CacheManager interface
+var _ CacheManager = &FsCache{}
+
+func NewFsCache(dir string) *FsCache {
+	// Try to initialize the cache directory, removing files left behind
+	// by writes and evictions interrupted by a crash, unless the worker
+	// being replaced on reload is still writing them.
+	_, reloaded := os.LookupEnv(reloadedEnv)
+	for _, d := range []string{stagingDir, trashDir} {
+		if !reloaded {
+			if err := os.RemoveAll(filepath.Join(dir, d)); err != nil {
+				log.Printf("[fscache] error cleaning up %v: %v", d, err)
+			}
+		}
+		if err := os.MkdirAll(filepath.Join(dir, d), 0777); err != nil {
+			log.Printf("[fscache] error initializing directory: %v", err)
+		}
+	}
+	c := &FsCache{dir: dir}
+	c.loadIndex(!reloaded)
+	return c
+}
+
+// Check verifies that the cache directory is writable.
+func (c *FsCache) Check() error {
+	fd, err := os.CreateTemp(filepath.Join(c.dir, stagingDir), ".check-*")
+	if err != nil {
+		return err
+	}
+	fd.Close()
+	return os.Remove(fd.Name())
+}
+
+func (c *FsCache) Put(key string, blob io.ReadCloser, h http.Header) (err error) {
+	k, key := key, c.path(key)
+	log.Printf("[fscache] Storing key=%v", key)
+
+	// Stage the blob and headers in a new entry directory
+	staged, err := c.stageEntry()
+	if err != nil {
+		log.Printf("[fscache] error storing key=%v: %v", key, err)
+		return err
+	}
+	defer os.RemoveAll(staged)
+	err = writeStaged(filepath.Join(staged, blobFile), func(w io.Writer) error {
+		_, err := io.Copy(w, blob)
+		return err
+	})
+	if err != nil {
+		log.Printf("[fscache] error storing key=%v: %v", key, err)
+		return err
+	}
+
+	// Copy every value of multi-valued headers, which must never be
+	// merged into a single line, but never hop-by-hop ones.
+	aux := h.Clone()
+	removeHopHeaders(aux)
+	err = writeStaged(filepath.Join(staged, blobFile+".headers"), func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(aux)
+	})
+	if err != nil {
+		log.Printf("[fscache] error storing key=%v: %v", key, err)
+		return err
+	}
+	var sizes [2]int64
+	for i, name := range []string{blobFile, blobFile + ".headers"} {
+		if st, err := os.Stat(filepath.Join(staged, name)); err == nil {
+			sizes[i] = st.Size()
+		}
+	}
+
+	// Commit the entry in one rename. Readers holding the previous files
+	// open are not disturbed, and never see a partially written entry.
+	unlock := c.locks.lock(key)
+	if err = c.commit(key, staged); err != nil {
+		log.Printf("[fscache] error storing key=%v: %v", key, err)
+		// The previous entry may be gone already
+		c.forget(key)
+		unlock()
+		return err
+	}
+	c.index.set(newIndexEntry(k, aux, sizes[0], sizes[1], time.Now()))
+	c.track(key, sizes[0]+sizes[1])
+	unlock()
+	c.evictLRU()
+	return nil
+}
+
+// stage calls write with a new file in the staging directory, returning
+// its name.
+func (c *FsCache) stage(write func(w io.Writer) error) (name string, err error) {
+	fd, err := os.CreateTemp(filepath.Join(c.dir, stagingDir), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFile(fd, write); err != nil {
+		return "", err
+	}
+	return fd.Name(), nil
+}
+
+// stageEntry returns a new entry directory in the staging directory.
+func (c *FsCache) stageEntry() (string, error) {
+	d, err := os.MkdirTemp(filepath.Join(c.dir, stagingDir), ".tmp-*")
+	if err != nil {
+		return "", err
+	}
+	// MkdirTemp uses 0700, but cached files are not private
+	if err := os.Chmod(d, 0755); err != nil {
+		os.Remove(d)
+		return "", err
+	}
+	return d, nil
+}
+
+// writeStaged calls write with the new file name.
+func writeStaged(name string, write func(w io.Writer) error) error {
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	return writeFile(fd, write)
+}
+
+// writeFile calls write with fd, closing it, and removing it on failure.
+func writeFile(fd *os.File, write func(w io.Writer) error) (err error) {
+	// Created as 0600, but cached files are not private
+	if err = fd.Chmod(0644); err == nil {
+		err = write(fd)
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+	}
+	return err
+}
+
+// commit moves the staged entry directory into the committed tree as the
+// entry of the blob key, replacing the previous one. It must be called
+// with key locked.
+func (c *FsCache) commit(key, staged string) error {
+	entry := filepath.Dir(key)
+	// Keys may be grouped in subdirectories
+	if err := os.MkdirAll(filepath.Dir(entry), 0777); err != nil {
+		return err
+	}
+	// Directories are never replaced by a rename, so the previous entry
+	// is moved away first: readers miss it until the new one is in place.
+	old, err := c.trash(entry)
+	if err == nil {
+		defer os.RemoveAll(old)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(staged, entry)
+}
+
+// evict moves the committed files of key to the trash before removing
+// them, so the entry disappears at once from the committed tree.
+func (c *FsCache) evict(key string) error {
+	unlock := c.locks.lock(key)
+	defer unlock()
+	c.forget(key)
+	names := []string{filepath.Dir(key)}
+	if filepath.Base(key) != blobFile {
+		// Stored by older versions, next to each other
+		names = []string{key + ".headers", key}
+	}
+	var err error
+	for _, name := range names {
+		trashed, terr := c.trash(name)
+		if terr != nil {
+			if !os.IsNotExist(terr) && err == nil {
+				err = terr
+			}
+			continue
+		}
+		os.RemoveAll(trashed)
+	}
+	return err
+}
+
+// forget removes key from the LRU and the index.
+func (c *FsCache) forget(key string) {
+	c.untrack(key)
+	c.index.remove(c.keyOf(key))
+}
+
+// trash moves name into the trash directory, returning its new name.
+func (c *FsCache) trash(name string) (string, error) {
+	d, err := os.MkdirTemp(filepath.Join(c.dir, trashDir), ".evict-*")
+	if err != nil {
+		return "", err
+	}
+	trashed := filepath.Join(d, filepath.Base(name))
+	if err := os.Rename(name, trashed); err != nil {
+		os.Remove(d)
+		return "", err
+	}
+	return d, nil
+}
+
+// Get returns the cached blob as an *os.File, so callers can seek on it and
+// the HTTP server can use sendfile(2) when copying it to the client.
+func (c *FsCache) Get(key string) (blob io.ReadCloser, h http.Header, err error) {
+	k, key := key, c.path(key)
+	// Both files are read from the same entry directory, even if it is
+	// replaced meanwhile.
+	entry, err := os.OpenRoot(filepath.Dir(key))
+	if err != nil {
+		log.Printf("[fscache] error opening cache key=%v: %v", key, err)
+		if os.IsNotExist(err) {
+			c.index.remove(k)
+		}
+		return
+	}
+	defer entry.Close()
+	fd, err := entry.Open(blobFile)
+	if err != nil {
+		log.Printf("[fscache] error opening cache key=%v: %v", key, err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			fd.Close()
+		}
+	}()
+	st, err := fd.Stat()
+	if err != nil {
+		log.Printf("[fscache] error reading cache key=%v: %v", key, err)
+		return
+	}
+	hb, err := entry.ReadFile(blobFile + ".headers")
+	if err != nil {
+		log.Printf("[fscache] error opening cache headers=%v.headers: %v", key, err)
+		return
+	}
+	h = make(http.Header)
+	if err = json.Unmarshal(hb, &h); err != nil {
+		log.Printf("[fscache] error decoding headers: %v", err)
+		return
+	}
+	switch err = checkExpiry(k, h); err {
+	case nil:
+	case errExpired:
+		events.Emit(eventEvict, k, h.Get(uriHeader), st.Size())
+		c.evict(key)
+		return nil, nil, err
+	default:
+		return nil, nil, err
+	}
+	// Entries stored by another process, as a worker being replaced on
+	// reload, are indexed once read.
+	c.index.add(newIndexEntry(k, h, st.Size(), int64(len(hb)), st.ModTime()))
+	// The length is always the one of the blob, which may differ from the
+	// upstream one if it was decoded.
+	h.Set("content-length", strconv.FormatInt(st.Size(), 10))
+	h.Del(mustRevalidateHeader)
+	h.Del(uriHeader)
+	c.touch(k)
+	log.Printf("[fscache] Cache hit!")
+	return fd, h, nil
+}
+
+// checkExpiry applies the expiration policy to the cached headers h of key.
+// Expired entries are kept during the --stale-grace window, or the
+// stale-while-revalidate one set by upstream, and the expiration is left in
+// h so callers can tell them apart. Entries with validators are kept past
+// it, marked to be revalidated upstream. It returns errExpired for entries
+// to evict, and errMustRevalidate for entries to keep but not serve.
+func checkExpiry(key string, h http.Header) error {
+	grace, ifError := staleWindows(h)
+	e := h.Get(expiresHeader)
+	if e == "" {
+		return nil
+	}
+	t, perr := http.ParseTime(e)
+	must := h.Get(mustRevalidateHeader) != ""
+	expired := perr == nil && time.Now().After(t)
+	pastGrace := perr == nil && time.Now().After(t.Add(grace))
+	onError := conf.ServeStaleOnError || perr == nil && time.Now().Before(t.Add(ifError))
+	switch {
+	case (pastGrace || must && expired) && hasValidators(h):
+		log.Printf("[cache] Expired key=%v must be revalidated", key)
+		switch {
+		case must:
+			h.Set(revalidateHeader, revalidateMust)
+		case onError:
+			h.Set(revalidateHeader, revalidateOnError)
+		default:
+			h.Set(revalidateHeader, revalidateMay)
+		}
+	case must && expired:
+		// Never served stale: keep it until it is fetched again,
+		// so failures to do so are reported as such.
+		log.Printf("[cache] Expired key=%v must be revalidated", key)
+		return errMustRevalidate
+	case pastGrace && pins.Has(key, h.Get(uriHeader)):
+		// Pinned entries are served stale, and refreshed, but
+		// never evicted.
+		log.Printf("[cache] Keeping expired pinned key=%v", key)
+	case pastGrace && onError:
+		// Fetched again, but kept in case upstream fails
+		log.Printf("[cache] Expired key=%v kept to serve on upstream errors", key)
+		h.Set(revalidateHeader, revalidateOnError)
+	case pastGrace:
+		log.Printf("[cache] Expired key=%v", key)
+		return errExpired
+	}
+	return nil
+}
+
+// UpdateHeaders replaces the stored headers of key by the result of
+// update, leaving the blob untouched.
+func (c *FsCache) UpdateHeaders(key string, update func(h http.Header)) error {
+	k, key := key, c.path(key)
+	unlock := c.locks.lock(key)
+	defer unlock()
+	hb, err := os.ReadFile(key + ".headers")
+	if err != nil {
+		return err
+	}
+	h := make(http.Header)
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return err
+	}
+	update(h)
+	staged, err := c.stage(func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(h)
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(staged, key+".headers"); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	if e, ok := c.index.get(k); ok {
+		c.index.set(newIndexEntry(k, h, e.Size, e.HeaderSize, e.Stored))
+	}
+	return nil
+}
+
+// FlushTenant removes all entries stored for tenant.
+func (c *FsCache) FlushTenant(tenant string) error {
+	c.untrackDir(filepath.Join(c.dir, tenantDir(tenant)))
+	c.index.removeDir(tenantDir(tenant))
+	d, err := c.trash(filepath.Join(c.dir, tenantDir(tenant)))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return os.RemoveAll(d)
+}
+
+// Flush removes the entry stored at key, returning an error satisfying
+// os.IsNotExist if there is none.
+func (c *FsCache) Flush(key string) (err error) {
+	key = c.path(key)
+	if _, err := os.Stat(key + ".headers"); err != nil {
+		return err
+	}
+	return c.evict(key)
+}
+
+// keyLocks serializes the writes to each entry of a FsCache. The zero
+// value is ready to use.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock locks key, returning the function unlocking it.
+func (l *keyLocks) lock(key string) (unlock func()) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*keyLock)
+	}
+	kl, ok := l.locks[key]
+	if !ok {
+		kl = &keyLock{}
+		l.locks[key] = kl
+	}
+	kl.waiters++
+	l.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if kl.waiters--; kl.waiters == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
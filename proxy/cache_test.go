@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFsCachePutCommitFailure(t *testing.T) {
+	parseTestFlags(t)
+	c := NewFsCache(t.TempDir())
+	key := "failing"
+	// A file in the way of the shard directory fails the commit
+	shard := filepath.Dir(filepath.Dir(c.path(key)))
+	if err := os.WriteFile(shard, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	h := http.Header{"Content-Type": {"text/plain"}}
+	if err := c.Put(key, io.NopCloser(strings.NewReader("body")), h); err == nil {
+		t.Fatal("Put succeeded, want an error committing the entry")
+	}
+	if _, _, err := c.Get(key); err == nil {
+		t.Errorf("Get found the entry that failed to be stored")
+	}
+	staged, _ := os.ReadDir(filepath.Join(c.dir, stagingDir))
+	if len(staged) > 0 {
+		t.Errorf("%d staged files left behind", len(staged))
+	}
+}
+
+func TestFsCachePutGet(t *testing.T) {
+	parseTestFlags(t)
+	c := NewFsCache(t.TempDir())
+	h := http.Header{"Content-Type": {"text/plain"}}
+	if err := c.Put("entry", io.NopCloser(strings.NewReader("body")), h); err != nil {
+		t.Fatal(err)
+	}
+	b, got, err := c.Get("entry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	body, _ := io.ReadAll(b)
+	if string(body) != "body" || got.Get("Content-Type") != "text/plain" || got.Get("Content-Length") != "4" {
+		t.Errorf("got %q with headers %v", body, got)
+	}
+}
+
+func TestFsCachePutKeepsEveryValue(t *testing.T) {
+	parseTestFlags(t)
+	c := NewFsCache(t.TempDir())
+	// Repeated lines are never merged, even for single-valued headers
+	h := http.Header{"Content-Type": {"text/plain", "charset=utf-8"}}
+	if err := c.Put("entry", io.NopCloser(strings.NewReader("body")), h); err != nil {
+		t.Fatal(err)
+	}
+	b, got, err := c.Get("entry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if v := got.Values("Content-Type"); len(v) != 2 || v[0] != "text/plain" || v[1] != "charset=utf-8" {
+		t.Errorf("got Content-Type %q, want both values apart", v)
+	}
+}
+
+func TestFsCacheEvictEvents(t *testing.T) {
+	parseTestFlags(t)
+	sink := &eventSink{queue: make(chan cacheEvent, 10)}
+	events = sink
+	t.Cleanup(func() { events = nil })
+	put := func(c *FsCache, key, uri, body string) {
+		t.Helper()
+		if err := c.Put(key, io.NopCloser(strings.NewReader(body)), http.Header{uriHeader: {uri}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := func(how string, key, uri string, size int64) {
+		t.Helper()
+		select {
+		case e := <-sink.queue:
+			if e.Type != eventEvict || e.Key != key || e.URI != uri || e.Size != size {
+				t.Errorf("%v: got event %+v, want the eviction of %v for %v with %d bytes", how, e, key, uri, size)
+			}
+		default:
+			t.Errorf("%v: no eviction event", how)
+		}
+	}
+
+	c := NewFsCache(t.TempDir())
+	put(c, "old", "/old", "old body")
+	put(c, "new", "/new", "new")
+	c.SetMaxSize(1)
+	want("LRU", "old", "/old", 8)
+	want("LRU", "new", "/new", 3)
+
+	c = NewFsCache(t.TempDir())
+	put(c, "unused", "/unused", "unused body")
+	c.maxAge = time.Nanosecond
+	c.sweep()
+	want("janitor", "unused", "/unused", 11)
+}
+
+func TestFsCacheFlushTenant(t *testing.T) {
+	parseTestFlags(t)
+	c := NewFsCache(t.TempDir())
+	if err := c.SetMaxSize(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"acme/a", "acme/b", "other/a"} {
+		if err := c.Put(key, io.NopCloser(strings.NewReader("body")), make(http.Header)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	size := c.Stats()["size"]
+	if err := c.Flush("acme/a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.FlushTenant("acme"); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, e := range c.index.list() {
+		keys = append(keys, e.Key)
+	}
+	if len(keys) != 1 || keys[0] != "other/a" {
+		t.Errorf("index has %v after the flush, want only other/a", keys)
+	}
+	if got := c.Stats()["size"]; got != size/3 {
+		t.Errorf("tracked size is %d after the flush, want %d for other/a", got, size/3)
+	}
+}
+
+func TestFsCacheConcurrentPuts(t *testing.T) {
+	parseTestFlags(t)
+	c := NewFsCache(t.TempDir())
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		version := strconv.Itoa(i)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				body := strings.Repeat(version, 100+j)
+				if err := c.Put("entry", io.NopCloser(strings.NewReader(body)), http.Header{"X-Version": {version}}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				b, h, err := c.Get("entry")
+				if err != nil {
+					continue
+				}
+				body, _ := io.ReadAll(b)
+				b.Close()
+				if v := h.Get("X-Version"); strings.Trim(string(body), v) != "" || h.Get("Content-Length") != strconv.Itoa(len(body)) {
+					t.Errorf("got a body of %d bytes %.10q... with version %v", len(body), body, v)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if _, _, err := c.Get("entry"); err != nil {
+		t.Errorf("no entry left after the writes: %v", err)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(filepath.Dir(c.path("entry"))))
+	if len(entries) != 1 {
+		t.Errorf("got %d files in the shard, want the entry directory alone", len(entries))
+	}
+}
+
+func TestFsCacheMigratesOlderLayouts(t *testing.T) {
+	parseTestFlags(t)
+	dir := t.TempDir()
+	// Flat, then sharded, each blob next to its headers
+	for name, body := range map[string]string{
+		filepath.Join(dir, "flat"):                         "flat body",
+		filepath.Join(dir, shardDir("sharded"), "sharded"): "sharded body",
+	} {
+		os.MkdirAll(filepath.Dir(name), 0777)
+		if err := os.WriteFile(name, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(name+".headers", []byte(`{"Content-Type":["text/plain"]}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewFsCache(dir)
+	for _, key := range []string{"flat", "sharded"} {
+		b, h, err := c.Get(key)
+		if err != nil {
+			t.Errorf("Get(%v): %v", key, err)
+			continue
+		}
+		body, _ := io.ReadAll(b)
+		b.Close()
+		if string(body) != key+" body" || h.Get("Content-Type") != "text/plain" {
+			t.Errorf("Get(%v) = %q with headers %v", key, body, h)
+		}
+		if _, err := os.Stat(c.path(key) + ".headers"); err != nil {
+			t.Errorf("%v not moved into its entry directory: %v", key, err)
+		}
+	}
+}
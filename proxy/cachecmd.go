@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// CacheCommand runs the cache subcommand in args on the entries in the
+// --cache-dir of cfg, without running the proxy, writing its output to out:
+//
+//	ls [PREFIX]     lists the entries, or those whose URI starts with PREFIX
+//	show URI|KEY    prints the stored headers of the matching entries
+//	rm URI|KEY      removes the matching entries
+//	stats           sums up the entries
+//
+// URIs match the entries stored for them, including their variants, once
+// normalized as cache keys are.
+func CacheCommand(cfg *Config, args []string, out io.Writer) error {
+	conf = cfg
+	if conf.ConfigFile != "" {
+		if err := loadConfig(conf.ConfigFile); err != nil {
+			return fmt.Errorf("invalid --config: %v", err)
+		}
+	}
+	if len(args) == 0 {
+		return errors.New("missing subcommand: use ls, show, rm or stats")
+	}
+	if conf.CacheBackend != "fs" {
+		return fmt.Errorf("the cache command requires --cache-backend=fs")
+	}
+	if _, err := os.Stat(conf.CacheDir); err != nil {
+		return err
+	}
+	// Unlike NewFsCache, leaves alone the writes of a running proxy
+	if err := os.MkdirAll(filepath.Join(conf.CacheDir, trashDir), 0777); err != nil {
+		return err
+	}
+	c := &FsCache{dir: conf.CacheDir}
+	sub, args := args[0], args[1:]
+	switch {
+	case sub == "ls" && len(args) <= 1:
+		prefix := ""
+		if len(args) == 1 {
+			prefix = args[0]
+		}
+		return listCacheEntries(c, prefix, out)
+	case sub == "show" && len(args) == 1:
+		return showCacheEntries(c, args[0], out)
+	case sub == "rm" && len(args) == 1:
+		return removeCacheEntries(c, args[0], out)
+	case sub == "stats" && len(args) == 0:
+		return printCacheStats(c, out)
+	case sub == "ls":
+		return errors.New("usage: cache ls [PREFIX]")
+	case sub == "show" || sub == "rm":
+		return fmt.Errorf("usage: cache %v URI|KEY", sub)
+	case sub == "stats":
+		return errors.New("usage: cache stats")
+	}
+	return fmt.Errorf("unknown subcommand %q: use ls, show, rm or stats", sub)
+}
+
+func listCacheEntries(c *FsCache, prefix string, out io.Writer) error {
+	now := time.Now()
+	tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "SIZE\tAGE\tEXPIRES\tURI\tKEY")
+	err := c.Entries(func(e cacheEntry) error {
+		if !strings.HasPrefix(storedURI(e), prefix) {
+			return nil
+		}
+		fmt.Fprintf(tw, "%d\t%v\t%v\t%v\t%v\n", e.Size, formatAge(now.Sub(e.Stored)), formatExpires(e.Expires, now), entryURI(e), e.Key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func showCacheEntries(c *FsCache, target string, out io.Writer) error {
+	entries, err := matchCacheEntries(c, target)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i, e := range entries {
+		b, err := os.ReadFile(e.name + ".headers")
+		if err != nil {
+			return err
+		}
+		h := make(http.Header)
+		if err := json.Unmarshal(b, &h); err != nil {
+			return fmt.Errorf("%v: %v", e.Key, err)
+		}
+		if i > 0 {
+			fmt.Fprintln(out)
+		}
+		fmt.Fprintf(out, "Key: %v\nURI: %v\nSize: %d\nStored: %v (%v ago)\n",
+			e.Key, entryURI(e), e.Size, e.Stored.UTC().Format(time.RFC3339), formatAge(now.Sub(e.Stored)))
+		if !e.Expires.IsZero() {
+			fmt.Fprintf(out, "Expires: %v (%v)\n", e.Expires.UTC().Format(time.RFC3339), formatExpires(e.Expires, now))
+		}
+		fmt.Fprintln(out)
+		if err := h.Write(out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeCacheEntries(c *FsCache, target string, out io.Writer) error {
+	entries, err := matchCacheEntries(c, target)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := c.evict(e.name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fmt.Fprintf(out, "Removed %v (%v)\n", entryURI(e), e.Key)
+	}
+	// The saved index no longer matches the files, so it is rebuilt
+	if err := os.Remove(filepath.Join(c.dir, indexFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func printCacheStats(c *FsCache, out io.Writer) error {
+	now := time.Now()
+	var n, expired, unknown int
+	var size int64
+	var oldest time.Time
+	err := c.Entries(func(e cacheEntry) error {
+		n++
+		size += e.Size
+		if !e.Expires.IsZero() && now.After(e.Expires) {
+			expired++
+		}
+		if storedURI(e) == "" {
+			unknown++
+		}
+		if oldest.IsZero() || e.Stored.Before(oldest) {
+			oldest = e.Stored
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Entries: %d\nSize: %d\nExpired: %d\nWithout URI: %d\n", n, size, expired, unknown)
+	if n > 0 {
+		fmt.Fprintf(out, "Oldest: %v ago\n", formatAge(now.Sub(oldest)))
+	}
+	return nil
+}
+
+// matchCacheEntries returns the entries of c stored with target as their
+// key, or for the URI target, failing if there are none.
+func matchCacheEntries(c *FsCache, target string) ([]cacheEntry, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	var uris []string
+	if u.Path != "" || u.RawQuery != "" {
+		r, err := http.NewRequest(http.MethodGet, u.RequestURI(), nil)
+		if err != nil {
+			return nil, err
+		}
+		r.RequestURI = u.RequestURI()
+		uris = append(uris, keyURI(r))
+		// Absolute URLs also match the entries of forward proxy requests
+		if u.IsAbs() {
+			r.RequestURI = target
+			uris = append(uris, keyURI(r))
+		}
+	}
+	var entries []cacheEntry
+	err = c.Entries(func(e cacheEntry) error {
+		match, stored := e.Key == target || path.Base(e.Key) == target, storedURI(e)
+		for _, uri := range uris {
+			// Variants append the headers they vary on
+			match = match || stored == uri || strings.HasPrefix(stored, uri+"\n")
+		}
+		if match {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("%v: not in cache", target)
+	}
+	return entries, nil
+}
+
+// storedURI returns the URI of e, decoding base64 keys of entries stored
+// without it by older versions.
+func storedURI(e cacheEntry) string {
+	if e.URI == "" && conf.CacheKeyHash == "base64" {
+		if b, err := base64.URLEncoding.DecodeString(path.Base(e.Key)); err == nil {
+			return string(b)
+		}
+	}
+	return e.URI
+}
+
+// entryURI returns the URI of e on a single line, as variants include
+// the headers they vary on.
+func entryURI(e cacheEntry) string {
+	uri := storedURI(e)
+	if uri == "" {
+		return "-"
+	}
+	return strings.ReplaceAll(uri, "\n", " ")
+}
+
+func formatAge(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+func formatExpires(t, now time.Time) string {
+	switch {
+	case t.IsZero():
+		return "never"
+	case now.After(t):
+		return "expired"
+	}
+	return "in " + formatAge(t.Sub(now))
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// generatedETagHeader stores the ETag generated for clients with
+// --client-cache-control. It is kept apart from ETag, so entries without
+// upstream validators are not revalidated with it.
+const generatedETagHeader = "X-Simpleproxy-Etag"
+
+// setClientCacheControl overrides the Cache-Control header sent to clients
+// with --client-cache-control, if set.
+func setClientCacheControl(h http.Header) {
+	if conf.ClientCacheControl != "" {
+		h.Set("Cache-Control", conf.ClientCacheControl)
+	}
+}
+
+// newETag generates a weak ETag for a new version of the entry at key. It
+// is weak since the proxy cannot tell whether upstream content is
+// byte-for-byte equal to what was previously served.
+func newETag(key string) string {
+	sum := sha256.Sum256([]byte(key + strconv.FormatInt(time.Now().UnixNano(), 10)))
+	return `W/"` + hex.EncodeToString(sum[:8]) + `"`
+}
+
+// restoreETag moves the ETag generated for clients from its internal
+// header in h, unless upstream provided one.
+func restoreETag(h http.Header) {
+	etag := h.Get(generatedETagHeader)
+	h.Del(generatedETagHeader)
+	if etag != "" && h.Get("ETag") == "" {
+		h.Set("ETag", etag)
+	}
+}
+
+// fileETag generates a weak ETag from the size and modification time of a
+// cached file, in the same spirit as most static file servers.
+func fileETag(size int64, modtime time.Time) string {
+	return fmt.Sprintf(`W/"%x-%x"`, size, modtime.UnixNano())
+}
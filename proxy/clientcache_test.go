@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGeneratedETag(t *testing.T) {
+	var n int32
+	p := newTestHandler(t, newTestConfig(t, newTestUpstream(t, &n), "--client-cache-control=public, max-age=300"))
+	etag := get(p, "/page").Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("generated ETag = %q, want a weak one", etag)
+	}
+	rec := get(p, "/page")
+	if got := rec.Header().Get("ETag"); rec.Header().Get("x-cache") != CacheHit || got != etag {
+		t.Errorf("hit got ETag %q, x-cache %q, want %q from cache", got, rec.Header().Get("x-cache"), etag)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	r.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	p.ServeHTTP(rec, r)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("conditional request got %d, want %d", rec.Code, http.StatusNotModified)
+	}
+
+	_, _, b, h, err := getEntry(p.cache, httptest.NewRequest(http.MethodGet, "/page", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if hasValidators(h) {
+		t.Errorf("stored headers %v have validators, want the generated ETag kept apart", h)
+	}
+}
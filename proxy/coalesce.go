@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// flight is an upstream fetch in progress, which other requests for the
+// same key wait for instead of sending their own.
+type flight struct {
+	done chan struct{}
+}
+
+// flightGroup coalesces concurrent cache misses for the same key. The zero
+// value is ready to use.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// Join returns the fetch in progress for key, and whether the caller leads
+// it, in which case it must call Done once the response is handled.
+func (g *flightGroup) Join(key string) (f *flight, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	f = &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	return f, true
+}
+
+// Done releases the requests waiting for the fetch of key. Later requests
+// start a new fetch, so a failed one never affects them.
+func (g *flightGroup) Done(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if f, ok := g.flights[key]; ok {
+		close(f.done)
+		delete(g.flights, key)
+	}
+}
+
+// flightBody ends a flight once the leader response body is closed, which
+// happens after its cache write is committed or aborted.
+type flightBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *flightBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// follow waits for the fetch f, led by another request, and serves r from
+// the entry it stored. The response is nil if there is none, as the
+// leader response may not be cacheable, so r must be fetched on its own.
+func (c *CachedTransport) follow(r *http.Request, f *flight) (*http.Response, error) {
+	coalescedRequests.Inc()
+	debugf("[transport] Waiting for the in-flight fetch of '%v'", keyURI(r))
+	select {
+	case <-f.done:
+	case <-r.Context().Done():
+		return nil, r.Context().Err()
+	}
+	k, uri, b, h, err := getEntry(c.cache, r)
+	if err != nil {
+		return nil, nil
+	}
+	if needsRevalidation(h) != "" {
+		b.Close()
+		return nil, nil
+	}
+	size, _ := strconv.ParseInt(h.Get("content-length"), 10, 64)
+	events.Emit(eventHit, k, uri, size)
+	xcache := CacheHit
+	if isStale(h) {
+		xcache = CacheStale
+	}
+	return cachedResponse(r, b, h, xcache), nil
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressedHeader is stored along with the cached headers of entries
+// gzipped by --compress, which are decompressed for clients not accepting
+// gzip. It is never sent to clients.
+const compressedHeader = "X-Simpleproxy-Compressed"
+
+// defaultCompressTypes are the media types gzipped by --compress, unless
+// set by --compress-types.
+const defaultCompressTypes = "text/*,application/json,application/javascript,application/xml,*+json,*+xml"
+
+// compressible reports whether the body of w should be stored gzipped: it
+// is not encoded yet, and its media type matches --compress-types.
+func compressible(w *http.Response) bool {
+	if !conf.Compress || w.StatusCode != http.StatusOK || w.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	return matchMediaType(w.Header.Get("Content-Type"), conf.CompressTypes)
+}
+
+// matchMediaType reports whether the media type of contentType is in the
+// comma-separated list of types, as type/subtype, type/* or *+suffix.
+func matchMediaType(contentType, types string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, t := range strings.Split(types, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case strings.HasSuffix(t, "/*") && strings.HasPrefix(mt, t[:len(t)-1]),
+			strings.HasPrefix(t, "*+") && strings.HasSuffix(mt, t[1:]),
+			mt == t:
+			return true
+		}
+	}
+	return false
+}
+
+// gzipReader returns a reader of the contents of r, gzipped. Closing it
+// stops reading from r.
+func gzipReader(r io.Reader) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		gz := gzip.NewWriter(pw)
+		_, err := io.Copy(gz, r)
+		if cerr := gz.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr
+}
+
+// gzipResponse compresses the body of w on the fly, with --compress, for
+// clients accepting gzip, so they save bandwidth on misses too, even when
+// the upstream does not compress. Entries are still stored from the
+// uncompressed body.
+func gzipResponse(w *http.Response) {
+	if w.Request.Method != http.MethodGet || passthrough(w.Request) || isEventStream(w.Header) {
+		return
+	}
+	if !compressible(w) || !acceptsGzip(w.Request) {
+		return
+	}
+	w.Body = gzipBody{ReadCloser: gzipReader(w.Body), body: w.Body}
+	w.ContentLength = -1
+	w.Header.Del("Content-Length")
+	w.Header.Set("Content-Encoding", "gzip")
+	w.Header.Add("Vary", "Accept-Encoding")
+	if etag := w.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		w.Header.Set("ETag", "W/"+etag)
+	}
+}
+
+// gzipBody is a response body compressed by gzipReader. Closing it closes
+// the original body too.
+type gzipBody struct {
+	io.ReadCloser
+	body io.Closer
+}
+
+func (g gzipBody) Close() error {
+	g.ReadCloser.Close()
+	return g.body.Close()
+}
+
+// withAcceptGzip records whether the client accepts gzip, before the
+// Accept-Encoding header is replaced for the upstream.
+func withAcceptGzip(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), acceptGzipKey, acceptsGzip(r)))
+}
+
+// acceptsGzip reports whether the client of r accepts gzip encoded bodies.
+func acceptsGzip(r *http.Request) bool {
+	if v, ok := r.Context().Value(acceptGzipKey).(bool); ok {
+		return v
+	}
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, enc := range strings.Split(v, ",") {
+			name, q := enc, ""
+			if i := strings.Index(enc, ";"); i >= 0 {
+				name, q = enc[:i], strings.TrimSpace(enc[i+1:])
+			}
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "gzip" && name != "*" {
+				continue
+			}
+			if strings.HasPrefix(q, "q=") {
+				if f, err := strconv.ParseFloat(q[2:], 64); err == nil && f == 0 {
+					continue
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gunzipCached prepares the headers h of a cached entry to be served to
+// r, reporting whether its blob must be decompressed. Entries gzipped by
+// --compress are served as they are to clients accepting gzip, with a weak
+// ETag, as the bytes differ from the upstream ones.
+func gunzipCached(r *http.Request, h http.Header) bool {
+	if h.Get(compressedHeader) == "" {
+		return false
+	}
+	h.Del(compressedHeader)
+	h.Add("Vary", "Accept-Encoding")
+	if acceptsGzip(r) {
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		return false
+	}
+	h.Del("Content-Encoding")
+	h.Del("Content-Length")
+	return true
+}
+
+// gunzipBody decompresses a cached blob as it is read.
+type gunzipBody struct {
+	blob io.ReadCloser
+	zr   *gzip.Reader
+}
+
+func (g *gunzipBody) Read(p []byte) (int, error) {
+	if g.zr == nil {
+		zr, err := gzip.NewReader(g.blob)
+		if err != nil {
+			return 0, err
+		}
+		g.zr = zr
+	}
+	return g.zr.Read(p)
+}
+
+func (g *gunzipBody) Close() error {
+	return g.blob.Close()
+}
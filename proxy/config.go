@@ -0,0 +1,168 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// configEntry is a setting read from the --config file: the name of a flag
+// and one of its values.
+type configEntry struct {
+	name, value string
+	line        int
+}
+
+// readConfig parses the configuration file at path, a YAML subset where
+// each key is the name of a flag, set to a scalar or to a list of values
+// for flags that may be repeated:
+//
+//	listen: :8080
+//	upstream:
+//	  - https://example.com
+//	  - /api=https://api.internal
+//	min-ttl: 5m
+//
+// Values may be quoted, and comments start with '#'.
+func readConfig(path string) ([]configEntry, error) {
+	if conf.flags == nil {
+		return nil, errors.New("settings must be defined with RegisterFlags to read --config")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []configEntry
+	list := "" // key of the list being read, if any
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := stripComment(s.Text())
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fail := func(format string, args ...interface{}) error {
+			return fmt.Errorf("%v:%d: %v", path, n, fmt.Sprintf(format, args...))
+		}
+		if trimmed := strings.TrimSpace(line); trimmed == "-" || strings.HasPrefix(trimmed, "- ") {
+			if list == "" {
+				return nil, fail("list item outside of a list")
+			}
+			if trimmed == "-" {
+				return nil, fail("empty list item")
+			}
+			v, err := configValue(strings.TrimSpace(trimmed[2:]))
+			if err != nil {
+				return nil, fail("%v", err)
+			}
+			entries = append(entries, configEntry{name: list, value: v, line: n})
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			return nil, fail("unexpected indentation")
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, fail("expected NAME: VALUE")
+		}
+		name, raw := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if conf.flags.Lookup(name) == nil || name == "config" {
+			return nil, fail("unknown setting %q", name)
+		}
+		if raw == "" {
+			list = name
+			continue
+		}
+		list = ""
+		v, err := configValue(raw)
+		if err != nil {
+			return nil, fail("%v", err)
+		}
+		entries = append(entries, configEntry{name: name, value: v, line: n})
+	}
+	return entries, s.Err()
+}
+
+// stripComment removes a trailing comment from line: a '#' at its start or
+// after a space, outside of quotes.
+func stripComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+// configValue unquotes raw if it is a double or single quoted string.
+func configValue(raw string) (string, error) {
+	switch {
+	case len(raw) >= 2 && raw[0] == '"' && raw[len(raw)-1] == '"':
+		return strconv.Unquote(raw)
+	case len(raw) >= 2 && raw[0] == '\'' && raw[len(raw)-1] == '\'':
+		return strings.ReplaceAll(raw[1:len(raw)-1], "''", "'"), nil
+	case raw[0] == '"' || raw[0] == '\'':
+		return "", errors.New("unterminated quoted value")
+	}
+	return raw, nil
+}
+
+// loadConfig sets the flags in the --config file at path, except those
+// already set on the command line, which take precedence.
+func loadConfig(path string) error {
+	entries, err := readConfig(path)
+	if err != nil {
+		return err
+	}
+	cmdline := cmdlineFlags()
+	for _, e := range entries {
+		if cmdline[e.name] {
+			continue
+		}
+		if err := conf.flags.Set(e.name, e.value); err != nil {
+			return fmt.Errorf("%v:%d: invalid %v %q: %v", path, e.line, e.name, e.value, err)
+		}
+	}
+	return nil
+}
+
+// cmdlineFlags returns the names of the flags set so far, which are those
+// of the command line until loadConfig runs.
+func cmdlineFlags() map[string]bool {
+	set := make(map[string]bool)
+	conf.flags.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// configValues returns the values of the flag name, as set on the command
+// line, or else in entries.
+func configValues(entries []configEntry, name string) []string {
+	if cmdlineFlags()[name] {
+		if v := conf.flags.Lookup(name).Value.String(); v != "" {
+			return []string{v}
+		}
+		return nil
+	}
+	var values []string
+	for _, e := range entries {
+		if e.name == name {
+			values = append(values, e.value)
+		}
+	}
+	return values
+}
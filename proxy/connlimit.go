@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// tooManyConns is written to connections rejected by connLimiter.
+const tooManyConns = "HTTP/1.1 429 Too Many Requests\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"Content-Length: 43\r\n" +
+	"Connection: close\r\n\r\n" +
+	"429 Too Many Requests: too many connections"
+
+// errTooManyConns is returned reading connections over the limit.
+var errTooManyConns = errors.New("too many connections")
+
+// connLimiter allows at most max simultaneous connections per client IP
+// address, across the listeners it wraps.
+type connLimiter struct {
+	max int
+	// tls is set when connections are TLS, which rejected clients
+	// cannot read a plain text response from.
+	tls bool
+
+	mu    sync.Mutex
+	conns map[string]int
+}
+
+// conns tracks per-IP connections when --max-conns-per-ip is set.
+var conns *connLimiter
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, conns: make(map[string]int)}
+}
+
+// Wrap returns l rejecting connections over the limit.
+func (cl *connLimiter) Wrap(l net.Listener) net.Listener {
+	return &limitedListener{Listener: l, connLimiter: cl}
+}
+
+// limitedListener is a net.Listener whose connections are counted by a
+// connLimiter.
+type limitedListener struct {
+	net.Listener
+	*connLimiter
+}
+
+func (l *limitedListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &limitedConn{Conn: c, limiter: l.connLimiter}, nil
+}
+
+// acquire counts a connection from ip, unless it already has the maximum.
+func (l *connLimiter) acquire(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] >= l.max {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *connLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip]--; l.conns[ip] <= 0 {
+		delete(l.conns, ip)
+	}
+}
+
+// Top returns the n client IPs with most open connections.
+func (l *connLimiter) Top(n int) []map[string]interface{} {
+	l.mu.Lock()
+	ips := make([]string, 0, len(l.conns))
+	counts := make(map[string]int, len(l.conns))
+	for ip, count := range l.conns {
+		ips = append(ips, ip)
+		counts[ip] = count
+	}
+	l.mu.Unlock()
+	sort.Slice(ips, func(i, j int) bool {
+		if counts[ips[i]] != counts[ips[j]] {
+			return counts[ips[i]] > counts[ips[j]]
+		}
+		return ips[i] < ips[j]
+	})
+	if len(ips) > n {
+		ips = ips[:n]
+	}
+	top := make([]map[string]interface{}, 0, len(ips))
+	for _, ip := range ips {
+		top = append(top, map[string]interface{}{"ip": ip, "conns": counts[ip]})
+	}
+	return top
+}
+
+// reject tells the client why its connection is being closed.
+func reject(c net.Conn) {
+	defer c.Close()
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Write([]byte(tooManyConns))
+}
+
+// limitedConn counts against the limit of its client IP address from its
+// first read, once a PROXY protocol header, if any, tells the client, and
+// until closed. Reading it outside of the accept loop keeps slow clients
+// from holding up the others.
+type limitedConn struct {
+	net.Conn
+	limiter *connLimiter
+
+	once     sync.Once
+	ip       string // set once counted
+	err      error
+	released sync.Once
+}
+
+func (c *limitedConn) acquire() {
+	c.once.Do(func() {
+		ip, _, err := net.SplitHostPort(c.Conn.RemoteAddr().String())
+		if err != nil {
+			ip = c.Conn.RemoteAddr().String()
+		}
+		if !c.limiter.acquire(ip) {
+			log.Printf("[connlimit] Rejecting connection from %v: limit of %d reached", ip, c.limiter.max)
+			if c.limiter.tls {
+				c.Conn.Close()
+			} else {
+				reject(c.Conn)
+			}
+			c.err = errTooManyConns
+			return
+		}
+		c.ip = ip
+	})
+}
+
+func (c *limitedConn) Read(b []byte) (int, error) {
+	c.acquire()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *limitedConn) Close() error {
+	// Connections closed before their first read are never counted
+	c.once.Do(func() { c.err = net.ErrClosed })
+	c.released.Do(func() {
+		if c.ip != "" {
+			c.limiter.release(c.ip)
+		}
+	})
+	return c.Conn.Close()
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestConnLimitPerProxiedClient(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conf.TrustedProxies = nil
+	l := newConnLimiter(1).Wrap(acceptProxyProtocol(ln))
+
+	results := make(chan error)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, err := c.Read(make([]byte, 1))
+				results <- err
+			}()
+		}
+	}()
+	dial := func(client string) net.Conn {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(c, "PROXY TCP4 %v 192.0.2.9 1000 80\r\nx", client)
+		return c
+	}
+
+	// Same TCP peer, told apart by their PROXY header
+	for _, client := range []string{"192.0.2.1", "192.0.2.2"} {
+		c := dial(client)
+		defer c.Close()
+		if err := <-results; err != nil {
+			t.Fatalf("connection from %v rejected: %v", client, err)
+		}
+	}
+	c := dial("192.0.2.1")
+	defer c.Close()
+	if err := <-results; err != errTooManyConns {
+		t.Fatalf("second connection from 192.0.2.1 got %v, want %v", err, errTooManyConns)
+	}
+	b, _ := io.ReadAll(c)
+	if !strings.Contains(string(b), "429 Too Many Requests") {
+		t.Errorf("rejected client read %q, want a 429 response", b)
+	}
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// rewriteRule replaces from by to.
+type rewriteRule struct {
+	from, to string
+}
+
+// rewriteRules implements flag.Value, parsing repeated FROM=TO values.
+type rewriteRules []rewriteRule
+
+func (r *rewriteRules) String() string {
+	if r == nil {
+		return ""
+	}
+	var s []string
+	for _, rule := range *r {
+		s = append(s, rule.from+"="+rule.to)
+	}
+	return strings.Join(s, ",")
+}
+
+func (r *rewriteRules) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid rule %q, use FROM=TO", v)
+	}
+	*r = append(*r, rewriteRule{from: v[:i], to: v[i+1:]})
+	return nil
+}
+
+// rewriteSetCookies applies the --rewrite-set-cookie-* rules to every
+// Set-Cookie header in h, so cookies set by upstream apply to the proxy
+// domain.
+func rewriteSetCookies(h http.Header) {
+	cookies := h.Values("Set-Cookie")
+	for i, c := range cookies {
+		cookies[i] = rewriteSetCookie(c)
+	}
+}
+
+func rewriteSetCookie(c string) string {
+	parts := strings.Split(c, ";")
+	out := parts[:1]
+	for _, p := range parts[1:] {
+		attr := strings.TrimSpace(p)
+		name, value := attr, ""
+		if i := strings.Index(attr, "="); i >= 0 {
+			name, value = attr[:i], attr[i+1:]
+		}
+		switch strings.ToLower(name) {
+		case "domain":
+			d := strings.TrimPrefix(strings.ToLower(value), ".")
+			for _, rule := range conf.CookieDomainRules {
+				if d == strings.ToLower(rule.from) {
+					attr = name + "=" + rule.to
+					break
+				}
+			}
+		case "path":
+			for _, rule := range conf.CookiePathRules {
+				if strings.HasPrefix(value, rule.from) {
+					rewritten := strings.TrimSuffix(rule.to, "/") + strings.TrimPrefix(value, rule.from)
+					if !strings.HasPrefix(rewritten, "/") {
+						rewritten = "/" + rewritten
+					}
+					attr = name + "=" + rewritten
+					break
+				}
+			}
+		case "secure":
+			if conf.StripCookieSecure {
+				continue
+			}
+		}
+		out = append(out, " "+attr)
+	}
+	return strings.Join(out, ";")
+}
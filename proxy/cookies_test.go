@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestSetCookieKeptApart(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Add("Link", "</a.css>; rel=preload")
+		w.Header().Add("Link", "</b.js>; rel=preload")
+		if r.URL.Path == "/login" {
+			w.Header().Add("Set-Cookie", "session=1; Domain=upstream.test; Path=/; Secure")
+			w.Header().Add("Set-Cookie", "theme=dark, blue; Path=/")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	for _, extra := range [][]string{nil, {"--mem-cache-size=1MB"}} {
+		h := newTestHandler(t, newTestConfig(t, u, append([]string{
+			"--rewrite-set-cookie-domain=upstream.test=proxy.test",
+			"--strip-set-cookie-secure",
+			"--response-header=+Set-Cookie: seen=1",
+			"--response-header=+Set-Cookie: lang=en",
+			"--compress",
+		}, extra...)...))
+
+		// Passed through, as responses setting cookies are never cached
+		for i, gzip := range []bool{false, true} {
+			r := httptest.NewRequest(http.MethodGet, "/login", nil)
+			if gzip {
+				r.Header.Set("Accept-Encoding", "gzip")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			want := []string{"session=1; Domain=proxy.test; Path=/", "theme=dark, blue; Path=/", "seen=1", "lang=en"}
+			if got := rec.Result().Header.Values("Set-Cookie"); !reflect.DeepEqual(got, want) {
+				t.Errorf("passthrough %d got Set-Cookie %q, want %q", i, got, want)
+			}
+		}
+
+		get(h, "/page")
+		for _, gzip := range []bool{false, true} {
+			r := httptest.NewRequest(http.MethodGet, "/page", nil)
+			if gzip {
+				r.Header.Set("Accept-Encoding", "gzip")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Header().Get("x-cache") != CacheHit {
+				t.Fatalf("request with gzip %v not served from the cache", gzip)
+			}
+			if got, want := rec.Result().Header.Values("Set-Cookie"), []string{"seen=1", "lang=en"}; !reflect.DeepEqual(got, want) {
+				t.Errorf("hit with gzip %v got Set-Cookie %q, want %q", gzip, got, want)
+			}
+			if got := rec.Result().Header.Values("Link"); len(got) != 2 {
+				t.Errorf("hit with gzip %v got Link %q, want both values", gzip, got)
+			}
+		}
+	}
+}
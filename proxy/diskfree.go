@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// diskCheckInterval is how long a free disk space reading is reused.
+const diskCheckInterval = 10 * time.Second
+
+// byteSize implements flag.Value, parsing sizes such as 512MiB or 10GB.
+type byteSize int64
+
+var sizeUnits = []struct {
+	suffix string
+	n      int64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"B", 1},
+}
+
+func (b *byteSize) String() string {
+	if b == nil {
+		return "0"
+	}
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(v string) error {
+	n, unit := strings.TrimSpace(v), int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(strings.ToUpper(n), strings.ToUpper(u.suffix)) {
+			n, unit = strings.TrimSpace(n[:len(n)-len(u.suffix)]), u.n
+			break
+		}
+	}
+	i, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || i < 0 {
+		return fmt.Errorf("invalid size %q", v)
+	}
+	*b = byteSize(i * unit)
+	return nil
+}
+
+// diskSpace checks the free space in the cache directory, reusing each
+// reading for diskCheckInterval.
+type diskSpace struct {
+	dir string
+	min int64
+
+	mu        sync.Mutex
+	free      int64
+	checkedAt time.Time
+	err       error
+}
+
+// disk tracks the cache volume free space when --min-free-disk is set.
+var disk *diskSpace
+
+// Low reports whether the free space is below the minimum. Errors
+// reading it are logged, and never prevent caching.
+func (d *diskSpace) Low() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Since(d.checkedAt) >= diskCheckInterval {
+		d.free, d.err = freeDiskSpace(d.dir)
+		d.checkedAt = time.Now()
+		if d.err != nil {
+			log.Printf("[disk] error checking free space in %v: %v", d.dir, d.err)
+		} else if d.free < d.min {
+			log.Printf("[disk] WARNING: only %d bytes free in %v, below --min-free-disk=%d: not caching new entries", d.free, d.dir, d.min)
+		}
+	}
+	return d.err == nil && d.free < d.min
+}
+
+// Stats returns the last reading, for the stats endpoint.
+func (d *diskSpace) Stats() map[string]interface{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := map[string]interface{}{
+		"free":       d.free,
+		"min_free":   d.min,
+		"low":        d.err == nil && d.free < d.min,
+		"checked_at": d.checkedAt,
+	}
+	if d.err != nil {
+		s["error"] = d.err.Error()
+	}
+	return s
+}
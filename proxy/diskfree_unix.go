@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import "syscall"
+
+// freeDiskSpace returns the bytes available to unprivileged users in the
+// filesystem holding dir.
+func freeDiskSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
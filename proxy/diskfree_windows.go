@@ -0,0 +1,8 @@
+package proxy
+
+import "errors"
+
+// freeDiskSpace is not supported on Windows.
+func freeDiskSpace(dir string) (int64, error) {
+	return 0, errors.New("free disk space checks are not supported on windows")
+}
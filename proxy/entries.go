@@ -0,0 +1,256 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheEntry describes a stored entry, for the admin endpoints.
+type cacheEntry struct {
+	Key     string
+	URI     string
+	Size    int64
+	Stored  time.Time
+	Expires time.Time
+
+	// name is the file holding the blob, for FsCache entries.
+	name string
+}
+
+// entryLister is implemented by caches that can enumerate their entries.
+type entryLister interface {
+	// Entries calls fn for each stored entry, stopping at the first
+	// error, which is returned.
+	Entries(fn func(e cacheEntry) error) error
+}
+
+// errStopListing stops Entries early, without reporting an error.
+var errStopListing = errors.New("stop listing")
+
+// newCacheEntry returns the entry for key from its stored headers h.
+func newCacheEntry(key string, h http.Header, size int64, stored time.Time) cacheEntry {
+	e := cacheEntry{Key: key, URI: h.Get(uriHeader), Size: size, Stored: stored}
+	e.Expires, _ = http.ParseTime(h.Get(expiresHeader))
+	return e
+}
+
+// Entries lists the index, or walks the cache directory, skipping the
+// staging and trash ones, if there is none.
+func (c *FsCache) Entries(fn func(e cacheEntry) error) error {
+	if c.index != nil {
+		for _, e := range c.index.list() {
+			err := fn(cacheEntry{Key: e.Key, URI: e.URI, Size: e.Size, Stored: e.Stored, Expires: e.Expires, name: c.path(e.Key)})
+			if err == errStopListing {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err := filepath.WalkDir(c.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && name != c.dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(name, ".headers") {
+			return nil
+		}
+		key := strings.TrimSuffix(name, ".headers")
+		st, err := os.Stat(key)
+		if err != nil {
+			return nil
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil
+		}
+		h := make(http.Header)
+		if err := json.Unmarshal(b, &h); err != nil {
+			return nil
+		}
+		e := newCacheEntry(c.keyOf(key), h, st.Size(), st.ModTime())
+		e.name = key
+		return fn(e)
+	})
+	if err == errStopListing {
+		return nil
+	}
+	return err
+}
+
+// Entries lists the entries of the next cache, which holds all of them.
+func (m *memCache) Entries(fn func(e cacheEntry) error) error {
+	l, ok := m.next.(entryLister)
+	if !ok {
+		return errNotSupported
+	}
+	return l.Entries(fn)
+}
+
+// entryFilter returns the entries selected by the query q: those whose URI
+// starts with prefix, or whose path matches pattern, as in --cache-exclude.
+// Without either, all entries are selected, unless required is set.
+func entryFilter(q url.Values, required bool) (func(e cacheEntry) bool, error) {
+	prefix, pattern := q.Get("prefix"), q.Get("pattern")
+	switch {
+	case prefix != "" && pattern != "":
+		return nil, errors.New("use either prefix or pattern")
+	case prefix != "":
+		return func(e cacheEntry) bool { return strings.HasPrefix(e.URI, prefix) }, nil
+	case pattern != "":
+		var pp pathPatterns
+		if err := pp.Set(pattern); err != nil {
+			return nil, err
+		}
+		return func(e cacheEntry) bool {
+			u, err := url.Parse(e.URI)
+			return err == nil && e.URI != "" && pp.Match(u.Path)
+		}, nil
+	case required:
+		return nil, errors.New("missing key, prefix or pattern")
+	}
+	return func(cacheEntry) bool { return true }, nil
+}
+
+// entriesHandler lists the cached entries selected by the query, up to
+// limit, 1000 by default, with their size and age.
+func entriesHandler(w http.ResponseWriter, r *http.Request) {
+	l, ok := cache.(entryLister)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "cache does not support listing entries"})
+		return
+	}
+	match, err := entryFilter(r.URL.Query(), false)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	limit := 1000
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit " + v})
+			return
+		}
+	}
+	now := time.Now()
+	entries := []map[string]interface{}{}
+	truncated := false
+	err = l.Entries(func(e cacheEntry) error {
+		if !match(e) {
+			return nil
+		}
+		if len(entries) == limit {
+			truncated = true
+			return errStopListing
+		}
+		entry := map[string]interface{}{"key": e.Key, "size": e.Size}
+		if e.URI != "" {
+			entry["uri"] = e.URI
+		}
+		if !e.Stored.IsZero() {
+			entry["stored"] = e.Stored.UTC().Format(time.RFC3339)
+			entry["age"] = int64(now.Sub(e.Stored).Seconds())
+		}
+		if !e.Expires.IsZero() {
+			entry["expires"] = e.Expires.UTC().Format(time.RFC3339)
+			entry["expired"] = now.After(e.Expires)
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		log.Printf("[admin] error listing entries: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"entries": entries, "truncated": truncated})
+}
+
+// purgeEntriesHandler removes the entry with the key in the query, or all
+// the entries selected by its prefix or pattern.
+func purgeEntriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if key := r.URL.Query().Get("key"); key != "" {
+		if !validKey(key) {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": errInvalidKey.Error()})
+			return
+		}
+		switch err := cache.Flush(key); {
+		case os.IsNotExist(err):
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": "not in cache", "key": key})
+		case err != nil:
+			log.Printf("[admin] error purging key=%v: %v", key, err)
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		default:
+			log.Printf("[admin] Purged key=%v", key)
+			writeJSON(w, http.StatusOK, map[string]interface{}{"purged": 1})
+		}
+		return
+	}
+	match, err := entryFilter(r.URL.Query(), true)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	purgeEntries(w, match)
+}
+
+// flushHandler removes every entry from the cache.
+func flushHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	purgeEntries(w, func(cacheEntry) bool { return true })
+}
+
+// purgeEntries removes the entries selected by match, reporting how many
+// were removed.
+func purgeEntries(w http.ResponseWriter, match func(e cacheEntry) bool) {
+	l, ok := cache.(entryLister)
+	if !ok {
+		writeJSON(w, http.StatusNotImplemented, map[string]string{"error": "cache does not support listing entries"})
+		return
+	}
+	// Collected first, as removing entries while walking them may skip
+	// some of them.
+	var keys []string
+	err := l.Entries(func(e cacheEntry) error {
+		if match(e) {
+			keys = append(keys, e.Key)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[admin] error listing entries: %v", err)
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	purged := 0
+	for _, key := range keys {
+		if err := cache.Flush(key); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("[admin] error purging key=%v: %v", key, err)
+			}
+			continue
+		}
+		purged++
+	}
+	log.Printf("[admin] Purged %d entries", purged)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"purged": purged})
+}
@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+// minErrorRateSamples is the number of requests needed within the window
+// before the error rate is taken into account, so a single failure on an
+// idle instance does not flip readiness.
+const minErrorRateSamples = 10
+
+// errorRate keeps a rolling count of upstream requests and failures over a
+// time window, in one second slots.
+type errorRate struct {
+	mu     sync.Mutex
+	slots  []errorRateSlot
+	window time.Duration
+}
+
+type errorRateSlot struct {
+	second           int64
+	requests, errors int64
+}
+
+func newErrorRate(window time.Duration) *errorRate {
+	n := int(window / time.Second)
+	if n < 1 {
+		n = 1
+	}
+	return &errorRate{slots: make([]errorRateSlot, n), window: window}
+}
+
+// upstreamErrors tracks the error rate of upstream requests within
+// --error-rate-window.
+var upstreamErrors = newErrorRate(time.Minute)
+
+// Record counts one upstream request, failed or not.
+func (e *errorRate) Record(failed bool) {
+	now := time.Now().Unix()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	s := &e.slots[now%int64(len(e.slots))]
+	if s.second != now {
+		*s = errorRateSlot{second: now}
+	}
+	s.requests++
+	if failed {
+		s.errors++
+	}
+}
+
+// Rate returns the fraction of failed requests in the window, along with
+// the number of requests it is based on.
+func (e *errorRate) Rate() (rate float64, requests int64) {
+	now := time.Now().Unix()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var errors int64
+	for _, s := range e.slots {
+		if now-s.second < int64(len(e.slots)) {
+			requests += s.requests
+			errors += s.errors
+		}
+	}
+	if requests == 0 {
+		return 0, 0
+	}
+	return float64(errors) / float64(requests), requests
+}
+
+// Degraded reports whether the error rate is above --unhealthy-error-rate.
+func (e *errorRate) Degraded() bool {
+	if conf.UnhealthyErrorRate <= 0 {
+		return false
+	}
+	rate, requests := e.Rate()
+	return requests >= minErrorRateSamples && rate > conf.UnhealthyErrorRate
+}
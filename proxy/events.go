@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Cache event types sent to the webhook.
+const (
+	eventStore = "store"
+	eventHit   = "hit"
+	eventEvict = "evict"
+)
+
+// cacheEvent is the JSON payload posted to the event webhook.
+type cacheEvent struct {
+	Type string    `json:"type"`
+	Key  string    `json:"key"`
+	URI  string    `json:"uri,omitempty"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+// eventSink delivers cache events to a webhook in the background. Delivery
+// is best-effort: events are dropped when the queue is full or the webhook
+// fails, so the request path is never blocked.
+type eventSink struct {
+	url    string
+	client *http.Client
+	queue  chan cacheEvent
+
+	sent    int64
+	dropped int64
+	failed  int64
+}
+
+// newEventSink returns a sink delivering events to url, queueing up to
+// size of them, until ctx is done.
+func newEventSink(ctx context.Context, url string, size int) *eventSink {
+	s := &eventSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan cacheEvent, size),
+	}
+	go s.run(ctx)
+	return s
+}
+
+// Emit queues an event for delivery. It is safe to call on a nil sink.
+func (s *eventSink) Emit(typ, key, uri string, size int64) {
+	if s == nil {
+		return
+	}
+	select {
+	case s.queue <- cacheEvent{Type: typ, Key: key, URI: uri, Size: size, Time: time.Now()}:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+func (s *eventSink) run(ctx context.Context) {
+	for {
+		var e cacheEvent
+		select {
+		case <-ctx.Done():
+			return
+		case e = <-s.queue:
+		}
+		b, err := json.Marshal(e)
+		if err != nil {
+			log.Printf("[events] error encoding event: %v", err)
+			continue
+		}
+		resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+		if err != nil {
+			atomic.AddInt64(&s.failed, 1)
+			log.Printf("[events] error sending event: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			atomic.AddInt64(&s.failed, 1)
+			log.Printf("[events] webhook returned %v", resp.Status)
+			continue
+		}
+		atomic.AddInt64(&s.sent, 1)
+	}
+}
+
+// Stats returns the delivery counters of the sink.
+func (s *eventSink) Stats() map[string]int64 {
+	return map[string]int64{
+		"queued":  int64(len(s.queue)),
+		"sent":    atomic.LoadInt64(&s.sent),
+		"dropped": atomic.LoadInt64(&s.dropped),
+		"failed":  atomic.LoadInt64(&s.failed),
+	}
+}
@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// forwardMode reports whether clients use the proxy explicitly, with
+// --mode=forward, instead of it standing in for an upstream.
+func forwardMode() bool {
+	return conf.Mode == "forward"
+}
+
+// forwardOrigin returns the origin server of the absolute-form request r,
+// which is its upstream in forward mode, or nil for other requests.
+func forwardOrigin(r *http.Request) *url.URL {
+	if !r.URL.IsAbs() || r.URL.Host == "" {
+		return nil
+	}
+	return &url.URL{Scheme: r.URL.Scheme, Host: r.URL.Host}
+}
+
+// errForbiddenTarget is returned dialing forward proxy targets on loopback
+// or link-local addresses, without --forward-allow-local.
+var errForbiddenTarget = errors.New("forward proxy target is a local address")
+
+// forwardControl refuses connections to loopback and link-local addresses,
+// checked once resolved so host names cannot point the proxy at itself or
+// at cloud metadata services, unless --forward-allow-local is set.
+func forwardControl(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%w: %v", errForbiddenTarget, address)
+	}
+	return nil
+}
+
+// dialControl returns the check of the addresses dialed by the transport,
+// which only forward proxies have.
+func dialControl() func(network, address string, c syscall.RawConn) error {
+	if !forwardMode() || conf.ForwardAllowLocal {
+		return nil
+	}
+	return forwardControl
+}
+
+// connectAllowed reports whether CONNECT requests may reach port, one of
+// the --connect-ports.
+func connectAllowed(port string) bool {
+	for _, p := range strings.Split(conf.ConnectPorts, ",") {
+		if p = strings.TrimSpace(p); p == "*" || p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardProxy serves clients using the proxy explicitly: CONNECT requests
+// are tunneled to their target, and other requests must have an absolute
+// URL, as in GET http://example.com/ HTTP/1.1, before reaching next.
+func forwardProxy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			tunnel(w, r)
+			return
+		}
+		if forwardOrigin(r) == nil {
+			http.Error(w, "400 Bad Request: forward proxy requests need an absolute URL", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// tunnel connects the client of the CONNECT request r to its target, and
+// copies bytes both ways until either side is done. Tunneled traffic,
+// usually TLS, is never cached.
+func tunnel(w http.ResponseWriter, r *http.Request) {
+	if isOffline() {
+		http.Error(w, "504 Gateway Timeout: offline mode never connects", http.StatusGatewayTimeout)
+		return
+	}
+	_, port, err := net.SplitHostPort(r.Host)
+	if err != nil || port == "" {
+		http.Error(w, "400 Bad Request: CONNECT needs a host:port target", http.StatusBadRequest)
+		return
+	}
+	if !connectAllowed(port) {
+		log.Printf("[forward] Refusing CONNECT to %v from %v: port is not in --connect-ports", r.Host, clientIP(r))
+		http.Error(w, "403 Forbidden: CONNECT is not allowed to port "+port, http.StatusForbidden)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "505 HTTP Version Not Supported: CONNECT requires HTTP/1.1", http.StatusHTTPVersionNotSupported)
+		return
+	}
+	d := &net.Dialer{Timeout: conf.DialTimeout, Control: dialControl()}
+	upstreamConn, err := d.Dial("tcp", r.Host)
+	if errors.Is(err, errForbiddenTarget) {
+		log.Printf("[forward] Refusing CONNECT to %v from %v: %v", r.Host, clientIP(r), err)
+		http.Error(w, "403 Forbidden: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		log.Printf("[forward] error connecting to %v: %v", r.Host, err)
+		http.Error(w, "502 Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer upstreamConn.Close()
+	clientConn, buf, err := hj.Hijack()
+	if err != nil {
+		log.Printf("[forward] error taking over the connection for %v: %v", r.Host, err)
+		return
+	}
+	defer clientConn.Close()
+	// Tunnels last as long as both ends keep them open: make sure no
+	// deadline from the --client-*-timeout flags is left on the connection.
+	clientConn.SetDeadline(time.Time{})
+	start := time.Now()
+	debugf("[forward] Tunneling %v to %v", clientIP(r), r.Host)
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		return
+	}
+	// Clients may send the TLS handshake along with the request
+	if n := buf.Reader.Buffered(); n > 0 {
+		if _, err := io.CopyN(upstreamConn, buf, int64(n)); err != nil {
+			return
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(upstreamConn, clientConn)
+		if c, ok := upstreamConn.(*net.TCPConn); ok {
+			c.CloseWrite()
+		}
+	}()
+	io.Copy(clientConn, upstreamConn)
+	clientConn.Close()
+	<-done
+	debugf("[forward] Closed tunnel to %v after %v", r.Host, time.Since(start).Round(time.Millisecond))
+}
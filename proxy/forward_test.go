@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConnectAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		ports, port string
+		want        bool
+	}{
+		{"443", "443", true},
+		{"443", "22", false},
+		{"443, 8443", "8443", true},
+		{"*", "22", true},
+	} {
+		conf.ConnectPorts = tc.ports
+		if got := connectAllowed(tc.port); got != tc.want {
+			t.Errorf("connectAllowed(%v) with %q = %v, want %v", tc.port, tc.ports, got, tc.want)
+		}
+	}
+}
+
+func TestForwardControl(t *testing.T) {
+	for addr, forbidden := range map[string]bool{
+		"127.0.0.1:80":       true,
+		"[::1]:443":          true,
+		"169.254.169.254:80": true,
+		"[fe80::1]:80":       true,
+		"0.0.0.0:80":         true,
+		"192.0.2.10:80":      false,
+		"[2001:db8::1]:443":  false,
+	} {
+		err := forwardControl("tcp", addr, nil)
+		if got := errors.Is(err, errForbiddenTarget); got != forbidden {
+			t.Errorf("forwardControl(%v) = %v, want forbidden %v", addr, err, forbidden)
+		}
+	}
+}
+
+func TestForwardRefusesLocalTargets(t *testing.T) {
+	var n int32
+	target := newTestUpstream(t, &n).String() + "/page"
+	h := newTestHandler(t, newTestConfig(t, nil, "--mode=forward"))
+	if rec := get(h, target); rec.Code != http.StatusForbidden || n != 0 {
+		t.Errorf("request for %v got %d after %d upstream requests, want 403", target, rec.Code, n)
+	}
+	h = newTestHandler(t, newTestConfig(t, nil, "--mode=forward", "--forward-allow-local"))
+	if rec := get(h, target); rec.Code != http.StatusOK || n != 1 {
+		t.Errorf("request for %v with --forward-allow-local got %d, want 200", target, rec.Code)
+	}
+}
+
+func TestTunnelOutlivesClientTimeouts(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	h := newTestHandler(t, newTestConfig(t, nil, "--mode=forward", "--forward-allow-local", "--connect-ports=*",
+		"--client-read-timeout=100ms", "--client-write-timeout=100ms"))
+	// Hijacked connections are not tracked by the server: wait for the
+	// tunnel to end before the next test resets the flags.
+	var tunnels sync.WaitGroup
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tunnels.Add(1)
+		defer tunnels.Done()
+		h.ServeHTTP(w, r)
+	}))
+	setServerTimeouts(srv.Config)
+	srv.Start()
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnels.Wait()
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %v HTTP/1.1\r\nHost: %[1]v\r\n\r\n", echo.Addr())
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: http.MethodConnect})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT got %v, %v", resp, err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	io.WriteString(conn, "ping")
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+		t.Errorf("tunnel got %q, %v after the client timeouts, want the echo", got, err)
+	}
+}
@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// responseTTL returns for how long w can be cached: the TTL requested with
+// --allow-ttl-param, or the freshness lifetime set by upstream, bounded by
+// --min-ttl and --max-ttl. Responses without either never expire. The
+// reason is set for responses that must not be cached at all, including
+// those setting cookies or answering authenticated requests.
+func responseTTL(w *http.Response) (ttl time.Duration, ok bool, reason string) {
+	if hasCacheDirective(w.Header, "no-store", "no-cache", "private") {
+		return 0, false, "Cache-Control forbids caching"
+	}
+	// HTTP/1.0 upstreams, which do not send Cache-Control
+	if w.Header.Get("Cache-Control") == "" && hasPragmaNoCache(w.Header) {
+		return 0, false, "Pragma forbids caching"
+	}
+	// Personalized responses are never shared, unless upstream says so
+	if w.Header.Get("Set-Cookie") != "" {
+		return 0, false, "response sets cookies"
+	}
+	if w.Request != nil && w.Request.Header.Get("Authorization") != "" &&
+		!hasCacheDirective(w.Header, "public", "s-maxage", "must-revalidate") {
+		return 0, false, "request is authenticated"
+	}
+	if ttl, ok := requestTTL(w.Request); ok {
+		return ttl, true, ""
+	}
+	if ttl, ok := originTTL(w); ok {
+		if ttl = clampTTL(ttl); ttl <= 0 {
+			return 0, false, "already expired"
+		}
+		return ttl, true, ""
+	}
+	return 0, false, ""
+}
+
+// originTTL returns for how long w is still fresh according to upstream:
+// its freshness lifetime minus its Age, if cached by another proxy.
+func originTTL(w *http.Response) (time.Duration, bool) {
+	ttl, ok := originLifetime(w)
+	if age, err := strconv.Atoi(w.Header.Get("Age")); err == nil && age > 0 {
+		ttl -= time.Duration(age) * time.Second
+	}
+	return ttl, ok
+}
+
+// originLifetime returns the freshness lifetime upstream set for w, from
+// the s-maxage or max-age directives, or the Expires header.
+func originLifetime(w *http.Response) (time.Duration, bool) {
+	var maxAge string
+	for _, v := range w.Header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name, value := strings.TrimSpace(d), ""
+			if i := strings.Index(name, "="); i >= 0 {
+				name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+			}
+			switch strings.ToLower(name) {
+			case "s-maxage":
+				if s, err := strconv.Atoi(value); err == nil {
+					return time.Duration(s) * time.Second, true
+				}
+			case "max-age":
+				maxAge = value
+			}
+		}
+	}
+	if s, err := strconv.Atoi(maxAge); err == nil {
+		return time.Duration(s) * time.Second, true
+	}
+	if e := w.Header.Get("Expires"); e != "" {
+		exp, err := http.ParseTime(e)
+		if err != nil {
+			// Invalid dates mean already expired
+			return 0, true
+		}
+		date, err := http.ParseTime(w.Header.Get("Date"))
+		if err != nil {
+			date = time.Now()
+		}
+		return exp.Sub(date), true
+	}
+	return 0, false
+}
+
+// hasPragmaNoCache reports whether h has the HTTP/1.0 Pragma: no-cache.
+func hasPragmaNoCache(h http.Header) bool {
+	for _, v := range h.Values("Pragma") {
+		for _, d := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(d), "no-cache") {
+				return true
+			}
+		}
+	}
+	return false
+}
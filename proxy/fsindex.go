@@ -0,0 +1,296 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// indexFile holds the index of a FsCache between runs. It is removed once
+// loaded, so the index is rebuilt from the files after a crash.
+const indexFile = ".index"
+
+// shardDir returns the subdirectory holding the entries named name, which
+// spreads them over 256 directories by the hash of their name, so none of
+// them grows too large.
+func shardDir(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:1])
+}
+
+// path returns the name of the blob of key, in the directory of its entry,
+// in its shard. Keys grouped in tenant or upstream directories are sharded
+// within them.
+func (c *FsCache) path(key string) string {
+	dir, name := filepath.Split(filepath.FromSlash(key))
+	return filepath.Join(c.dir, dir, shardDir(name), name, blobFile)
+}
+
+// keyOf returns the key of the blob name, undoing path. Names outside of
+// an entry directory or a shard, as stored by older versions, are keys as
+// they are.
+func (c *FsCache) keyOf(name string) string {
+	rel, err := filepath.Rel(c.dir, name)
+	if err != nil {
+		return name
+	}
+	if entry := filepath.Dir(rel); filepath.Base(rel) == blobFile && filepath.Base(filepath.Dir(entry)) == shardDir(filepath.Base(entry)) {
+		rel = entry
+	}
+	dir, base := filepath.Split(rel)
+	dir = filepath.Clean(dir)
+	if filepath.Base(dir) == shardDir(base) {
+		dir = filepath.Dir(dir)
+	}
+	return filepath.ToSlash(filepath.Join(dir, base))
+}
+
+// indexEntry describes a stored entry in the index.
+type indexEntry struct {
+	Key        string    `json:"key"`
+	URI        string    `json:"uri,omitempty"`
+	Size       int64     `json:"size"`
+	HeaderSize int64     `json:"header_size"`
+	Stored     time.Time `json:"stored"`
+	Expires    time.Time `json:"expires"`
+}
+
+// fsIndex keeps the size, time and URI of the entries of a FsCache in
+// memory, so they are listed and evicted without reading every file. A
+// nil index ignores updates.
+type fsIndex struct {
+	mu      sync.Mutex
+	entries map[string]*indexEntry
+}
+
+func (x *fsIndex) set(e *indexEntry) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	x.entries[e.Key] = e
+}
+
+// add records e, unless its key is already known.
+func (x *fsIndex) add(e *indexEntry) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if _, ok := x.entries[e.Key]; !ok {
+		x.entries[e.Key] = e
+	}
+}
+
+// remove forgets about key.
+func (x *fsIndex) remove(key string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	delete(x.entries, key)
+}
+
+// removeDir forgets about every entry under dir. It goes through all the
+// entries, so it is only used to flush whole directories.
+func (x *fsIndex) removeDir(dir string) {
+	if x == nil {
+		return
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for k := range x.entries {
+		if strings.HasPrefix(k, dir+"/") {
+			delete(x.entries, k)
+		}
+	}
+}
+
+func (x *fsIndex) get(key string) (indexEntry, bool) {
+	if x == nil {
+		return indexEntry{}, false
+	}
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	e, ok := x.entries[key]
+	if !ok {
+		return indexEntry{}, false
+	}
+	return *e, true
+}
+
+// list returns a copy of the entries, ordered by key.
+func (x *fsIndex) list() []indexEntry {
+	x.mu.Lock()
+	entries := make([]indexEntry, 0, len(x.entries))
+	for _, e := range x.entries {
+		entries = append(entries, *e)
+	}
+	x.mu.Unlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries
+}
+
+// pinned reports whether the entry at key is pinned, with the URI recorded
+// in the index.
+func (c *FsCache) pinned(key string) bool {
+	e, _ := c.index.get(key)
+	return pins.Has(key, e.URI)
+}
+
+// emitEvict sends the eviction event for the blob name, with the URI and
+// size recorded in the index. Call it before evicting, while they are known.
+func (c *FsCache) emitEvict(name string) {
+	k := c.keyOf(name)
+	e, _ := c.index.get(k)
+	events.Emit(eventEvict, k, e.URI, e.Size)
+}
+
+// newIndexEntry returns the index entry for key from its stored headers h.
+func newIndexEntry(key string, h http.Header, size, headerSize int64, stored time.Time) *indexEntry {
+	e := &indexEntry{Key: key, URI: h.Get(uriHeader), Size: size, HeaderSize: headerSize, Stored: stored}
+	e.Expires, _ = http.ParseTime(h.Get(expiresHeader))
+	return e
+}
+
+// loadIndex reads the index saved by Close, or rebuilds it from the files
+// in the cache directory, moving entries stored by older versions into
+// their shard if migrate is set.
+func (c *FsCache) loadIndex(migrate bool) {
+	start := time.Now()
+	c.index = &fsIndex{entries: make(map[string]*indexEntry)}
+	name := filepath.Join(c.dir, indexFile)
+	if err := c.readIndex(name); err == nil {
+		log.Printf("[fscache] Loaded the index of %d entries", len(c.index.entries))
+		return
+	} else if !os.IsNotExist(err) {
+		log.Printf("[fscache] error loading the index, rebuilding it: %v", err)
+		c.index.entries = make(map[string]*indexEntry)
+	}
+	filepath.WalkDir(c.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && name != c.dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(name, ".headers") {
+			return nil
+		}
+		blob := strings.TrimSuffix(name, ".headers")
+		key := c.keyOf(blob)
+		if to := c.path(key); migrate && to != blob {
+			if err := c.migrate(to, blob); err != nil {
+				log.Printf("[fscache] error moving key=%v into its shard: %v", key, err)
+				return nil
+			}
+			blob, name = to, to+".headers"
+		}
+		hst, err := os.Stat(name)
+		if err != nil {
+			return nil
+		}
+		st, err := os.Stat(blob)
+		if err != nil {
+			return nil
+		}
+		b, err := os.ReadFile(name)
+		if err != nil {
+			return nil
+		}
+		h := make(http.Header)
+		if err := json.Unmarshal(b, &h); err != nil {
+			return nil
+		}
+		c.index.set(newIndexEntry(key, h, st.Size(), hst.Size(), st.ModTime()))
+		return nil
+	})
+	log.Printf("[fscache] Indexed %d entries in %v", len(c.index.entries), time.Since(start).Round(time.Millisecond))
+}
+
+// migrate moves the blob stored by an older version, and its headers, into
+// the entry directory of to.
+func (c *FsCache) migrate(to, blob string) error {
+	staged, err := c.stageEntry()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staged)
+	for _, ext := range []string{"", ".headers"} {
+		if err := os.Rename(blob+ext, filepath.Join(staged, blobFile+ext)); err != nil {
+			return err
+		}
+	}
+	unlock := c.locks.lock(to)
+	defer unlock()
+	return c.commit(to, staged)
+}
+
+// readIndex loads the index file name, removing it.
+func (c *FsCache) readIndex(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// A later crash must not leave a stale index behind
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		e := &indexEntry{}
+		if err := dec.Decode(e); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		c.index.set(e)
+	}
+}
+
+// Close stops the janitor of SetMaxAge, if any, and saves the index, so
+// the next run loads it instead of reading every file.
+func (c *FsCache) Close() error {
+	if c.stopSweep != nil {
+		close(c.stopSweep)
+		c.stopSweep = nil
+	}
+	if c.index == nil {
+		return nil
+	}
+	entries := c.index.list()
+	staged, err := c.stage(func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		enc := json.NewEncoder(bw)
+		for i := range entries {
+			if err := enc.Encode(&entries[i]); err != nil {
+				return err
+			}
+		}
+		return bw.Flush()
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(staged, filepath.Join(c.dir, indexFile)); err != nil {
+		os.Remove(staged)
+		return err
+	}
+	log.Printf("[fscache] Saved the index of %d entries", len(entries))
+	return nil
+}
@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+)
+
+// Proxy is a caching reverse proxy, serving clients as an http.Handler.
+// Its state is kept in the package, along with its settings, so a process
+// runs one Proxy at a time: New replaces the previous one, which should be
+// closed first.
+type Proxy struct {
+	handler http.Handler
+	// cache is closed along with the Proxy, unless set by Config.Cache
+	cache CacheManager
+	stop  context.CancelFunc
+}
+
+// New returns a Proxy with the settings in cfg, which it keeps using, so
+// they should not change while it runs. It starts the background tasks
+// they enable, such as health checks, until it is closed.
+func New(cfg *Config) (*Proxy, error) {
+	conf = cfg
+	ctx, cancel := context.WithCancel(context.Background())
+	t, err := configure(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	p := &Proxy{handler: newHandler(ctx, t), stop: cancel}
+	if cfg.Cache == nil {
+		p.cache = t.cache
+	}
+	return p, nil
+}
+
+// ServeHTTP serves r from the cache, or through the upstream.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.handler.ServeHTTP(w, r)
+}
+
+// Close stops the background tasks of p, waiting for the entries being
+// refreshed, and closes the cache it created. Requests still in flight
+// should be drained first, as with http.Server.Shutdown.
+func (p *Proxy) Close() error {
+	p.stop()
+	refresher.Wait()
+	if c, ok := p.cache.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// NewCachedTransport returns a RoundTripper serving requests from cache,
+// or fetching them upstream.
+func NewCachedTransport(cache CacheManager) *CachedTransport {
+	return &CachedTransport{
+		cache: cache,
+		t: http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   conf.DialTimeout,
+				KeepAlive: 30 * time.Second,
+				DualStack: true,
+				Control:   dialControl(),
+			}).DialContext,
+			TLSClientConfig:       upstreamTLS,
+			MaxIdleConns:          conf.MaxIdleConns,
+			IdleConnTimeout:       conf.IdleConnTimeout,
+			ResponseHeaderTimeout: conf.ResponseHeaderTimeout,
+			ExpectContinueTimeout: 30 * time.Second,
+		},
+	}
+}
+
+// newHandler returns the handler serving clients from the cache of t, or
+// through a reverse proxy sending requests upstream with t. Its background
+// tasks run until ctx is done.
+func newHandler(ctx context.Context, t *CachedTransport) http.Handler {
+	p := &httputil.ReverseProxy{Director: prepareRequest}
+	p.Transport = t
+	p.ModifyResponse = t.cacheResponse
+	p.FlushInterval = conf.FlushInterval
+	p.ErrorHandler = proxyError
+	// Cache keys always use the path requested by clients
+	var next http.Handler = p
+	if len(conf.PathRewrites) > 0 || rewritesRoutedPaths() {
+		next = keepKeyURI(p)
+	}
+	next = routeUpstream(next)
+	refresher.ctx, refresher.next = ctx, next
+	warmer.next, warmer.cache = next, t.cache
+	prefetcher = nil
+	if conf.PrefetchLinks {
+		prefetcher = newLinkPrefetcher(ctx, next, t.cache, conf.PrefetchConcurrency)
+	}
+	var handler http.Handler = routeUpstream(&Handler{cache: t.cache, next: next})
+	if forwardMode() {
+		handler = forwardProxy(handler)
+	}
+	if clientAuth != nil {
+		handler = clientAuth.Wrap(handler)
+	}
+	if conf.RateLimit > 0 {
+		handler = newRateLimiter(conf.RateLimit, conf.RateBurst).Wrap(handler)
+	}
+	if len(conf.ResponseHeaderRules) > 0 {
+		handler = rewriteResponseHeaders(handler)
+	}
+	handler = countResponses(handler)
+	if tracer != nil {
+		handler = traceRequests(handler)
+	}
+	if accessLog != nil {
+		handler = accessLog.logAccess(handler)
+	}
+	return handler
+}
@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// parseTestFlags resets the settings to their defaults, then parses args.
+func parseTestFlags(t *testing.T, args ...string) {
+	t.Helper()
+	conf = DefaultConfig()
+	if err := conf.flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestConfig returns the settings parsed from args, proxying to u
+// unless nil, with a cache in a temporary directory.
+func newTestConfig(t *testing.T, u *url.URL, args ...string) *Config {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.CacheDir = t.TempDir()
+	if u != nil {
+		args = append([]string{"--upstream=" + u.String()}, args...)
+	}
+	if err := cfg.flags.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// newTestHandler returns a Proxy with cfg, closed once the test ends.
+func newTestHandler(t *testing.T, cfg *Config) *Proxy {
+	t.Helper()
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p
+}
+
+// newTestUpstream returns a server answering every request with its path
+// and a one minute max-age, counting the requests in n.
+func newTestUpstream(t *testing.T, n *int32) *url.URL {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(n, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "path=%v", r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return u
+}
+
+// get serves a GET request for target with h, returning the response.
+func get(h http.Handler, target string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, target, nil))
+	return rec
+}
+
+func TestProxyCaches(t *testing.T) {
+	var n int32
+	h := newTestHandler(t, newTestConfig(t, newTestUpstream(t, &n)))
+	for i, want := range []string{"", CacheHit} {
+		rec := get(h, "/page")
+		if rec.Code != http.StatusOK || rec.Body.String() != "path=/page" {
+			t.Fatalf("request %d: got %d %q", i, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("x-cache"); got != want {
+			t.Errorf("request %d: x-cache = %q, want %q", i, got, want)
+		}
+	}
+	if n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
+
+func TestCacheBypassesAreNotMisses(t *testing.T) {
+	var n int32
+	h := newTestHandler(t, newTestConfig(t, newTestUpstream(t, &n)))
+	misses, bypasses := cacheMisses.Value(), cacheBypasses.Value()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/form", nil))
+	get(h, "/page")
+	if got := cacheMisses.Value() - misses; got != 1 {
+		t.Errorf("counted %d misses, want 1 for the GET", got)
+	}
+	if got := cacheBypasses.Value() - bypasses; got != 1 {
+		t.Errorf("counted %d bypasses, want 1 for the POST", got)
+	}
+}
+
+func TestProxyConfig(t *testing.T) {
+	var n int32
+	u := newTestUpstream(t, &n)
+	cfg := DefaultConfig()
+	cfg.Upstream = u.String()
+	cfg.UpstreamRoutes["/api"] = u
+	cfg.CacheDir = t.TempDir()
+	cfg.MaxCacheSize = 1 << 20
+	cfg.MaxTTL = time.Hour
+	cfg.Offline = true
+	if err := cfg.CacheInclude.Set("/static/*"); err != nil {
+		t.Fatal(err)
+	}
+	p := newTestHandler(t, cfg)
+	if upstreamUrl.String() != u.String() || requestUpstream(httptest.NewRequest(http.MethodGet, "/api/x", nil)) != u {
+		t.Errorf("upstreams = %v and %v, want %v for both", upstreamUrl, conf.UpstreamRoutes["/api"], u)
+	}
+	if fs, ok := p.cache.(*FsCache); !ok || fs.dir != cfg.CacheDir || fs.maxSize != 1<<20 || !isOffline() {
+		t.Errorf("got cache %#v and offline %v", p.cache, isOffline())
+	}
+	if rec := get(p, "/static/a"); rec.Code != http.StatusGatewayTimeout || n != 0 {
+		t.Errorf("offline miss got %d after %d upstream requests, want 504 without any", rec.Code, n)
+	}
+}
+
+func TestNewStartsOver(t *testing.T) {
+	var n int32
+	u := newTestUpstream(t, &n)
+	p := newTestHandler(t, newTestConfig(t, u, "--upstream="+u.String(), "--cache-include=/a/*"))
+	if len(upstreamPools) != 1 {
+		t.Fatalf("got %d upstream pools, want 1 for the repeated --upstream", len(upstreamPools))
+	}
+	p.Close()
+	newTestHandler(t, newTestConfig(t, u))
+	if len(upstreamPools) != 0 || len(conf.UpstreamBackends) != 0 || len(conf.CacheInclude) != 0 {
+		t.Errorf("settings kept from the previous proxy: %d pools, %d backends, %d includes",
+			len(upstreamPools), len(conf.UpstreamBackends), len(conf.CacheInclude))
+	}
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, args := range [][]string{
+		{},
+		{"--upstream=http://127.0.0.1:1", "--balance=random"},
+		{"--upstream=http://127.0.0.1:1", "--cache-backend=memory"},
+		{"--upstream=http://127.0.0.1:1", "--mode=forward"},
+	} {
+		if _, err := New(newTestConfig(t, nil, args...)); err == nil {
+			t.Errorf("New with %v succeeded, want an error", args)
+		}
+	}
+	cfg := newTestConfig(t, nil)
+	cfg.Upstream = "/relative"
+	if _, err := New(cfg); err == nil {
+		t.Errorf("New with a relative upstream succeeded, want an error")
+	}
+}
+
+func TestProxyCloseStopsHealthChecks(t *testing.T) {
+	var probes int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	p := newTestHandler(t, newTestConfig(t, u, "--upstream-health-interval=5ms", "--max-cache-age=1h"))
+	for atomic.LoadInt32(&probes) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if fs := p.cache.(*FsCache); fs.stopSweep != nil {
+		t.Errorf("janitor still running once closed")
+	}
+	// A probe may still be finishing
+	time.Sleep(20 * time.Millisecond)
+	n := atomic.LoadInt32(&probes)
+	time.Sleep(50 * time.Millisecond)
+	if got := atomic.LoadInt32(&probes); got != n {
+		t.Errorf("got %d probes once closed, want none", got-n)
+	}
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// headerRule changes a header of the requests sent upstream, or of the
+// responses sent to clients.
+type headerRule struct {
+	op    byte // '=' sets, '+' adds, '-' removes and '~' rewrites
+	name  string
+	value string
+	re    *regexp.Regexp
+}
+
+// headerRules implements flag.Value, parsing repeated rules: NAME: VALUE
+// sets a header, +NAME: VALUE adds a value, -NAME removes the header, and
+// ~NAME: PATTERN=>REPLACEMENT rewrites its values.
+type headerRules []headerRule
+
+func (h *headerRules) String() string {
+	if h == nil {
+		return ""
+	}
+	var s []string
+	for _, rule := range *h {
+		switch rule.op {
+		case '-':
+			s = append(s, "-"+rule.name)
+		case '~':
+			s = append(s, "~"+rule.name+": "+rule.re.String()+"=>"+rule.value)
+		case '+':
+			s = append(s, "+"+rule.name+": "+rule.value)
+		default:
+			s = append(s, rule.name+": "+rule.value)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (h *headerRules) Set(v string) error {
+	rule, spec := headerRule{op: '='}, v
+	if spec != "" && strings.ContainsRune("+-~", rune(spec[0])) {
+		rule.op, spec = spec[0], spec[1:]
+	}
+	name, hasValue := spec, false
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name, rule.value, hasValue = spec[:i], strings.TrimSpace(spec[i+1:]), true
+	}
+	if name = strings.TrimSpace(name); name == "" || strings.ContainsAny(name, " \t") {
+		return fmt.Errorf("invalid header name %q", name)
+	}
+	rule.name = http.CanonicalHeaderKey(name)
+	switch {
+	case rule.op == '-' && hasValue:
+		return fmt.Errorf("unexpected value in %q, use -NAME", v)
+	case rule.op != '-' && !hasValue:
+		return fmt.Errorf("missing value in %q, use NAME: VALUE", v)
+	case rule.op == '~':
+		i := strings.Index(rule.value, "=>")
+		if i < 0 {
+			return fmt.Errorf("missing replacement in %q, use ~NAME: PATTERN=>REPLACEMENT", v)
+		}
+		re, err := regexp.Compile(rule.value[:i])
+		if err != nil {
+			return fmt.Errorf("invalid pattern %q: %v", rule.value[:i], err)
+		}
+		rule.re, rule.value = re, rule.value[i+2:]
+	}
+	*h = append(*h, rule)
+	return nil
+}
+
+// Apply changes h, the headers of a request sent upstream or of a response,
+// for the client request r. Set and added values expand $scheme, $host and
+// $client_ip with those r was received with; rewrites expand the groups of
+// their pattern instead.
+func (h headerRules) Apply(header http.Header, r *http.Request) {
+	vars := func(name string) string {
+		switch name {
+		case "scheme":
+			if r.TLS != nil {
+				return "https"
+			}
+			return "http"
+		case "host":
+			return r.Host
+		case "client_ip":
+			return clientIP(r)
+		}
+		return "$" + name
+	}
+	for _, rule := range h {
+		switch rule.op {
+		case '=':
+			header.Set(rule.name, os.Expand(rule.value, vars))
+		case '+':
+			header.Add(rule.name, os.Expand(rule.value, vars))
+		case '-':
+			header.Del(rule.name)
+		case '~':
+			for i, v := range header[rule.name] {
+				header[rule.name][i] = rule.re.ReplaceAllString(v, rule.value)
+			}
+		}
+	}
+}
+
+// rewriteResponseHeaders applies the --response-header rules to the
+// responses of next, whether served from the cache or not.
+func rewriteResponseHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, onHeader: func(h http.Header) {
+			conf.ResponseHeaderRules.Apply(h, r)
+		}}
+		next.ServeHTTP(rec, r)
+	})
+}
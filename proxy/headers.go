@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// defaultCacheHeaders are the response headers stored with cache entries
+// and replayed on hits, unless set by --cache-headers.
+const defaultCacheHeaders = "Content-Type,Content-Encoding,Content-Language,Content-Disposition,ETag,Last-Modified,Cache-Control,Expires,Vary,Link"
+
+// hopHeaders are meaningful only for a single connection, and never
+// stored.
+var hopHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization",
+	"Proxy-Connection", "Te", "Trailer", "Transfer-Encoding", "Upgrade",
+}
+
+// parseHeaderList parses a comma-separated list of header names.
+func parseHeaderList(v string) []string {
+	var names []string
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	return names
+}
+
+// validatorHeaders are always stored, as expired entries are revalidated
+// with them.
+var validatorHeaders = []string{"ETag", "Last-Modified"}
+
+// setCacheHeaders sets --cache-headers from the comma-separated list v.
+// Cookies are never stored, as they would be replayed to every client.
+func (c *Config) setCacheHeaders(v string) error {
+	names := parseHeaderList(v)
+	for _, name := range names {
+		if name == "Set-Cookie" {
+			return errors.New("Set-Cookie cannot be stored, it would be replayed to every client")
+		}
+	}
+	for _, validator := range validatorHeaders {
+		if !containsHeader(names, validator) {
+			names = append(names, validator)
+		}
+	}
+	c.CacheHeaders = names
+	return nil
+}
+
+func containsHeader(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// storedHeaders returns the headers of w listed in --cache-headers, to be
+// stored along with the cached body.
+func storedHeaders(w *http.Response) http.Header {
+	h := make(http.Header)
+	for _, name := range conf.CacheHeaders {
+		if v := w.Header.Values(name); len(v) > 0 {
+			h[name] = append([]string(nil), v...)
+		}
+	}
+	return h
+}
+
+// removeHopHeaders deletes hop-by-hop headers from h, including the ones
+// listed in its Connection header.
+func removeHopHeaders(h http.Header) {
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
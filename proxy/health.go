@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errUpstreamUnhealthy = errors.New("upstream is unhealthy")
+
+// healthChecker probes an upstream server and keeps track of its health.
+type healthChecker struct {
+	target *url.URL
+	client *http.Client
+
+	mu        sync.Mutex
+	healthy   bool
+	checkedAt time.Time
+	lastErr   error
+}
+
+// healthStatus is the JSON representation of a healthChecker state.
+type healthStatus struct {
+	Upstream  string    `json:"upstream"`
+	Healthy   bool      `json:"healthy"`
+	CheckedAt time.Time `json:"checked_at"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// upstreamHealth maps the default upstream, and those routed to, to their
+// health checker. Upstreams with the same URL share one.
+var upstreamHealth map[*url.URL]*healthChecker
+
+// initHealth creates the checkers of the upstreams, sending the probes
+// with t.
+func initHealth(t http.RoundTripper) {
+	upstreamHealth = make(map[*url.URL]*healthChecker)
+	byURL := make(map[string]*healthChecker)
+	add := func(u *url.URL) {
+		if u == nil {
+			return
+		}
+		h := byURL[u.String()]
+		if h == nil {
+			h = newHealthChecker(u, t)
+			byURL[u.String()] = h
+		}
+		upstreamHealth[u] = h
+	}
+	add(upstreamUrl)
+	for _, host := range conf.UpstreamRoutes.Hosts() {
+		add(conf.UpstreamRoutes[host])
+	}
+}
+
+// healthOf returns the checker of the upstream u, or nil if it has none,
+// as the origin servers of forward proxies.
+func healthOf(u *url.URL) *healthChecker {
+	return upstreamHealth[u]
+}
+
+// healthCheckers returns the checkers of all upstreams, sorted by URL.
+func healthCheckers() []*healthChecker {
+	seen := make(map[*healthChecker]bool)
+	var checkers []*healthChecker
+	for _, h := range upstreamHealth {
+		if !seen[h] {
+			seen[h] = true
+			checkers = append(checkers, h)
+		}
+	}
+	sort.Slice(checkers, func(i, j int) bool {
+		return checkers[i].target.String() < checkers[j].target.String()
+	})
+	return checkers
+}
+
+// healthStatuses returns the last known health of all upstreams.
+func healthStatuses() []healthStatus {
+	statuses := []healthStatus{}
+	for _, h := range healthCheckers() {
+		statuses = append(statuses, h.Status())
+	}
+	return statuses
+}
+
+// newHealthChecker initializes a checker for target, using t to send the
+// probes. Upstreams are considered healthy until the first probe fails.
+func newHealthChecker(target *url.URL, t http.RoundTripper) *healthChecker {
+	return &healthChecker{
+		target:  target,
+		client:  &http.Client{Transport: t},
+		healthy: true,
+	}
+}
+
+// Check probes the upstream with a HEAD request. Any response other than
+// a server error counts as healthy.
+func (h *healthChecker) Check(ctx context.Context) error {
+	if h.target == nil {
+		// Forward proxies have no upstream of their own
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, h.target.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			err = fmt.Errorf("probe returned %v", resp.Status)
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if healthy := err == nil; healthy != h.healthy {
+		log.Printf("[health] Upstream %v changed health: healthy=%v (err=%v)", h.target, healthy, err)
+	}
+	h.healthy = err == nil
+	h.checkedAt = time.Now()
+	h.lastErr = err
+	return err
+}
+
+// Run probes the upstream every interval, until ctx is done.
+func (h *healthChecker) Run(ctx context.Context, interval time.Duration) {
+	for {
+		// The upstream is left alone while offline
+		if !isOffline() {
+			probe, cancel := context.WithTimeout(ctx, interval)
+			h.Check(probe)
+			cancel()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// Healthy reports the result of the last probe.
+func (h *healthChecker) Healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.healthy
+}
+
+// Status returns the current state of the checker.
+func (h *healthChecker) Status() healthStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := healthStatus{
+		Healthy:   h.healthy,
+		CheckedAt: h.checkedAt,
+	}
+	if h.target != nil {
+		s.Upstream = h.target.String()
+	}
+	if h.lastErr != nil {
+		s.Error = h.lastErr.Error()
+	}
+	return s
+}
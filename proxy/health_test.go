@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+)
+
+func TestHealthPerRoute(t *testing.T) {
+	var good, bad int32
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodHead {
+			atomic.AddInt32(&bad, 1)
+		}
+		http.Error(w, "down", http.StatusInternalServerError)
+	}))
+	defer down.Close()
+	downURL, _ := url.Parse(down.URL)
+	h := newTestHandler(t, newTestConfig(t, nil,
+		"--upstream=/a="+newTestUpstream(t, &good).String(),
+		"--upstream=/b="+downURL.String(),
+		"--upstream-health-interval=1h",
+	))
+	checkers := healthCheckers()
+	if len(checkers) != 2 {
+		t.Fatalf("got %d health checkers, want one per route", len(checkers))
+	}
+	for _, c := range checkers {
+		c.Check(context.Background())
+	}
+
+	if rec := get(h, "/a/page"); rec.Code != http.StatusOK {
+		t.Errorf("healthy route got %d, want 200", rec.Code)
+	}
+	if rec := get(h, "/b/page"); rec.Code == http.StatusOK || atomic.LoadInt32(&bad) != 0 {
+		t.Errorf("unhealthy route got %d after %d upstream requests, want to fail fast", rec.Code, bad)
+	}
+
+	atomic.StoreInt32(&ready, 1)
+	defer atomic.StoreInt32(&ready, 0)
+	rec := httptest.NewRecorder()
+	readyzHandler(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	var got struct {
+		Upstreams []healthStatus `json:"upstreams"`
+	}
+	json.NewDecoder(rec.Body).Decode(&got)
+	if rec.Code != http.StatusServiceUnavailable || len(got.Upstreams) != 2 {
+		t.Errorf("/readyz got %d with %d upstreams, want 503 with both", rec.Code, len(got.Upstreams))
+	}
+}
+
+func TestHealthzIsLiveness(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:1")
+	newTestHandler(t, newTestConfig(t, u))
+	rec := httptest.NewRecorder()
+	healthzHandler(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("/healthz got %d with an unreachable upstream, want 200", rec.Code)
+	}
+}
+
+func TestHealthzDetailsRequireAuth(t *testing.T) {
+	u, _ := url.Parse("http://127.0.0.1:1")
+	newTestHandler(t, newTestConfig(t, u, "--metrics-auth-token=secret"))
+	for _, token := range []string{"", "wrong", "secret"} {
+		r := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		healthzHandler(rec, r)
+		var got map[string]interface{}
+		json.NewDecoder(rec.Body).Decode(&got)
+		if _, ok := got["upstreams_healthy"]; rec.Code != http.StatusOK || !ok {
+			t.Errorf("/healthz with token %q got %d %v, want 200 with the aggregate status", token, rec.Code, got)
+		}
+		if _, listed := got["upstreams"]; listed != (token == "secret") {
+			t.Errorf("/healthz with token %q listed upstreams: %v", token, listed)
+		}
+	}
+}
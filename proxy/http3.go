@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// listenHTTP3 serves handler over HTTP/3 with tlsConfig, on the UDP ports
+// matching the TCP listeners, returning the server to shut down.
+func listenHTTP3(listeners []net.Listener, handler http.Handler, tlsConfig *tls.Config) *http3.Server {
+	srv := &http3.Server{
+		Handler:     handler,
+		TLSConfig:   http3.ConfigureTLSConfig(tlsConfig),
+		IdleTimeout: conf.ClientIdleTimeout,
+	}
+	for _, l := range listeners {
+		if l.Addr().Network() != "tcp" {
+			continue
+		}
+		pc, err := net.ListenPacket("udp", l.Addr().String())
+		if err != nil {
+			log.Printf("WARNING: not serving HTTP/3 on %v: %v", l.Addr(), err)
+			continue
+		}
+		go func() {
+			log.Printf("Listening on %v:%v for HTTP/3", pc.LocalAddr().Network(), pc.LocalAddr())
+			if err := srv.Serve(pc); err != nil && err != http.ErrServerClosed {
+				log.Printf("[http3] error serving on %v: %v", pc.LocalAddr(), err)
+			}
+		}()
+	}
+	return srv
+}
+
+// advertiseHTTP3 tells clients of next, over HTTP/1.1 or HTTP/2, that
+// HTTP/3 is served on the UDP port matching the one they connected to.
+func advertiseHTTP3(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "tcp" {
+			if _, port, err := net.SplitHostPort(addr.String()); err == nil {
+				w.Header().Set("Alt-Svc", fmt.Sprintf(`h3=":%v"; ma=86400`, port))
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,25 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdvertiseHTTP3(t *testing.T) {
+	h := advertiseHTTP3(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for addr, want := range map[net.Addr]string{
+		&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8443}: `h3=":8443"; ma=86400`,
+		&net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}:  "",
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r = r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, addr))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if got := rec.Header().Get("Alt-Svc"); got != want {
+			t.Errorf("over %v, Alt-Svc = %q, want %q", addr, got, want)
+		}
+	}
+}
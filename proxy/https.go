@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// httpsRedirect redirects plain HTTP clients to the same URL over HTTPS,
+// on port, which is omitted if it is the default one.
+type httpsRedirect struct {
+	port string
+}
+
+func (h httpsRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host := r.Host
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		host = name
+	}
+	if host == "" {
+		http.Error(w, "Missing Host header", http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(host, ":") {
+		// IPv6 literals
+		host = "[" + strings.Trim(host, "[]") + "]"
+	}
+	if h.port != "" && h.port != "443" {
+		host += ":" + h.port
+	}
+	code := http.StatusMovedPermanently
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		// Keeps the method and body of the request
+		code = http.StatusPermanentRedirect
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), code)
+}
+
+// httpsPort returns the port of the first TCP address in addrs, to
+// redirect to.
+func httpsPort(addrs []string) string {
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "unix:") {
+			continue
+		}
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			return port
+		}
+	}
+	return "443"
+}
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SetMaxAge starts a janitor evicting, every interval, the entries not read
+// nor written for longer than maxAge, as well as expired ones that would
+// be evicted when read, so the cache does not keep entries nobody asks
+// for anymore. Pinned entries are never evicted. The janitor stops once
+// the cache is closed.
+func (c *FsCache) SetMaxAge(maxAge, interval time.Duration) {
+	c.maxAge = maxAge
+	c.usedGranularity = interval
+	c.stopSweep = make(chan struct{})
+	go func(stop chan struct{}) {
+		for {
+			c.sweep()
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}(c.stopSweep)
+}
+
+// markUsed records that key was read in the modification time of its
+// headers file, which is never served, at most once per sweep interval.
+func (c *FsCache) markUsed(key string) {
+	if c.maxAge <= 0 {
+		return
+	}
+	name := key + ".headers"
+	st, err := os.Stat(name)
+	if err != nil || time.Since(st.ModTime()) < c.usedGranularity {
+		return
+	}
+	now := time.Now()
+	if err := os.Chtimes(name, now, now); err != nil {
+		log.Printf("[fscache] error marking key=%v as used: %v", key, err)
+	}
+}
+
+// sweep evicts unused and expired entries.
+func (c *FsCache) sweep() {
+	start := time.Now()
+	var evicted, scanned int
+	filepath.WalkDir(c.dir, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && name != c.dir && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if d.IsDir() || !strings.HasSuffix(name, ".headers") {
+			return nil
+		}
+		scanned++
+		key := strings.TrimSuffix(name, ".headers")
+		if c.pinned(c.keyOf(key)) {
+			return nil
+		}
+		st, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		reason := ""
+		if time.Since(st.ModTime()) > c.maxAge {
+			reason = "unused for over " + c.maxAge.String()
+		} else if sweepExpired(name) {
+			reason = "expired"
+		}
+		if reason == "" {
+			return nil
+		}
+		log.Printf("[fscache] Evicting key=%v: %v", key, reason)
+		c.emitEvict(key)
+		if err := c.evict(key); err == nil {
+			evicted++
+		}
+		return nil
+	})
+	log.Printf("[fscache] Swept %d entries in %v, evicted %d", scanned, time.Since(start).Round(time.Millisecond), evicted)
+}
+
+// sweepExpired reports whether the entry with the headers file name is past
+// its stale windows, as set by evictAfter.
+func sweepExpired(name string) bool {
+	b, err := os.ReadFile(name)
+	if err != nil {
+		return false
+	}
+	h := make(http.Header)
+	if err := json.Unmarshal(b, &h); err != nil {
+		return false
+	}
+	t, ok := evictAfter(h)
+	return ok && time.Now().After(t)
+}
+
+// evictAfter returns when the entry with headers h is past its stale
+// windows and would be evicted when read, rather than revalidated or kept
+// to be served on upstream errors, or false if it is kept until then.
+func evictAfter(h http.Header) (time.Time, bool) {
+	if conf.ServeStaleOnError || hasValidators(h) {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(h.Get(expiresHeader))
+	if err != nil {
+		return time.Time{}, false
+	}
+	grace, ifError := staleWindows(h.Clone())
+	if ifError > grace {
+		grace = ifError
+	}
+	return t.Add(grace), true
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// keyQuery returns the query of the cache key for path p, without the
+// parameters ignored by --ignore-query-param, sorted with --sort-query, or
+// empty for paths matching --ignore-query. Queries that cannot be parsed
+// are kept as they are.
+func keyQuery(p, query string) string {
+	if query == "" || conf.IgnoreQueryPaths.Match(p) {
+		return ""
+	}
+	if len(conf.IgnoreQueryParams) == 0 && !conf.SortQuery {
+		return query
+	}
+	params := strings.Split(query, "&")
+	kept := params[:0]
+	for _, param := range params {
+		if name, err := url.QueryUnescape(queryParamName(param)); err == nil && ignoredQueryParam(name) {
+			continue
+		}
+		kept = append(kept, param)
+	}
+	if conf.SortQuery {
+		// Values repeated under the same name keep their order
+		sort.SliceStable(kept, func(i, j int) bool {
+			return queryParamName(kept[i]) < queryParamName(kept[j])
+		})
+	}
+	return strings.Join(kept, "&")
+}
+
+// queryParamName returns the escaped name of the query parameter param.
+func queryParamName(param string) string {
+	if i := strings.Index(param, "="); i >= 0 {
+		return param[:i]
+	}
+	return param
+}
+
+// ignoredQueryParam reports whether name matches --ignore-query-param,
+// either exactly or, for values ending with '*', by prefix.
+func ignoredQueryParam(name string) bool {
+	for _, p := range conf.IgnoreQueryParams {
+		if name == p || (strings.HasSuffix(p, "*") && strings.HasPrefix(name, p[:len(p)-1])) {
+			return true
+		}
+	}
+	return false
+}
+
+// setKeyHeaders sets --cache-key-headers from the comma-separated list v.
+func (c *Config) setKeyHeaders(v string) error {
+	c.KeyHeaders = parseHeaderList(v)
+	sort.Strings(c.KeyHeaders)
+	return nil
+}
+
+// keyHeadersURI extends uri with the values of --cache-key-headers in r,
+// so each combination is cached on its own.
+func keyHeadersURI(uri string, r *http.Request) string {
+	if len(conf.KeyHeaders) == 0 {
+		return uri
+	}
+	return variantURI(uri, r, conf.KeyHeaders)
+}
@@ -0,0 +1,44 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// errResponseTooLarge is reported for upstream responses over
+// --max-response-size.
+var errResponseTooLarge = errors.New("response is over --max-response-size")
+
+// limitResponse fails for upstream responses w declaring a length over
+// --max-response-size, and cuts the body of those of unknown length once
+// over it, so neither clients nor the cache get more.
+func limitResponse(w *http.Response) error {
+	max := int64(conf.MaxResponseSize)
+	if w.ContentLength > max {
+		w.Body.Close()
+		return fmt.Errorf("%w: %d bytes", errResponseTooLarge, w.ContentLength)
+	}
+	if w.ContentLength < 0 {
+		w.Body = limitBlob(w.Body, max, errResponseTooLarge)
+	}
+	return nil
+}
+
+// cancelOnClose calls a cancel function once closed, as the body of an
+// upstream response, ending its --upstream-timeout and in-flight count.
+type cancelOnClose context.CancelFunc
+
+func (c cancelOnClose) Close() error {
+	c()
+	return nil
+}
+
+// setServerTimeouts applies the --client-*-timeout flags to srv.
+func setServerTimeouts(srv *http.Server) {
+	srv.ReadHeaderTimeout = conf.ClientReadHeaderTimeout
+	srv.ReadTimeout = conf.ClientReadTimeout
+	srv.WriteTimeout = conf.ClientWriteTimeout
+	srv.IdleTimeout = conf.ClientIdleTimeout
+}
@@ -0,0 +1,70 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenList implements flag.Value, parsing repeated --listen addresses.
+type listenList []string
+
+func (l *listenList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *listenList) Set(v string) error {
+	addr, err := normalizeListenAddr(v)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, addr)
+	return nil
+}
+
+// normalizeListenAddr validates addr as a host:port pair, accepting bare
+// port numbers as well, or as a unix:PATH socket.
+func normalizeListenAddr(addr string) (string, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		if addr == "unix:" {
+			return "", errors.New("missing socket path")
+		}
+		return addr, nil
+	}
+	if _, err := strconv.Atoi(addr); err == nil {
+		addr = ":" + addr
+	}
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return "", err
+	}
+	return addr, nil
+}
+
+// listen opens a listener at addr, as returned by normalizeListenAddr.
+// Sockets left behind by a previous run are removed first, but never
+// other files. Workers use the listener inherited for addr, if any.
+func listen(addr string) (net.Listener, error) {
+	if l, ok := inherited[addr]; ok {
+		delete(inherited, addr)
+		return l, nil
+	}
+	if !strings.HasPrefix(addr, "unix:") {
+		return net.Listen("tcp", addr)
+	}
+	path := strings.TrimPrefix(addr, "unix:")
+	if st, err := os.Stat(path); err == nil && st.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
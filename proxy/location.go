@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// rewriteLocations makes the Location, Content-Location and Refresh
+// headers of w relative when they point to its upstream, or any of its
+// backends, so clients keep going through the proxy. Locations elsewhere
+// are left untouched.
+func rewriteLocations(w *http.Response) {
+	u := requestUpstream(w.Request)
+	if u == nil {
+		return
+	}
+	targets := []*url.URL{u}
+	if p := upstreamPools[u]; p != nil {
+		targets = targets[:0]
+		for _, b := range p.backends {
+			targets = append(targets, b.url)
+		}
+	}
+	relative := func(location string) string {
+		for _, t := range targets {
+			if rel := upstreamRelative(t, location); rel != location {
+				return unroutedPath(u, rel)
+			}
+		}
+		return location
+	}
+	for _, name := range []string{"Location", "Content-Location"} {
+		if v := w.Header.Get(name); v != "" {
+			w.Header.Set(name, relative(v))
+		}
+	}
+	// Refresh: 5; url=https://example.com/next
+	if v := w.Header.Get("Refresh"); v != "" {
+		if i := strings.Index(strings.ToLower(v), "url="); i >= 0 {
+			target := strings.Trim(strings.TrimSpace(v[i+4:]), `'"`)
+			w.Header.Set("Refresh", v[:i+4]+relative(target))
+		}
+	}
+}
+
+// upstreamRelative returns location relative to the proxy if it is an
+// absolute URL with the same scheme, host and port as upstream u.
+func upstreamRelative(u *url.URL, location string) string {
+	l, err := url.Parse(location)
+	if err != nil || l.Host == "" {
+		// Already relative, or not ours to fix
+		return location
+	}
+	if l.Scheme == "" {
+		// Scheme-relative URLs use the one of the upstream request
+		l.Scheme = u.Scheme
+	}
+	if !strings.EqualFold(l.Scheme, u.Scheme) || canonicalHost(l) != canonicalHost(u) || l.User != nil {
+		return location
+	}
+	rel := &url.URL{Path: l.Path, RawPath: l.RawPath, RawQuery: l.RawQuery, Fragment: l.Fragment}
+	if !strings.HasPrefix(rel.Path, "/") {
+		rel.Path, rel.RawPath = "/"+rel.Path, ""
+	}
+	if strings.HasPrefix(rel.EscapedPath(), "//") {
+		// Would be read as a host by clients
+		rel.Path, rel.RawPath = "/"+strings.TrimLeft(rel.Path, "/"), ""
+	}
+	return rel.String()
+}
+
+// unroutedPath undoes routedPath on the relative location rel, pointing to
+// upstream u: with /api=https://api.internal/v2, /v2/users becomes
+// /api/users.
+func unroutedPath(u *url.URL, rel string) string {
+	prefix := routedPrefix(u)
+	if prefix == "" || u.Path == "" {
+		return rel
+	}
+	base := strings.TrimSuffix(u.EscapedPath(), "/")
+	if rel != base && !strings.HasPrefix(rel, base+"/") && !strings.HasPrefix(rel, base+"?") && !strings.HasPrefix(rel, base+"#") {
+		return rel
+	}
+	if p := strings.TrimSuffix(prefix, "/") + strings.TrimPrefix(rel, base); strings.HasPrefix(p, "/") {
+		return p
+	}
+	return "/" + strings.TrimPrefix(rel, base)
+}
+
+// canonicalHost returns the lowercase host of u, with its port made
+// explicit.
+func canonicalHost(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[strings.ToLower(u.Scheme)]
+	}
+	return strings.ToLower(u.Hostname()) + ":" + port
+}
@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"container/list"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// lruIndex keeps track of the entries in a FsCache and their total size,
+// ordered by last access.
+type lruIndex struct {
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // of *lruEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type lruEntry struct {
+	key  string
+	size int64
+}
+
+func newLRUIndex() *lruIndex {
+	return &lruIndex{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// SetMaxSize enables evicting the least recently used entries once the
+// cache grows over max bytes. Entries already in the index are accounted
+// for their size, the oldest written being the first to go.
+func (c *FsCache) SetMaxSize(max int64) error {
+	c.maxSize = max
+	c.lru = newLRUIndex()
+	if c.index == nil {
+		c.loadIndex(false)
+	}
+	entries := c.index.list()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Stored.Before(entries[j].Stored) })
+	for _, e := range entries {
+		c.track(c.path(e.Key), e.Size+e.HeaderSize)
+	}
+	log.Printf("[fscache] Found %d entries using %d bytes, limit is %d bytes", len(entries), c.lru.size, max)
+	c.evictLRU()
+	return nil
+}
+
+// track records key as the most recently used entry, with size bytes.
+func (c *FsCache) track(key string, size int64) {
+	if c.lru == nil {
+		return
+	}
+	l := c.lru
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.entries[key]; ok {
+		e := el.Value.(*lruEntry)
+		l.size += size - e.size
+		e.size = size
+		l.order.MoveToFront(el)
+		return
+	}
+	l.entries[key] = l.order.PushFront(&lruEntry{key: key, size: size})
+	l.size += size
+}
+
+// touch marks key as the most recently used entry, and as used for the
+// janitor.
+func (c *FsCache) touch(key string) {
+	name := c.path(key)
+	c.markUsed(name)
+	if c.lru == nil {
+		return
+	}
+	l := c.lru
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.entries[name]; ok {
+		l.order.MoveToFront(el)
+	}
+}
+
+// untrack forgets about key.
+func (c *FsCache) untrack(key string) {
+	if c.lru == nil {
+		return
+	}
+	l := c.lru
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if el, ok := l.entries[key]; ok {
+		l.removeElement(el)
+	}
+}
+
+// untrackDir forgets about every entry under dir. It goes through all the
+// entries, so it is only used to flush whole directories.
+func (c *FsCache) untrackDir(dir string) {
+	if c.lru == nil {
+		return
+	}
+	l := c.lru
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for k, el := range l.entries {
+		if strings.HasPrefix(k, dir+string(filepath.Separator)) {
+			l.removeElement(el)
+		}
+	}
+}
+
+// removeElement must be called with l.mu held.
+func (l *lruIndex) removeElement(el *list.Element) {
+	e := l.order.Remove(el).(*lruEntry)
+	l.size -= e.size
+	delete(l.entries, e.key)
+}
+
+// evictLRU removes the least recently used entries, other than pinned
+// ones, until the cache size is within the limit.
+func (c *FsCache) evictLRU() {
+	if c.lru == nil {
+		return
+	}
+	l := c.lru
+	var victims []string
+	l.mu.Lock()
+	for el := l.order.Back(); el != nil && l.size > c.maxSize; {
+		e := el.Value.(*lruEntry)
+		prev := el.Prev()
+		if !c.pinned(c.keyOf(e.key)) {
+			victims = append(victims, e.key)
+			l.removeElement(el)
+		}
+		el = prev
+	}
+	size := l.size
+	l.mu.Unlock()
+
+	for _, key := range victims {
+		log.Printf("[fscache] Evicting key=%v", key)
+		c.emitEvict(key)
+		c.evict(key)
+	}
+	if size > c.maxSize {
+		log.Printf("[fscache] WARNING: pinned entries use %d bytes, over --max-cache-size=%d", size, c.maxSize)
+	}
+}
+
+// Stats returns the cache size accounting, if enabled.
+func (c *FsCache) Stats() map[string]int64 {
+	if c.lru == nil {
+		return nil
+	}
+	l := c.lru
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return map[string]int64{
+		"size":     l.size,
+		"max_size": c.maxSize,
+		"entries":  int64(len(l.entries)),
+	}
+}
@@ -0,0 +1,781 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Config holds the settings of a Proxy. Each field is set by the flag
+// RegisterFlags defines for it, as Debug by --debug or MaxTTL by --max-ttl,
+// whose usage documents it; DefaultConfig returns them at their defaults.
+// Fields of the rule and list types are set as their flags are, calling
+// their Set method with each value, as in cfg.CacheInclude.Set("/static/*").
+type Config struct {
+	Debug                bool
+	SlowRequestThreshold time.Duration
+	ConfigFile           string
+	AccessLog            string
+	LogFormat            string
+
+	Listen          listenList
+	ShutdownTimeout time.Duration
+	TLSCert         string
+	TLSKey          string
+	ACMEDomains     string
+	ACMECacheDir    string
+	ACMEEmail       string
+	HTTPRedirect    string
+	HTTP2           bool
+	HTTP3           bool
+
+	Mode              string
+	ConnectPorts      string
+	ForwardAllowLocal bool
+
+	// Upstream, UpstreamRoutes and UpstreamBackends are all set by
+	// --upstream: the default upstream, the upstream of routed hosts and
+	// path prefixes, and the backends added by repeating it, per routed
+	// host, or "" for the default one.
+	Upstream         string
+	UpstreamRoutes   hostRoutes
+	UpstreamBackends map[string][]*url.URL
+
+	UpstreamCA                 string
+	UpstreamClientCert         string
+	UpstreamClientKey          string
+	UpstreamInsecureSkipVerify bool
+
+	CacheBackend string
+	CacheDir     string
+	CacheKeyHash string
+	CacheHeaders []string
+	TenantHeader string
+
+	MaxCacheKeyLength   int
+	MaxConcurrentWrites int
+	MinFreeDisk         byteSize
+	MaxCacheSize        byteSize
+	MaxCacheAge         time.Duration
+	MemCacheSize        byteSize
+	MemCacheMaxObject   byteSize
+
+	RedisURL       string
+	RedisMaxObject byteSize
+	S3URL          string
+	S3Region       string
+	S3AccessKey    string
+	S3SecretKey    string
+
+	MinUpstreamLatency time.Duration
+
+	CacheIneligibleAction string
+	CacheIneligibleStatus int
+
+	CaseInsensitivePaths bool
+	NormalizePath        bool
+	SortQuery            bool
+	IgnoreQueryParams    pathList
+	IgnoreQueryPaths     pathPatterns
+	KeyHeaders           []string
+
+	EnableAccelRedirect bool
+
+	DisableUpstreamCompression bool
+	Compress                   bool
+	CompressTypes              string
+
+	AllowTTLParam bool
+	TTLParam      string
+	MinTTL        time.Duration
+	MaxTTL        time.Duration
+
+	HeuristicExpirationWarning bool
+
+	AdminAddr              string
+	MetricsAddr            string
+	ResponseSizeBuckets    string
+	MetricsAuthToken       string
+	MetricsAuthBasic       string
+	AuthBasic              pathList
+	AuthHtpasswd           string
+	AuthBearerTokens       pathList
+	Balance                string
+	UpstreamFailTimeout    time.Duration
+	UpstreamRetries        int
+	UpstreamRetryBackoff   time.Duration
+	CircuitBreakerFailures int
+	CircuitBreakerCooldown time.Duration
+	UpstreamHealthInterval time.Duration
+	ProbeUpstreamOnStart   string
+	UnhealthyErrorRate     float64
+	ErrorRateWindow        time.Duration
+
+	Offline bool
+
+	PinPaths pathList
+
+	CacheInclude pathPatterns
+	CacheExclude pathPatterns
+
+	CacheContentTypes        mediaPatterns
+	CacheExcludeContentTypes mediaPatterns
+	MaxCacheObjectSize       byteSize
+
+	MaxConnsPerIP  int
+	RateLimit      float64
+	RateBurst      int
+	TrustedProxies ipNets
+	ProxyProtocol  bool
+
+	DialTimeout           time.Duration
+	IdleConnTimeout       time.Duration
+	MaxIdleConns          int
+	ResponseHeaderTimeout time.Duration
+	UpstreamTimeout       time.Duration
+	MaxResponseSize       byteSize
+
+	ClientReadHeaderTimeout time.Duration
+	ClientReadTimeout       time.Duration
+	ClientWriteTimeout      time.Duration
+	ClientIdleTimeout       time.Duration
+
+	PathRewrites pathRewriteRules
+
+	FlushInterval     time.Duration
+	RangeMissStrategy string
+	StaleGrace        time.Duration
+	ServeStaleOnError bool
+
+	HonorClientNoCache bool
+	RefreshHeader      string
+	RefreshToken       string
+
+	PrefetchLinks       bool
+	PrefetchConcurrency int
+	WarmConcurrency     int
+
+	ForwardClientCert   bool
+	ClientCacheControl  string
+	AllowMethodOverride bool
+
+	CookieDomainRules rewriteRules
+	CookiePathRules   rewriteRules
+	StripCookieSecure bool
+
+	RewriteBodies     bool
+	RewriteBodyOrigin string
+	RewriteBodyTypes  string
+
+	RequestHeaderRules  headerRules
+	ResponseHeaderRules headerRules
+
+	NegativePaths negativePathRules
+	CacheStatuses map[int]bool
+	NegativeTTL   time.Duration
+	JSONSchemas   schemaRules
+
+	EventWebhook   string
+	EventQueueSize int
+
+	OTelEndpoint    string
+	OTelServiceName string
+
+	// Cache, if set, stores the entries instead of the --cache-backend.
+	Cache CacheManager
+
+	flags *flag.FlagSet
+}
+
+var (
+	// conf holds the settings of the running Proxy.
+	conf = new(Config)
+
+	cache       CacheManager
+	upstreamUrl *url.URL
+	ready       int32
+	events      *eventSink
+)
+
+// RegisterFlags resets c to the defaults of the settings, defining them as
+// flags in fs, which set c once parsed.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	// Flags of custom types default to the value they hold
+	*c = Config{
+		UpstreamRoutes:    make(hostRoutes),
+		UpstreamBackends:  make(map[string][]*url.URL),
+		CacheHeaders:      parseHeaderList(defaultCacheHeaders),
+		CacheStatuses:     map[int]bool{http.StatusOK: true},
+		RedisMaxObject:    16 << 20,
+		MemCacheMaxObject: 64 << 10,
+		flags:             fs,
+	}
+	fs.BoolVar(&c.Debug, "debug", false, "Enable debug logging")
+	fs.StringVar(&c.AccessLog, "access-log", "", "Log one line per request to `FILE`, or to the standard output if -; disabled if empty")
+	fs.StringVar(&c.LogFormat, "log-format", "combined", "Write the access log in the Apache `combined` format, followed by the cache status, upstream and latency, or as JSON (json)")
+	fs.StringVar(&c.ConfigFile, "config", "", "Read settings from the YAML `FILE`, keyed by flag name, reloading it on SIGHUP without dropping connections; command line flags take precedence")
+	fs.DurationVar(&c.SlowRequestThreshold, "slow-request-threshold", 0, "Log a warning with a timing breakdown for requests taking longer than `DURATION` (0 disables)")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "On SIGINT or SIGTERM, wait up to `DURATION` for in-flight requests and cache writes to finish")
+	fs.Var(&c.Listen, "listen", "Listen for client requests at `ADDRESS`, as host:port, a bare port number or unix:PATH; may be repeated (default :8080)")
+	fs.StringVar(&c.TLSCert, "tls-cert", "", "Serve clients over HTTPS with the certificate chain in `FILE`, in PEM format; requires --tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", "", "Set the private key `FILE` for --tls-cert, in PEM format")
+	fs.StringVar(&c.ACMEDomains, "acme-domains", "", "Serve clients over HTTPS with certificates obtained and renewed from Let's Encrypt for the domains in the comma-separated `LIST`, instead of --tls-cert")
+	fs.StringVar(&c.ACMECacheDir, "acme-cache-dir", "acme", "Keep the --acme-domains certificates and account key in `DIR`")
+	fs.StringVar(&c.ACMEEmail, "acme-email", "", "Register the --acme-domains account with the contact `EMAIL`, to be told of certificate problems")
+	fs.BoolVar(&c.HTTP2, "http2", true, "Negotiate HTTP/2 with HTTPS clients, multiplexing their requests on one connection; false serves HTTP/1.1 only")
+	fs.BoolVar(&c.HTTP3, "http3", false, "Also serve HTTPS clients over HTTP/3, on the UDP ports matching the TCP ones, advertising it with Alt-Svc")
+	fs.StringVar(&c.HTTPRedirect, "http-redirect", "", "Redirect plain HTTP clients at `ADDRESS` to HTTPS, e.g. :80; requires --tls-cert or --acme-domains, which defaults it to :80")
+	fs.StringVar(&c.Mode, "mode", "reverse", "Run as a `reverse` proxy for --upstream, or as an explicit forward proxy (forward) caching plain HTTP for any host and tunneling CONNECT")
+	fs.StringVar(&c.ConnectPorts, "connect-ports", "443", "Only tunnel CONNECT requests in --mode=forward to the ports in the comma-separated `LIST`, or to any port with *")
+	fs.BoolVar(&c.ForwardAllowLocal, "forward-allow-local", false, "Let --mode=forward clients reach loopback and link-local addresses, such as the proxy host itself or cloud metadata services")
+	fs.Var(upstreamFlag{c}, "upstream", "Set the `URL` endpoint to proxy from, in the format https://example.com, or route requests for a host to it as HOST=URL, or for a path prefix as /PREFIX=URL; may be repeated")
+	fs.StringVar(&c.UpstreamCA, "upstream-ca", "", "Verify HTTPS upstreams with the CA certificates in `FILE`, in PEM format, instead of the system ones")
+	fs.StringVar(&c.UpstreamClientCert, "upstream-client-cert", "", "Present the certificate chain in `FILE`, in PEM format, to HTTPS upstreams; requires --upstream-client-key")
+	fs.StringVar(&c.UpstreamClientKey, "upstream-client-key", "", "Set the private key `FILE` for --upstream-client-cert, in PEM format")
+	fs.BoolVar(&c.UpstreamInsecureSkipVerify, "upstream-insecure-skip-verify", false, "Accept any certificate from HTTPS upstreams, e.g. self-signed ones in a lab; insecure")
+	fs.Var(&c.PathRewrites, "upstream-path-rewrite", "Rewrite request paths sent upstream matching a regular expression, as `PATTERN=>REPLACEMENT` (e.g. '^/v1/(.*)$=>/api/$1'); may be repeated, applied in order")
+	fs.StringVar(&c.CacheBackend, "cache-backend", "fs", "Store the cache in the local filesystem (`fs`), in Redis (redis) or in an S3 compatible bucket (s3)")
+	fs.StringVar(&c.CacheDir, "cache-dir", "cache", "Set the `DIRECTORY` where the cache will be saved")
+	fs.StringVar(&c.RedisURL, "redis-url", "redis://localhost:6379/0", "Connect to the Redis server at `URL`, as redis://[:password@]host:port[/db], with --cache-backend=redis")
+	fs.Var(&c.RedisMaxObject, "redis-max-object", "Only store entries up to `SIZE` in Redis")
+	fs.StringVar(&c.S3URL, "s3-url", "", "Store objects under `URL`, as https://endpoint/bucket[/prefix], with --cache-backend=s3")
+	fs.StringVar(&c.S3Region, "s3-region", "us-east-1", "Sign S3 requests for the `REGION` of the bucket")
+	fs.StringVar(&c.S3AccessKey, "s3-access-key", "", "Set the S3 access key `ID` (default $AWS_ACCESS_KEY_ID)")
+	fs.StringVar(&c.S3SecretKey, "s3-secret-key", "", "Set the S3 secret access `KEY` (default $AWS_SECRET_ACCESS_KEY)")
+	fs.StringVar(&c.CacheKeyHash, "cache-key-hash", "sha256", "Set the `ALGORITHM` used to derive cache keys from URIs: base64, sha256 or blake2b")
+	fs.Func("cache-headers", "Store and replay the response headers in the comma-separated `LIST` with cached entries (default "+defaultCacheHeaders+")", c.setCacheHeaders)
+	fs.StringVar(&c.TenantHeader, "tenant-header", "", "Group cache entries in one directory per value of the request header `NAME`, e.g. X-Tenant")
+	fs.IntVar(&c.MaxCacheKeyLength, "max-cache-key-length", 247, "Hash cache keys longer than `N` bytes with sha256; the default fits the usual 255 bytes file name limit")
+	fs.IntVar(&c.MaxConcurrentWrites, "max-concurrent-writes", 0, "Limit cache writes in progress to `N`, serving other responses uncached (0 means no limit)")
+	fs.Var(&c.MaxCacheSize, "max-cache-size", "Evict the least recently used entries once the cache is over `SIZE`, e.g. 500MB (0 means no limit)")
+	fs.DurationVar(&c.MaxCacheAge, "max-cache-age", 0, "Evict entries not read nor written for `DURATION`, e.g. 168h, along with expired ones, from a background sweep (0 disables)")
+	fs.Var(&c.MemCacheSize, "mem-cache-size", "Keep up to `SIZE` of small, fresh entries in memory, e.g. 64MiB (0 disables)")
+	fs.Var(&c.MemCacheSize, "memory-cache-size", "Alias for --mem-cache-size")
+	fs.Var(&c.MemCacheMaxObject, "mem-cache-max-object", "Only keep entries up to `SIZE` in memory")
+	fs.Var(&c.MinFreeDisk, "min-free-disk", "Stop caching new entries while the cache volume has less than `SIZE` free, e.g. 2GiB (0 disables)")
+	fs.BoolVar(&c.CaseInsensitivePaths, "case-insensitive-paths", false, "Lowercase the request path when computing cache keys, for case-insensitive upstreams")
+	fs.BoolVar(&c.NormalizePath, "normalize-path", false, "Collapse duplicate slashes and resolve dot segments in the path when computing cache keys")
+	fs.BoolVar(&c.SortQuery, "sort-query", false, "Sort query parameters by name when computing cache keys")
+	fs.Var(&c.IgnoreQueryParams, "ignore-query-param", "Leave the query parameter `NAME` out of cache keys, or all those starting with NAME if it ends with *, as in utm_*; may be repeated")
+	fs.Var(&c.IgnoreQueryPaths, "ignore-query", "Leave the whole query string out of cache keys for paths matching `PATTERN`, as in --cache-include; may be repeated")
+	fs.Func("cache-key-headers", "Cache each combination of values of the request headers in the comma-separated `LIST` on its own", c.setKeyHeaders)
+	fs.BoolVar(&c.EnableAccelRedirect, "enable-accel-redirect", false, "Serve the path in upstream X-Accel-Redirect headers instead of the original response")
+	fs.DurationVar(&c.MinUpstreamLatency, "min-upstream-latency", 0, "Only cache responses that took upstream at least `DURATION` to produce (0 caches all)")
+	fs.StringVar(&c.CacheIneligibleAction, "cache-ineligible-action", "pass", "Either `pass` responses that cannot be cached through, or reject them with --cache-ineligible-status (reject)")
+	fs.IntVar(&c.CacheIneligibleStatus, "cache-ineligible-status", http.StatusBadGateway, "Set the `STATUS` code returned for rejected non-cacheable responses")
+	fs.BoolVar(&c.Compress, "compress", false, "Store responses of --compress-types gzipped, serving them as they are to clients accepting gzip")
+	fs.StringVar(&c.CompressTypes, "compress-types", defaultCompressTypes, "Set the comma-separated `LIST` of media types to compress, as type/subtype, type/* or *+suffix")
+	fs.BoolVar(&c.DisableUpstreamCompression, "disable-upstream-compression-on-cache", false, "Always request identity-encoded bodies from upstream, so cached blobs are never compressed")
+	fs.BoolVar(&c.AllowTTLParam, "allow-ttl-param", false, "Allow clients to set the cache TTL of an entry, in seconds, with the query parameter set by --ttl-param")
+	fs.StringVar(&c.TTLParam, "ttl-param", "__ttl", "Set the query parameter `NAME` used to read per-request cache TTLs")
+	fs.DurationVar(&c.MinTTL, "min-ttl", 0, "Set the minimum `DURATION` a cache entry is kept (0 means no lower bound)")
+	fs.DurationVar(&c.MaxTTL, "max-ttl", 0, "Set the maximum `DURATION` a cache entry is kept (0 means no upper bound)")
+	fs.BoolVar(&c.HeuristicExpirationWarning, "heuristic-expiration-warning", false, "Add a Warning: 113 header to cached responses served past the freshness lifetime set by upstream, because of --min-ttl")
+	fs.StringVar(&c.AdminAddr, "admin-addr", "", "Serve the admin endpoints (/healthz, /readyz, /stats, /metrics) at `ADDRESS`; disabled if empty")
+	fs.StringVar(&c.ResponseSizeBuckets, "response-size-buckets", "", "Set the upper bounds of the response size histogram buckets, as comma-separated `BYTES` (default 1KiB to 64MiB, in powers of 4)")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", "", "Also serve /metrics alone at `ADDRESS`, e.g. for scrapers that cannot reach the admin listener; disabled if empty")
+	fs.StringVar(&c.MetricsAuthToken, "metrics-auth-token", "", "Require this bearer `TOKEN` on admin endpoints, except /healthz and /readyz")
+	fs.StringVar(&c.MetricsAuthBasic, "metrics-auth-basic", "", "Require these basic auth `USER:PASSWORD` credentials on admin endpoints, except /healthz and /readyz")
+	fs.Var(&c.AuthBasic, "auth-basic", "Require clients to authenticate with the basic auth `USER:PASSWORD` credentials, or others allowed; may be repeated")
+	fs.StringVar(&c.AuthHtpasswd, "auth-htpasswd", "", "Require clients to authenticate with the basic auth credentials of the htpasswd `FILE`, hashed with bcrypt or SHA-1, or others allowed")
+	fs.Var(&c.AuthBearerTokens, "auth-bearer-token", "Require clients to authenticate with the bearer `TOKEN`, or others allowed; may be repeated")
+	fs.StringVar(&c.Balance, "balance", "round-robin", "Balance requests among the backends of an upstream, set by repeating --upstream, with `POLICY`: round-robin or least-conn")
+	fs.DurationVar(&c.UpstreamFailTimeout, "upstream-fail-timeout", 10*time.Second, "Stop sending requests to a backend for `DURATION` after it fails to respond")
+	fs.IntVar(&c.UpstreamRetries, "upstream-retries", 0, "Retry idempotent requests up to `N` times when the upstream fails to respond, or returns 502, 503 or 504")
+	fs.DurationVar(&c.UpstreamRetryBackoff, "upstream-retry-backoff", 100*time.Millisecond, "Wait `DURATION` before the first --upstream-retries attempt, doubling it before each next one")
+	fs.IntVar(&c.CircuitBreakerFailures, "circuit-breaker-failures", 0, "Stop sending requests to an upstream for --circuit-breaker-cooldown after `N` consecutive failures, replying with 503 to misses (0 disables)")
+	fs.DurationVar(&c.CircuitBreakerCooldown, "circuit-breaker-cooldown", 30*time.Second, "Wait `DURATION` before probing an upstream again once its circuit breaker opens")
+	fs.DurationVar(&c.UpstreamHealthInterval, "upstream-health-interval", 0, "Probe the upstream health every `DURATION` in the background, failing fast while it is unhealthy (0 disables)")
+	fs.Float64Var(&c.UnhealthyErrorRate, "unhealthy-error-rate", 0, "Report not ready in /readyz while the fraction of failed upstream requests within --error-rate-window is above `RATE`, e.g. 0.5 (0 disables)")
+	fs.DurationVar(&c.ErrorRateWindow, "error-rate-window", time.Minute, "Compute the upstream error rate over the last `DURATION`")
+	fs.Var(&c.NegativePaths, "cache-negative-path", "Cache error responses, like 404, for paths matching `PATTERN:TTL` (e.g. /lookup/*:60s); may be repeated")
+	fs.Func("cache-statuses", "Cache responses with the status codes in the comma-separated `LIST`, such as 200,301,404; codes other than 200 are kept for --negative-ttl (default 200)", c.setCacheStatuses)
+	fs.DurationVar(&c.NegativeTTL, "negative-ttl", time.Minute, "Keep responses cached with --cache-statuses, other than 200, for `DURATION`")
+	fs.Var(&c.JSONSchemas, "validate-json-schema", "Only cache JSON responses for paths matching `PATTERN=FILE` if they are valid per the JSON schema in FILE (e.g. /api/*=user.schema.json); may be repeated")
+	fs.BoolVar(&c.AllowMethodOverride, "allow-method-override", false, "Honor the X-HTTP-Method-Override header of POST requests")
+	fs.StringVar(&c.ClientCacheControl, "client-cache-control", "", "Send this Cache-Control `VALUE` to clients, overriding upstream, and always provide an ETag for cached content")
+	fs.BoolVar(&c.ForwardClientCert, "forward-client-cert", false, "Forward the client TLS certificate subject and fingerprint upstream in the X-Forwarded-Client-Cert header")
+	fs.Var(&c.CookieDomainRules, "rewrite-set-cookie-domain", "Rewrite the Domain of upstream cookies, as `FROM=TO` (e.g. upstream.com=proxy.com); may be repeated")
+	fs.Var(&c.CookiePathRules, "rewrite-set-cookie-path", "Rewrite the Path prefix of upstream cookies, as `FROM=TO`; may be repeated")
+	fs.BoolVar(&c.StripCookieSecure, "strip-set-cookie-secure", false, "Remove the Secure attribute of upstream cookies, for development over plain HTTP")
+	fs.BoolVar(&c.RewriteBodies, "rewrite-body", false, "Replace absolute upstream URLs in response bodies of --rewrite-body-types with paths relative to the proxy, and move upstream cookies to the proxy domain")
+	fs.StringVar(&c.RewriteBodyOrigin, "rewrite-body-origin", "", "Replace absolute upstream URLs with URLs on `ORIGIN`, as in https://proxy.example.com, instead of relative paths, with --rewrite-body")
+	fs.StringVar(&c.RewriteBodyTypes, "rewrite-body-types", defaultRewriteBodyTypes, "Set the comma-separated `LIST` of media types rewritten by --rewrite-body, as in --compress-types")
+	fs.Var(&c.RequestHeaderRules, "request-header", "Change a header of requests sent upstream with `RULE`: NAME: VALUE sets it, +NAME: VALUE adds a value, -NAME removes it and ~NAME: PATTERN=>REPLACEMENT rewrites it; values may use $scheme, $host and $client_ip; may be repeated")
+	fs.Var(&c.ResponseHeaderRules, "response-header", "Change a header of responses sent to clients, cached or not, with `RULE`, as in --request-header; may be repeated")
+	fs.DurationVar(&c.FlushInterval, "flush-interval", 0, "Flush streamed responses to the client every `DURATION`; negative flushes after each write")
+	fs.StringVar(&c.RangeMissStrategy, "range-miss-strategy", "pass", "On Range request misses, either `pass` the range upstream without caching the partial response, or fetch and cache the full object first (full)")
+	fs.BoolVar(&c.ServeStaleOnError, "serve-stale-on-error", false, "Keep expired entries, serving them when upstream fails or returns a 5xx status")
+	fs.BoolVar(&c.HonorClientNoCache, "honor-client-no-cache", false, "Revalidate cached entries upstream before serving them to clients sending Cache-Control: no-cache or Pragma: no-cache")
+	fs.StringVar(&c.RefreshHeader, "refresh-header", "X-Proxy-Refresh", "Set the request header `NAME` carrying --refresh-token")
+	fs.StringVar(&c.RefreshToken, "refresh-token", "", "Fetch again and replace the cached entry for requests sending `TOKEN` in the --refresh-header")
+	fs.DurationVar(&c.StaleGrace, "stale-grace", 0, "Keep serving expired entries for `DURATION` while they are refreshed in the background")
+	fs.StringVar(&c.ProbeUpstreamOnStart, "probe-upstream-on-start", "", "Probe the upstream at startup, and either `warn` or be fatal if it is unreachable; disabled if empty")
+	fs.BoolVar(&c.PrefetchLinks, "prefetch-links", false, "Prefetch same-origin resources preloaded by cached pages, through Link headers or <link rel=preload> tags")
+	fs.IntVar(&c.PrefetchConcurrency, "prefetch-concurrency", 4, "Prefetch up to `N` links at the same time")
+	fs.IntVar(&c.WarmConcurrency, "warm-concurrency", 4, "Warm the cache fetching up to `N` URIs at the same time, with the warm command or /admin/warm")
+	fs.IntVar(&c.MaxConnsPerIP, "max-conns-per-ip", 0, "Allow at most `N` simultaneous connections from each client IP address, rejecting others with 429 (0 means no limit)")
+	fs.Func("rate-limit", "Allow each client IP address `RATE` requests on average, as in 100r/s or 600r/m, rejecting others with 429 (0 means no limit)", c.setRateLimit)
+	fs.IntVar(&c.RateBurst, "rate-burst", 0, "Allow bursts of up to `N` requests over --rate-limit (default the requests allowed per second)")
+	fs.Var(&c.TrustedProxies, "trusted-proxy", "Trust the X-Forwarded-For header sent by the `ADDRESS`, an IP address or CIDR range, to find client IP addresses; may be repeated")
+	fs.Var(&c.TrustedProxies, "trusted-proxies", "Trust the X-Forwarded-For header sent by the IP addresses or CIDR ranges in the comma-separated `LIST`, as --trusted-proxy")
+	fs.BoolVar(&c.ProxyProtocol, "proxy-protocol", false, "Read the client address from a PROXY protocol v1 or v2 header on each TCP connection, sent by the --trusted-proxy addresses if set")
+	fs.DurationVar(&c.DialTimeout, "dial-timeout", 120*time.Second, "Give up connecting to the upstream after `DURATION`")
+	fs.DurationVar(&c.IdleConnTimeout, "idle-conn-timeout", 120*time.Second, "Close idle upstream connections after `DURATION` (0 keeps them open)")
+	fs.IntVar(&c.MaxIdleConns, "max-idle-conns", 100, "Keep at most `N` idle upstream connections open (0 means no limit)")
+	fs.DurationVar(&c.ResponseHeaderTimeout, "response-header-timeout", 0, "Give up waiting for the upstream response headers after `DURATION` (0 waits forever)")
+	fs.DurationVar(&c.UpstreamTimeout, "upstream-timeout", 0, "Give up on upstream requests not done after `DURATION`, including reading their body, e.g. 5m (0 means no limit)")
+	fs.Var(&c.MaxResponseSize, "max-response-size", "Refuse upstream responses larger than `SIZE` with 502, cutting those of unknown length once over it (0 means no limit)")
+	fs.DurationVar(&c.ClientReadHeaderTimeout, "client-read-header-timeout", 10*time.Second, "Close client connections not sending their request headers within `DURATION` (0 means no limit)")
+	fs.DurationVar(&c.ClientReadTimeout, "client-read-timeout", 0, "Close client connections not sending their whole request within `DURATION` (0 means no limit)")
+	fs.DurationVar(&c.ClientWriteTimeout, "client-write-timeout", 0, "Close client connections not reading their whole response within `DURATION`; it also ends longer downloads and event streams, but not CONNECT tunnels (0 means no limit)")
+	fs.DurationVar(&c.ClientIdleTimeout, "client-idle-timeout", 120*time.Second, "Close idle keep-alive client connections after `DURATION` (0 means no limit)")
+	fs.Var(&c.CacheInclude, "cache-include", "Only cache requests for paths matching `PATTERN`, a glob such as /static/* or a regular expression prefixed by ~; may be repeated")
+	fs.Var(&c.CacheExclude, "cache-exclude", "Never cache requests for paths matching `PATTERN`, even if included, as in --cache-include; may be repeated")
+	fs.Var(&c.CacheContentTypes, "cache-content-type", "Only cache responses whose media type matches `PATTERN`, such as image/* or application/json; may be repeated")
+	fs.Var(&c.CacheExcludeContentTypes, "cache-exclude-content-type", "Never cache responses whose media type matches `PATTERN`, even if included, as in --cache-content-type; may be repeated")
+	fs.Var(&c.MaxCacheObjectSize, "max-cache-object-size", "Never cache responses larger than `SIZE`, e.g. 100MB, serving them uncached (0 means no limit)")
+	fs.Var(&c.PinPaths, "pin-path", "Never evict the cache entry for `URI`, e.g. /css/site.css; may be repeated")
+	fs.BoolVar(&c.Offline, "offline", false, "Serve only from cache, never contacting the upstream; misses return 504")
+	fs.StringVar(&c.EventWebhook, "event-webhook", "", "POST cache store, hit and eviction events as JSON to `URL`")
+	fs.IntVar(&c.EventQueueSize, "event-queue-size", 1000, "Buffer up to `N` webhook events, dropping new ones when full")
+	fs.StringVar(&c.OTelEndpoint, "otel-endpoint", "", "Export OpenTelemetry traces to the OTLP/HTTP collector at `URL`, e.g. http://localhost:4318")
+	fs.StringVar(&c.OTelServiceName, "otel-service-name", "simpleproxy", "Report traces as the service `NAME`")
+}
+
+// DefaultConfig returns the settings at the defaults of their flags.
+func DefaultConfig() *Config {
+	c := new(Config)
+	c.RegisterFlags(flag.NewFlagSet("simpleproxy", flag.ContinueOnError))
+	return c
+}
+
+// Run serves clients with a Proxy set by cfg, as parsed from the flags of
+// RegisterFlags by the simpleproxy command, returning once it is shut
+// down. Invalid settings and listen errors exit the process.
+func Run(cfg *Config) {
+	conf = cfg
+	if conf.ConfigFile != "" {
+		if _, worker := os.LookupEnv(listenFdsEnv); !worker {
+			supervise(conf.ConfigFile)
+			return
+		}
+		if err := loadConfig(conf.ConfigFile); err != nil {
+			log.Fatalf("Invalid --config: %v", err)
+		}
+	}
+	if err := inheritListeners(); err != nil {
+		log.Fatal(err)
+	}
+
+	var err error
+	if (conf.TLSCert == "") != (conf.TLSKey == "") {
+		log.Fatalf("Both --tls-cert and --tls-key must be set to serve HTTPS")
+	}
+	if conf.TLSCert != "" && conf.ACMEDomains != "" {
+		log.Fatalf("--acme-domains cannot be used with --tls-cert")
+	}
+	https := conf.TLSCert != "" || conf.ACMEDomains != ""
+	if len(conf.Listen) == 0 {
+		conf.Listen = listenList{":8080"}
+		if https {
+			conf.Listen = listenList{":443"}
+		}
+	}
+	if conf.ACMEDomains != "" && conf.HTTPRedirect == "" {
+		// Also answers HTTP-01 challenges
+		conf.HTTPRedirect = ":80"
+	}
+	if conf.HTTPRedirect != "" {
+		if !https {
+			log.Fatalf("--http-redirect requires --tls-cert or --acme-domains")
+		}
+		if conf.HTTPRedirect, err = normalizeListenAddr(conf.HTTPRedirect); err != nil {
+			log.Fatalf("Invalid --http-redirect address: %v", err)
+		}
+	}
+	var (
+		tlsConfig *tls.Config
+		acme      *autocert.Manager
+	)
+	switch {
+	case conf.TLSCert != "":
+		cert, err := tls.LoadX509KeyPair(conf.TLSCert, conf.TLSKey)
+		if err != nil {
+			log.Fatalf("Invalid TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	case conf.ACMEDomains != "":
+		acme = acmeManager()
+		tlsConfig = acmeTLSConfig(acme)
+	}
+	if conf.HTTP3 && tlsConfig == nil {
+		log.Fatalf("--http3 requires --tls-cert or --acme-domains")
+	}
+	if tlsConfig != nil {
+		protos := []string{"http/1.1"}
+		if conf.HTTP2 {
+			protos = []string{"h2", "http/1.1"}
+		}
+		tlsConfig.NextProtos = append(protos, tlsConfig.NextProtos...)
+		if conf.ForwardClientCert {
+			// Ask for client certificates, without verifying them
+			tlsConfig.ClientAuth = tls.RequestClientCert
+		}
+	}
+
+	p, err := New(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var handler http.Handler = p
+
+	if conf.AdminAddr != "" {
+		l, err := listen(conf.AdminAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go func() {
+			log.Fatal(http.Serve(l, newAdminMux()))
+		}()
+	}
+	if conf.MetricsAddr != "" {
+		l, err := listen(conf.MetricsAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", requireAuth(metricsHandler))
+		go func() {
+			log.Fatal(http.Serve(l, mux))
+		}()
+	}
+
+	// Startup tasks are done
+	atomic.StoreInt32(&ready, 1)
+	if conf.MaxConnsPerIP > 0 {
+		conns = newConnLimiter(conf.MaxConnsPerIP)
+		conns.tls = tlsConfig != nil
+	}
+	var listeners []net.Listener
+	for _, addr := range conf.Listen {
+		l, err := listen(addr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if conf.ProxyProtocol && l.Addr().Network() == "tcp" {
+			l = acceptProxyProtocol(l)
+		}
+		// Unix sockets have no client address to limit
+		if conns != nil && l.Addr().Network() == "tcp" {
+			l = conns.Wrap(l)
+		}
+		listeners = append(listeners, l)
+	}
+	srv := &http.Server{
+		Handler:   handler,
+		TLSConfig: tlsConfig,
+	}
+	setServerTimeouts(srv)
+	if !conf.HTTP2 {
+		// A non-nil map keeps net/http from configuring HTTP/2
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	var h3srv *http3.Server
+	if conf.HTTP3 {
+		h3srv = listenHTTP3(listeners, handler, tlsConfig)
+		srv.Handler = advertiseHTTP3(handler)
+	}
+	var redirectSrv *http.Server
+	if conf.HTTPRedirect != "" {
+		l, err := listen(conf.HTTPRedirect)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var redirect http.Handler = httpsRedirect{port: httpsPort(conf.Listen)}
+		if acme != nil {
+			redirect = acme.HTTPHandler(redirect)
+		}
+		redirectSrv = &http.Server{Handler: redirect}
+		setServerTimeouts(redirectSrv)
+		go func() {
+			log.Printf("Redirecting HTTP to HTTPS on %v:%v", l.Addr().Network(), l.Addr())
+			if err := redirectSrv.Serve(l); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	notifyReady()
+	// Drain in-flight requests and cache writes before exiting
+	stopped := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		log.Printf("Received %v, shutting down", <-sig)
+		atomic.StoreInt32(&ready, 0)
+		ctx, cancel := context.WithTimeout(context.Background(), conf.ShutdownTimeout)
+		defer cancel()
+		if redirectSrv != nil {
+			redirectSrv.Close()
+		}
+		if h3srv != nil {
+			go h3srv.Shutdown(ctx)
+		}
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("WARNING: requests still in flight: %v", err)
+		}
+		// Interrupted writes are left in the staging directory, which is
+		// cleaned up on the next start.
+		if err := waitWrites(ctx); err != nil {
+			log.Printf("WARNING: cache writes still in progress: %v", err)
+		}
+		if err := p.Close(); err != nil {
+			log.Printf("WARNING: error closing the cache: %v", err)
+		}
+		close(stopped)
+	}()
+	errs := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			log.Printf("Listening on %v:%v", l.Addr().Network(), l.Addr())
+			if tlsConfig != nil {
+				errs <- srv.ServeTLS(l, "", "")
+			} else {
+				errs <- srv.Serve(l)
+			}
+		}(l)
+	}
+	for range listeners {
+		if err := <-errs; err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	<-stopped
+	log.Printf("Shutdown complete")
+}
+
+// configure validates the settings and initializes the cache, unless set
+// by conf.Cache, and the upstreams, returning the transport to fetch with.
+// Optional components are reset when not set, so it may run again. The
+// background tasks it starts run until ctx is done.
+func configure(ctx context.Context) (*CachedTransport, error) {
+	// Detect upstream server to serve from
+	switch {
+	case conf.Mode != "reverse" && conf.Mode != "forward":
+		return nil, fmt.Errorf("invalid --mode %q: use reverse or forward", conf.Mode)
+	case forwardMode() && (conf.Upstream != "" || len(conf.UpstreamRoutes) > 0):
+		return nil, errors.New("--upstream cannot be used with --mode=forward, where clients choose the upstream")
+	case !forwardMode() && conf.Upstream == "" && len(conf.UpstreamRoutes) == 0:
+		return nil, errors.New("empty upstream URL: use --upstream to set")
+	}
+	var err error
+	upstreamUrl = nil
+	if conf.Upstream != "" {
+		upstreamUrl, err = url.Parse(conf.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream URL: %v", err)
+		}
+		if upstreamUrl.Scheme == "" || upstreamUrl.Host == "" {
+			return nil, fmt.Errorf("invalid upstream URL %q: use an absolute URL, as in https://example.com", conf.Upstream)
+		}
+	}
+
+	if upstreamTLS, err = upstreamTLSConfig(); err != nil {
+		return nil, err
+	}
+
+	if conf.Balance != "round-robin" && conf.Balance != "least-conn" {
+		return nil, fmt.Errorf("invalid --balance %q: use round-robin or least-conn", conf.Balance)
+	}
+
+	accessLog, events, tracer, clientAuth = nil, nil, nil, nil
+	if conf.AccessLog != "" {
+		if accessLog, err = newAccessLogger(conf.AccessLog, conf.LogFormat); err != nil {
+			return nil, err
+		}
+	}
+	if conf.EventWebhook != "" {
+		events = newEventSink(ctx, conf.EventWebhook, conf.EventQueueSize)
+	}
+	if conf.OTelEndpoint != "" {
+		tracer = newTraceExporter(ctx, conf.OTelEndpoint, conf.OTelServiceName)
+	}
+	if len(conf.AuthBasic) > 0 || conf.AuthHtpasswd != "" || len(conf.AuthBearerTokens) > 0 {
+		if clientAuth, err = newAuthenticator(conf.AuthBasic, conf.AuthHtpasswd, conf.AuthBearerTokens); err != nil {
+			return nil, err
+		}
+	}
+
+	switch conf.ProbeUpstreamOnStart {
+	case "", "warn", "fatal":
+	default:
+		return nil, fmt.Errorf("invalid --probe-upstream-on-start %q: use warn or fatal", conf.ProbeUpstreamOnStart)
+	}
+	switch conf.RangeMissStrategy {
+	case "pass", "full":
+	default:
+		return nil, fmt.Errorf("invalid --range-miss-strategy %q: use pass or full", conf.RangeMissStrategy)
+	}
+	switch conf.CacheIneligibleAction {
+	case "pass", "reject":
+	default:
+		return nil, fmt.Errorf("invalid --cache-ineligible-action %q: use pass or reject", conf.CacheIneligibleAction)
+	}
+	switch conf.CacheKeyHash {
+	case "base64", "sha256", "blake2b":
+	default:
+		return nil, fmt.Errorf("invalid --cache-key-hash %q: use base64, sha256 or blake2b", conf.CacheKeyHash)
+	}
+	if conf.ResponseSizeBuckets != "" {
+		buckets, err := parseBuckets(conf.ResponseSizeBuckets)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --response-size-buckets %q: %v", conf.ResponseSizeBuckets, err)
+		}
+		responseSizes.SetBuckets(buckets)
+	}
+
+	upstreamErrors = newErrorRate(conf.ErrorRateWindow)
+	breaker = nil
+	if conf.CircuitBreakerFailures > 0 {
+		breaker = newCircuitBreaker(conf.CircuitBreakerFailures, conf.CircuitBreakerCooldown)
+	}
+	pins = &pinSet{keys: make(map[string]string)}
+	for _, uri := range conf.PinPaths {
+		if err := pins.Pin(uri); err != nil {
+			return nil, fmt.Errorf("invalid --pin-path %q: %v", uri, err)
+		}
+	}
+
+	// Initializes the CacheManager, unless given one
+	cache = conf.Cache
+	if cache == nil {
+		if cache, err = newCache(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.MemCacheSize > 0 {
+		cache = newMemCache(cache, int64(conf.MemCacheSize), int64(conf.MemCacheMaxObject))
+	}
+	writeSlots = newWriteLimiter(conf.MaxConcurrentWrites)
+	setOffline(conf.Offline)
+	disk = nil
+	if conf.MinFreeDisk > 0 {
+		disk = &diskSpace{dir: conf.CacheDir, min: int64(conf.MinFreeDisk)}
+	}
+
+	// Intialize roundtripper with caching capabilities, using the CacheManager
+	roundTripper := NewCachedTransport(cache)
+
+	// Keep track of the health of each upstream, actively if requested
+	initHealth(&roundTripper.t)
+	if conf.ProbeUpstreamOnStart != "" && !conf.Offline {
+		for _, h := range healthCheckers() {
+			probe, cancel := context.WithTimeout(ctx, 10*time.Second)
+			err := h.Check(probe)
+			cancel()
+			switch {
+			case err == nil:
+				log.Printf("Upstream %v is reachable", h.target)
+			case conf.ProbeUpstreamOnStart == "fatal":
+				return nil, fmt.Errorf("upstream %v is unreachable: %v", h.target, err)
+			default:
+				log.Printf("WARNING: upstream %v is unreachable: %v", h.target, err)
+			}
+		}
+	}
+	// Started even --offline, which may be switched off at runtime
+	if conf.UpstreamHealthInterval > 0 {
+		for _, h := range healthCheckers() {
+			go h.Run(ctx, conf.UpstreamHealthInterval)
+		}
+	}
+	initPools(ctx, &roundTripper.t, conf.UpstreamHealthInterval)
+	return roundTripper, nil
+}
+
+// newCache returns the CacheManager set by --cache-backend.
+func newCache() (CacheManager, error) {
+	if conf.CacheBackend != "fs" && (conf.MaxCacheSize > 0 || conf.MaxCacheAge > 0 || conf.MinFreeDisk > 0) {
+		return nil, errors.New("--max-cache-size, --max-cache-age and --min-free-disk require --cache-backend=fs")
+	}
+	switch conf.CacheBackend {
+	case "fs":
+		fs := NewFsCache(conf.CacheDir)
+		if err := fs.Check(); err != nil {
+			return nil, fmt.Errorf("cache directory is not writable: %v", err)
+		}
+		if conf.MaxCacheSize > 0 {
+			if err := fs.SetMaxSize(int64(conf.MaxCacheSize)); err != nil {
+				return nil, fmt.Errorf("error scanning the cache directory: %v", err)
+			}
+		}
+		if conf.MaxCacheAge > 0 {
+			// Sweep often enough for the age to be accurate, but
+			// not so often that scanning the cache is a burden.
+			interval := conf.MaxCacheAge / 10
+			if interval < time.Minute {
+				interval = time.Minute
+			} else if interval > time.Hour {
+				interval = time.Hour
+			}
+			fs.SetMaxAge(conf.MaxCacheAge, interval)
+		}
+		return fs, nil
+	case "redis":
+		rc, err := newRedisCache(conf.RedisURL, int64(conf.RedisMaxObject))
+		if err != nil {
+			return nil, err
+		}
+		if err := rc.Check(); err != nil {
+			return nil, fmt.Errorf("redis server is not reachable: %v", err)
+		}
+		return rc, nil
+	case "s3":
+		sc, err := newS3Cache(conf.S3URL, conf.S3Region, conf.S3AccessKey, conf.S3SecretKey)
+		if err != nil {
+			return nil, err
+		}
+		if err := sc.Check(); err != nil {
+			return nil, fmt.Errorf("S3 bucket is not reachable: %v", err)
+		}
+		return sc, nil
+	}
+	return nil, fmt.Errorf("invalid --cache-backend %q: use fs, redis or s3", conf.CacheBackend)
+}
+
+// debugf logs only when --debug is set.
+func debugf(format string, args ...interface{}) {
+	if conf.Debug {
+		log.Printf(format, args...)
+	}
+}
+
+func prepareRequest(r *http.Request) {
+	// Rules see the request as received from the client
+	conf.RequestHeaderRules.Apply(r.Header, r)
+	u := requestUpstream(r)
+	r.URL.Scheme = u.Scheme
+	r.URL.Host = u.Host
+	r.Host = u.Host
+	routedPath(r, u)
+	if len(conf.PathRewrites) > 0 {
+		rewritePath(r)
+	}
+	if conf.DisableUpstreamCompression {
+		r.Header.Set("Accept-Encoding", "identity")
+	}
+}
@@ -0,0 +1,218 @@
+package proxy
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memCache keeps small, fresh entries of the next cache in memory, sparing
+// the file and header reads of hot objects. Entries are added when read
+// from the next cache, and evicted least recently used first once the
+// total size is over maxSize. Writes always go to the next cache, so
+// evicting an entry demotes it there, until read again.
+//
+// Only fresh entries are served from memory: expired ones are dropped, and
+// left for the next cache to serve stale, revalidate or evict.
+type memCache struct {
+	next      CacheManager
+	maxSize   int64
+	maxObject int64
+
+	mu      sync.Mutex
+	size    int64
+	order   *list.List // of *memEntry, most recently used first
+	entries map[string]*list.Element
+}
+
+type memEntry struct {
+	key     string
+	body    []byte
+	h       http.Header
+	expires time.Time
+}
+
+// Ensures we implement CacheManager interface
+var _ CacheManager = &memCache{}
+
+var errNotSupported = errors.New("not supported by the next cache tier")
+
+// toucher is implemented by caches tracking when entries are read, so
+// entries served from memory are not evicted from them as unused.
+type toucher interface {
+	touch(key string)
+}
+
+func newMemCache(next CacheManager, maxSize, maxObject int64) *memCache {
+	return &memCache{
+		next:      next,
+		maxSize:   maxSize,
+		maxObject: maxObject,
+		order:     list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+// memBlob is a cached body held in memory. It can seek, so it is served
+// like files are.
+type memBlob struct {
+	*bytes.Reader
+}
+
+func (memBlob) Close() error { return nil }
+
+// Put invalidates the entry in memory, storing it in the next cache.
+func (m *memCache) Put(key string, blob io.ReadCloser, h http.Header) error {
+	m.remove(key)
+	return m.next.Put(key, blob, h)
+}
+
+func (m *memCache) Get(key string) (blob io.ReadCloser, h http.Header, err error) {
+	m.mu.Lock()
+	if el, ok := m.entries[key]; ok {
+		e := el.Value.(*memEntry)
+		if e.expires.IsZero() || time.Now().Before(e.expires) {
+			m.order.MoveToFront(el)
+			m.mu.Unlock()
+			if t, ok := m.next.(toucher); ok {
+				t.touch(key)
+			}
+			debugf("[memcache] Cache hit key=%v", key)
+			return memBlob{bytes.NewReader(e.body)}, e.h.Clone(), nil
+		}
+		m.removeElement(el)
+	}
+	m.mu.Unlock()
+
+	blob, h, err = m.next.Get(key)
+	if err != nil {
+		return
+	}
+	size, _ := strconv.ParseInt(h.Get("content-length"), 10, 64)
+	if size > m.maxObject || size > m.maxSize || h.Get(revalidateHeader) != "" {
+		return
+	}
+	var expires time.Time
+	if e := h.Get(expiresHeader); e != "" {
+		if expires, err = http.ParseTime(e); err != nil || !time.Now().Before(expires) {
+			// Stale entries stay on disk
+			return blob, h, nil
+		}
+	}
+	defer blob.Close()
+	body, err := io.ReadAll(io.LimitReader(blob, m.maxObject+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	m.add(&memEntry{key: key, body: body, h: h.Clone(), expires: expires})
+	return memBlob{bytes.NewReader(body)}, h, nil
+}
+
+// Flush removes key from memory and from the next cache.
+func (m *memCache) Flush(key string) error {
+	m.remove(key)
+	return m.next.Flush(key)
+}
+
+// FlushTenant removes all entries of tenant from memory and from the next
+// cache.
+func (m *memCache) FlushTenant(tenant string) error {
+	f, ok := m.next.(tenantFlusher)
+	if !ok {
+		return errNoTenants
+	}
+	prefix := tenantDir(tenant) + "/"
+	m.mu.Lock()
+	for key, el := range m.entries {
+		if strings.HasPrefix(key, prefix) {
+			m.removeElement(el)
+		}
+	}
+	m.mu.Unlock()
+	return f.FlushTenant(tenant)
+}
+
+// UpdateHeaders drops key from memory, updating it in the next cache.
+func (m *memCache) UpdateHeaders(key string, update func(h http.Header)) error {
+	u, ok := m.next.(headerUpdater)
+	if !ok {
+		return errNotSupported
+	}
+	m.remove(key)
+	return u.UpdateHeaders(key, update)
+}
+
+// URI returns the URI of the entry at key, from the next cache.
+func (m *memCache) URI(key string) (string, error) {
+	r, ok := m.next.(uriResolver)
+	if !ok {
+		return "", errNotSupported
+	}
+	return r.URI(key)
+}
+
+// Check verifies the next cache, if it can.
+func (m *memCache) Check() error {
+	if c, ok := m.next.(cacheChecker); ok {
+		return c.Check()
+	}
+	return nil
+}
+
+// Close closes the next cache, if it needs to.
+func (m *memCache) Close() error {
+	if c, ok := m.next.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// add stores e as the most recently used entry, evicting the least
+// recently used ones if needed.
+func (m *memCache) add(e *memEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[e.key]; ok {
+		m.removeElement(el)
+	}
+	m.entries[e.key] = m.order.PushFront(e)
+	m.size += int64(len(e.body))
+	for m.size > m.maxSize {
+		el := m.order.Back()
+		debugf("[memcache] Evicting key=%v", el.Value.(*memEntry).key)
+		m.removeElement(el)
+	}
+}
+
+func (m *memCache) remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if el, ok := m.entries[key]; ok {
+		m.removeElement(el)
+	}
+}
+
+// removeElement must be called with m.mu held.
+func (m *memCache) removeElement(el *list.Element) {
+	e := m.order.Remove(el).(*memEntry)
+	delete(m.entries, e.key)
+	m.size -= int64(len(e.body))
+}
+
+// Stats returns the memory usage.
+func (m *memCache) Stats() map[string]int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return map[string]int64{
+		"size":       m.size,
+		"max_size":   m.maxSize,
+		"max_object": m.maxObject,
+		"entries":    int64(len(m.entries)),
+	}
+}
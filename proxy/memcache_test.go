@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemCacheTiers(t *testing.T) {
+	parseTestFlags(t)
+	m := newMemCache(NewFsCache(t.TempDir()), 10, 10)
+	for _, key := range []string{"a", "b"} {
+		if err := m.Put(key, io.NopCloser(strings.NewReader(key+" body")), make(http.Header)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(key string) {
+		t.Helper()
+		blob, _, err := m.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%v): %v", key, err)
+		}
+		defer blob.Close()
+		if body, _ := io.ReadAll(blob); string(body) != key+" body" {
+			t.Errorf("Get(%v) = %q", key, body)
+		}
+	}
+	inMemory := func(key string) bool {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		_, ok := m.entries[key]
+		return ok
+	}
+
+	if inMemory("a") || inMemory("b") {
+		t.Fatal("entries kept in memory when written, want them promoted when read")
+	}
+	read("a")
+	if !inMemory("a") {
+		t.Error("a not promoted to memory when read")
+	}
+	read("b")
+	if inMemory("a") || !inMemory("b") {
+		t.Errorf("got a in memory %v and b %v, want a demoted for b", inMemory("a"), inMemory("b"))
+	}
+	read("a")
+	if !inMemory("a") {
+		t.Error("a not promoted back to memory when read from disk")
+	}
+}
+
+func TestMemoryCacheSizeAlias(t *testing.T) {
+	parseTestFlags(t, "--memory-cache-size=256MB")
+	if conf.MemCacheSize != 256e6 {
+		t.Errorf("--memory-cache-size=256MB set %d bytes, want %d", conf.MemCacheSize, int64(256e6))
+	}
+}
+
+func TestMemCacheHitsKeepEntriesOnDisk(t *testing.T) {
+	parseTestFlags(t)
+	fs := NewFsCache(t.TempDir())
+	m := newMemCache(fs, 1<<20, 1<<20)
+	put := func(key string) {
+		t.Helper()
+		if err := m.Put(key, io.NopCloser(strings.NewReader(key+" body")), make(http.Header)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	read := func(key string) {
+		t.Helper()
+		blob, _, err := m.Get(key)
+		if err != nil {
+			t.Fatalf("Get(%v): %v", key, err)
+		}
+		blob.Close()
+	}
+	onDisk := func(key string) bool {
+		_, err := os.Stat(fs.path(key))
+		return err == nil
+	}
+
+	// hot is read from memory after cold was written, so cold is the least
+	// recently used entry on disk
+	if err := fs.SetMaxSize(1 << 20); err != nil {
+		t.Fatal(err)
+	}
+	put("hot")
+	read("hot")
+	put("cold")
+	read("hot")
+	// Room for two entries only
+	fs.maxSize = fs.Stats()["size"]
+	put("new")
+	if !onDisk("hot") || onDisk("cold") {
+		t.Errorf("got hot on disk %v and cold %v, want cold evicted first", onDisk("hot"), onDisk("cold"))
+	}
+
+	// Unused for the janitor, unless read since
+	fs.maxAge = time.Hour
+	old := time.Now().Add(-2 * time.Hour)
+	if err := os.Chtimes(fs.path("hot")+".headers", old, old); err != nil {
+		t.Fatal(err)
+	}
+	read("hot")
+	fs.sweep()
+	if !onDisk("hot") {
+		t.Error("hot swept as unused while served from memory")
+	}
+}
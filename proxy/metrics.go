@@ -0,0 +1,362 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// metric is a value exported in the Prometheus text format.
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   = make(map[string]metric)
+)
+
+func register(name string, m metric) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	if _, ok := metrics[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+	metrics[name] = m
+}
+
+// counter is a monotonically increasing metric.
+type counter struct {
+	name, help string
+	v          int64
+}
+
+func newCounter(name, help string) *counter {
+	c := &counter{name: name, help: help}
+	register(name, c)
+	return c
+}
+
+func (c *counter) Inc()         { atomic.AddInt64(&c.v, 1) }
+func (c *counter) Add(n int64)  { atomic.AddInt64(&c.v, n) }
+func (c *counter) Value() int64 { return atomic.LoadInt64(&c.v) }
+
+func (c *counter) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.Value())
+}
+
+// gauge is a metric that can go up and down.
+type gauge struct {
+	name, help string
+	v          int64
+}
+
+func newGauge(name, help string) *gauge {
+	g := &gauge{name: name, help: help}
+	register(name, g)
+	return g
+}
+
+func (g *gauge) Inc()         { atomic.AddInt64(&g.v, 1) }
+func (g *gauge) Dec()         { atomic.AddInt64(&g.v, -1) }
+func (g *gauge) Set(n int64)  { atomic.StoreInt64(&g.v, n) }
+func (g *gauge) Value() int64 { return atomic.LoadInt64(&g.v) }
+
+func (g *gauge) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.Value())
+}
+
+// gaugeFunc is a gauge computed when metrics are written, omitted while
+// fn reports it is unknown.
+type gaugeFunc struct {
+	name, help string
+	fn         func() (int64, bool)
+}
+
+func newGaugeFunc(name, help string, fn func() (int64, bool)) *gaugeFunc {
+	g := &gaugeFunc{name: name, help: help, fn: fn}
+	register(name, g)
+	return g
+}
+
+func (g *gaugeFunc) writeTo(w io.Writer) {
+	if v, ok := g.fn(); ok {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, v)
+	}
+}
+
+// counterVec is a counter partitioned by the value of a single label.
+type counterVec struct {
+	name, help, label string
+
+	mu     sync.Mutex
+	series map[string]int64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	c := &counterVec{name: name, help: help, label: label, series: make(map[string]int64)}
+	register(name, c)
+	return c
+}
+
+// Inc increments the series for the label value.
+func (c *counterVec) Inc(value string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.series[value]++
+}
+
+func (c *counterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	values := make([]string, 0, len(c.series))
+	for v := range c.series {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, v, c.series[v])
+	}
+}
+
+// histogram is a metric counting observations in buckets, partitioned by
+// the value of a single label.
+type histogram struct {
+	name, help, label string
+
+	mu      sync.Mutex
+	buckets []float64
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []int64
+	sum    float64
+	count  int64
+}
+
+func newHistogram(name, help, label string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, label: label, buckets: buckets, series: make(map[string]*histogramSeries)}
+	register(name, h)
+	return h
+}
+
+// SetBuckets replaces the bucket upper bounds, which must be sorted. It
+// must be called before any observation.
+func (h *histogram) SetBuckets(buckets []float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buckets = buckets
+}
+
+// Observe records v in the series for the label value.
+func (h *histogram) Observe(value string, v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.series[value]
+	if !ok {
+		s = &histogramSeries{counts: make([]int64, len(h.buckets))}
+		h.series[value] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+		}
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *histogram) writeTo(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	values := make([]string, 0, len(h.series))
+	for v := range h.series {
+		values = append(values, v)
+	}
+	sort.Strings(values)
+	for _, v := range values {
+		s := h.series[v]
+		for i, le := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", h.name, h.label, v, strconv.FormatFloat(le, 'f', -1, 64), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", h.name, h.label, v, s.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", h.name, h.label, v, s.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", h.name, h.label, v, s.count)
+	}
+}
+
+// parseBuckets parses a comma-separated list of increasing bucket upper
+// bounds.
+func parseBuckets(v string) ([]float64, error) {
+	var buckets []float64
+	for _, f := range strings.Split(v, ",") {
+		b, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return nil, err
+		}
+		if len(buckets) > 0 && b <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket %v is not greater than %v", b, buckets[len(buckets)-1])
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// metricsHandler writes all registered metrics in the Prometheus text
+// exposition format.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	metricsMu.Lock()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	metricsMu.Unlock()
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		metricsMu.Lock()
+		m := metrics[name]
+		metricsMu.Unlock()
+		m.writeTo(w)
+	}
+}
+
+var (
+	cacheHits           = newCounter("simpleproxy_cache_hits_total", "Requests served from the cache.")
+	cacheMisses         = newCounter("simpleproxy_cache_misses_total", "Requests not found in the cache.")
+	cacheBypasses       = newCounter("simpleproxy_cache_bypasses_total", "Requests sent upstream without a cache lookup, as their method, path or headers are not cacheable.")
+	cacheHitBytes       = newCounter("simpleproxy_cache_hit_bytes_total", "Body bytes served from the cache.")
+	upstreamBytes       = newCounter("simpleproxy_upstream_bytes_total", "Body bytes fetched from the upstream.")
+	upstreamFailures    = newCounter("simpleproxy_upstream_errors_total", "Upstream requests that failed, or returned a 5xx status.")
+	upstreamFetches     = newCounter("simpleproxy_upstream_fetches_total", "Requests forwarded to the upstream by a leader.")
+	coalescedRequests   = newCounter("simpleproxy_coalesced_requests_total", "Requests that waited for another in-flight upstream fetch instead of sending their own.")
+	upstreamConnsReused = newCounter("simpleproxy_upstream_conns_reused_total", "Upstream requests sent over a reused idle connection.")
+	upstreamConnsNew    = newCounter("simpleproxy_upstream_conns_new_total", "Upstream requests that established a new connection.")
+	cacheWritesInflight = newGauge("simpleproxy_cache_writes_inflight", "Cache writes currently in progress.")
+	cacheWritesSkipped  = newCounter("simpleproxy_cache_writes_skipped_total", "Responses not cached because --max-concurrent-writes was reached.")
+	invalidResponses    = newCounter("simpleproxy_invalid_responses_total", "Responses not cached because they failed --validate-json-schema.")
+	rateLimited         = newCounter("simpleproxy_rate_limited_total", "Requests rejected by --rate-limit.")
+	upstreamInflight    = newGauge("simpleproxy_upstream_inflight", "Upstream fetches currently in progress, including reading their body.")
+	responseSizes       = newHistogram("simpleproxy_response_size_bytes", "Size of response bodies, by cache status.", "cache",
+		[]float64{1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20})
+	upstreamLatency = newHistogram("simpleproxy_upstream_latency_seconds", "Time until the upstream response headers were received, by upstream host.", "upstream",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10})
+	responseCodes = newCounterVec("simpleproxy_responses_total", "Responses sent to clients, by status code.", "code")
+	cacheSize     = newGaugeFunc("simpleproxy_cache_size_bytes", "Bytes used by cache entries, tracked with --max-cache-size.", func() (int64, bool) {
+		v, ok := cacheStats(false)["size"]
+		return v, ok
+	})
+	cacheEntries = newGaugeFunc("simpleproxy_cache_entries", "Entries in the cache, tracked with --max-cache-size.", func() (int64, bool) {
+		v, ok := cacheStats(false)["entries"]
+		return v, ok
+	})
+	memCacheBytes = newGaugeFunc("simpleproxy_mem_cache_size_bytes", "Bytes used by entries kept in memory, with --mem-cache-size.", func() (int64, bool) {
+		v, ok := cacheStats(true)["size"]
+		return v, ok
+	})
+)
+
+// cacheStats returns the size accounting of the in-memory cache, if mem is
+// set, or else the one of the filesystem cache, if enabled.
+func cacheStats(mem bool) map[string]int64 {
+	next := cache
+	if m, ok := cache.(*memCache); ok {
+		if mem {
+			return m.Stats()
+		}
+		next = m.next
+	}
+	if fs, ok := next.(*FsCache); ok && !mem {
+		return fs.Stats()
+	}
+	return nil
+}
+
+// countResponses counts the responses sent by next, by status code.
+func countResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		responseCodes.Inc(strconv.Itoa(rec.code))
+	})
+}
+
+// statusRecorder records the status code and body size written to a
+// ResponseWriter, keeping the interfaces used to stream, upgrade and send
+// files.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+	// onHeader, if set, is called with the headers right before they are
+	// sent with the final status code.
+	onHeader func(h http.Header)
+}
+
+func (s *statusRecorder) setCode(code int) {
+	s.code = code
+	if s.onHeader != nil {
+		s.onHeader(s.Header())
+	}
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	// Informational responses come before the final one
+	if s.code == 0 && (code >= 200 || code == http.StatusSwitchingProtocols) {
+		s.setCode(code)
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.code == 0 {
+		s.setCode(http.StatusOK)
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+func (s *statusRecorder) ReadFrom(r io.Reader) (int64, error) {
+	if s.code == 0 {
+		s.setCode(http.StatusOK)
+	}
+	var n int64
+	var err error
+	if rf, ok := s.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(s.ResponseWriter, r)
+	}
+	s.bytes += n
+	return n, err
+}
+
+func (s *statusRecorder) Flush() {
+	if f, ok := s.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (s *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := s.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection does not support hijacking")
+	}
+	return h.Hijack()
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// negativePathRule caches error responses for paths matching pattern
+// during ttl.
+type negativePathRule struct {
+	pattern string
+	ttl     time.Duration
+}
+
+// negativePathRules implements flag.Value, parsing repeated PATTERN:TTL
+// values.
+type negativePathRules []negativePathRule
+
+func (n *negativePathRules) String() string {
+	if n == nil {
+		return ""
+	}
+	var s []string
+	for _, r := range *n {
+		s = append(s, r.pattern+":"+r.ttl.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (n *negativePathRules) Set(v string) error {
+	i := strings.LastIndex(v, ":")
+	if i < 0 {
+		return fmt.Errorf("missing TTL in %q, use PATTERN:TTL", v)
+	}
+	pattern := v[:i]
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	ttl, err := time.ParseDuration(v[i+1:])
+	if err != nil {
+		return fmt.Errorf("invalid TTL in %q: %v", v, err)
+	}
+	*n = append(*n, negativePathRule{pattern: pattern, ttl: ttl})
+	return nil
+}
+
+// setCacheStatuses sets --cache-statuses from the comma-separated list v.
+// Partial and not modified responses have no body of their own to cache.
+func (c *Config) setCacheStatuses(v string) error {
+	statuses := make(map[int]bool)
+	for _, code := range strings.Split(v, ",") {
+		if code = strings.TrimSpace(code); code == "" {
+			continue
+		}
+		status, err := strconv.Atoi(code)
+		switch {
+		case err != nil || status < 200 || status > 599:
+			return fmt.Errorf("invalid status code %q", code)
+		case status == http.StatusPartialContent || status == http.StatusNotModified:
+			return fmt.Errorf("%d responses cannot be cached", status)
+		}
+		statuses[status] = true
+	}
+	c.CacheStatuses = statuses
+	return nil
+}
+
+// negativeTTL returns for how long the non-200 response w can be cached:
+// the first matching --cache-negative-path rule applies to errors that are
+// cacheable by default per RFC 7231, and --negative-ttl to the other codes
+// in --cache-statuses.
+func negativeTTL(w *http.Response) (time.Duration, bool) {
+	switch w.StatusCode {
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusGone,
+		http.StatusRequestURITooLong, http.StatusNotImplemented:
+		for _, rule := range conf.NegativePaths {
+			if ok, _ := path.Match(rule.pattern, w.Request.URL.Path); ok {
+				return rule.ttl, true
+			}
+		}
+	}
+	if w.StatusCode != http.StatusOK && conf.CacheStatuses[w.StatusCode] {
+		return conf.NegativeTTL, true
+	}
+	return 0, false
+}
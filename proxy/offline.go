@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// offlineMode is 1 while serving only from the cache. It starts as set by
+// --offline, and is toggled at runtime with POST /admin/offline.
+var offlineMode int32
+
+// isOffline reports whether the upstream must never be contacted.
+func isOffline() bool {
+	return atomic.LoadInt32(&offlineMode) == 1
+}
+
+func setOffline(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	if atomic.SwapInt32(&offlineMode, v) != v {
+		log.Printf("[offline] Offline mode is now %v", map[bool]string{true: "on", false: "off"}[on])
+	}
+}
+
+// offlineHandler reports whether the proxy is offline, and switches it
+// on POST with ?enabled=true or false.
+func offlineHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		on, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "400 Bad Request: enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		setOffline(on)
+	default:
+		http.Error(w, "405 Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"offline": isOffline()})
+}
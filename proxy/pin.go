@@ -0,0 +1,101 @@
+package proxy
+
+import (
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pinSet holds the cache keys of entries that must never be evicted.
+type pinSet struct {
+	mu   sync.Mutex
+	keys map[string]string // key => uri
+}
+
+// pins is the set of entries pinned with --pin-path or the admin endpoint.
+var pins = &pinSet{keys: make(map[string]string)}
+
+// pinKey returns the cache key for uri, as it would be requested by
+// clients. Tenants of uri share the same key; variants are matched by Has
+// through their recorded URI.
+func pinKey(uri string) (string, error) {
+	r, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return "", err
+	}
+	return cacheKey(keyURI(r)), nil
+}
+
+// Pin exempts the entry for uri from eviction.
+func (p *pinSet) Pin(uri string) error {
+	k, err := pinKey(uri)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[k] = uri
+	return nil
+}
+
+// Unpin makes the entry for uri evictable again.
+func (p *pinSet) Unpin(uri string) error {
+	k, err := pinKey(uri)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.keys, k)
+	return nil
+}
+
+// Has reports whether the entry stored at key for uri, as recorded in its
+// headers, is pinned. Variants, selected by Vary or --cache-key-headers,
+// have keys of their own, and are pinned along with the URI they vary,
+// which starts theirs.
+func (p *pinSet) Has(key, uri string) bool {
+	base := ""
+	if uri != "" {
+		if i := strings.IndexByte(uri, '\n'); i >= 0 {
+			uri = uri[:i]
+		}
+		base = cacheKey(uri)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, ok := p.keys[filepath.Base(key)]; ok {
+		return true
+	}
+	_, ok := p.keys[base]
+	return ok
+}
+
+// List returns the pinned URIs.
+func (p *pinSet) List() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	uris := make([]string, 0, len(p.keys))
+	for _, uri := range p.keys {
+		uris = append(uris, uri)
+	}
+	sort.Strings(uris)
+	return uris
+}
+
+// pathList implements flag.Value, collecting repeated values.
+type pathList []string
+
+func (p *pathList) String() string {
+	if p == nil {
+		return ""
+	}
+	return strings.Join(*p, ",")
+}
+
+func (p *pathList) Set(v string) error {
+	*p = append(*p, v)
+	return nil
+}
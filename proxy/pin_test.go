@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPinSetHas(t *testing.T) {
+	parseTestFlags(t)
+	p := &pinSet{keys: make(map[string]string)}
+	if err := p.Pin("/a"); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		key, uri string
+		want     bool
+	}{
+		{cacheKey("/a"), "", true},
+		{"tenant/" + cacheKey("/a"), "", true},
+		{"variant", "/a\nAccept: application/json", true},
+		{"variant", "/a\nX-Lang: en", true},
+		{"other", "/a", true},
+		{"other", "/ab\nAccept: */*", false},
+		{"other", "", false},
+	} {
+		if got := p.Has(tc.key, tc.uri); got != tc.want {
+			t.Errorf("Has(%q, %q) = %v, want %v", tc.key, tc.uri, got, tc.want)
+		}
+	}
+}
+
+func TestPinnedVariantsAreNotEvicted(t *testing.T) {
+	var n int32
+	body := strings.Repeat("x", 1024)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pinned" {
+			atomic.AddInt32(&n, 1)
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept")
+		fmt.Fprintf(w, "%v %v %v", r.URL.Path, r.Header.Get("Accept"), body)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	h := newTestHandler(t, newTestConfig(t, u, "--pin-path=/pinned", "--max-cache-size=8KiB"))
+	accept := func(path, accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		r.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	variants := []string{"application/json", "application/xml"}
+	for _, ac := range variants {
+		accept("/pinned", ac)
+	}
+	// Fills the cache many times over
+	for i := 0; i < 20; i++ {
+		for _, ac := range variants {
+			accept(fmt.Sprintf("/other/%d", i), ac)
+		}
+	}
+	for _, ac := range variants {
+		if rec := accept("/pinned", ac); rec.Header().Get("x-cache") != CacheHit {
+			t.Errorf("pinned variant for %v got x-cache %q, want a hit", ac, rec.Header().Get("x-cache"))
+		}
+	}
+	if n != 2 {
+		t.Errorf("upstream got %d requests for the pinned URI, want one per variant", n)
+	}
+	if rec := accept("/other/0", variants[0]); rec.Header().Get("x-cache") == CacheHit {
+		t.Errorf("unpinned entries were not evicted")
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// errPathExcluded is returned for requests whose path is not cached, per
+// --cache-include and --cache-exclude.
+var errPathExcluded = errors.New("path is excluded from the cache")
+
+// pathPattern matches request paths, either with a glob, or a regular
+// expression if prefixed by '~'.
+type pathPattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+// Match reports whether p, or one of its parent directories, matches the
+// glob, so /static/* matches everything under /static. Regular expressions
+// match anywhere in p, unless anchored. Globs without a slash, such as
+// *.tar.gz, match the file name.
+func (pp pathPattern) Match(p string) bool {
+	if pp.re != nil {
+		return pp.re.MatchString(p)
+	}
+	if !strings.Contains(pp.glob, "/") {
+		ok, _ := path.Match(pp.glob, path.Base(p))
+		return ok
+	}
+	for {
+		if ok, _ := path.Match(pp.glob, p); ok {
+			return true
+		}
+		i := strings.LastIndex(p, "/")
+		if i <= 0 {
+			return false
+		}
+		p = p[:i]
+	}
+}
+
+// pathPatterns implements flag.Value, parsing repeated patterns.
+type pathPatterns []pathPattern
+
+func (p *pathPatterns) String() string {
+	if p == nil {
+		return ""
+	}
+	var s []string
+	for _, pp := range *p {
+		if pp.re != nil {
+			s = append(s, "~"+pp.re.String())
+		} else {
+			s = append(s, pp.glob)
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *pathPatterns) Set(v string) error {
+	if strings.HasPrefix(v, "~") {
+		re, err := regexp.Compile(v[1:])
+		if err != nil {
+			return fmt.Errorf("invalid regular expression %q: %v", v[1:], err)
+		}
+		*p = append(*p, pathPattern{re: re})
+		return nil
+	}
+	if _, err := path.Match(v, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", v, err)
+	}
+	*p = append(*p, pathPattern{glob: v})
+	return nil
+}
+
+// Match reports whether any of the patterns matches p.
+func (p pathPatterns) Match(path string) bool {
+	for _, pp := range p {
+		if pp.Match(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheablePath reports whether r may be served from and stored in the
+// cache: its path must not match --cache-exclude, and must match
+// --cache-include, if set. Exclusions take precedence.
+func cacheablePath(r *http.Request) bool {
+	if len(conf.CacheInclude) == 0 && len(conf.CacheExclude) == 0 {
+		return true
+	}
+	u, err := url.Parse(keyURI(r))
+	if err != nil {
+		return false
+	}
+	if conf.CacheExclude.Match(u.Path) {
+		return false
+	}
+	return len(conf.CacheInclude) == 0 || conf.CacheInclude.Match(u.Path)
+}
+
+// mediaPatterns implements flag.Value, parsing repeated media type globs,
+// such as image/* or application/json.
+type mediaPatterns []string
+
+func (m *mediaPatterns) String() string {
+	if m == nil {
+		return ""
+	}
+	return strings.Join(*m, ",")
+}
+
+func (m *mediaPatterns) Set(v string) error {
+	v = strings.ToLower(strings.TrimSpace(v))
+	if _, err := path.Match(v, ""); err != nil || v == "" {
+		return fmt.Errorf("invalid media type pattern %q", v)
+	}
+	*m = append(*m, v)
+	return nil
+}
+
+// Match reports whether any of the patterns matches the media type mt.
+func (m mediaPatterns) Match(mt string) bool {
+	for _, p := range m {
+		if ok, _ := path.Match(p, mt); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheableType reports whether a response with the header h may be
+// stored, per --cache-content-type and --cache-exclude-content-type.
+// Responses without a Content-Type are only stored when no type is
+// required.
+func cacheableType(h http.Header) bool {
+	if len(conf.CacheContentTypes) == 0 && len(conf.CacheExcludeContentTypes) == 0 {
+		return true
+	}
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	if conf.CacheExcludeContentTypes.Match(mt) {
+		return false
+	}
+	return len(conf.CacheContentTypes) == 0 || conf.CacheContentTypes.Match(mt)
+}
+
+// limitBlob returns blob failing with err once more than max bytes are
+// read, so entries over --max-cache-object-size are discarded.
+func limitBlob(blob io.ReadCloser, max int64, err error) io.ReadCloser {
+	return &limitedBlob{ReadCloser: blob, left: max, err: err}
+}
+
+type limitedBlob struct {
+	io.ReadCloser
+	left int64
+	err  error
+}
+
+func (b *limitedBlob) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.left -= int64(n); b.left < 0 {
+		return 0, b.err
+	}
+	return n, err
+}
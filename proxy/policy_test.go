@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestIneligibleResponsesRejected(t *testing.T) {
+	for _, flag := range []string{
+		"--cache-exclude-content-type=text/*",
+		"--cache-content-type=image/*",
+		"--max-cache-object-size=4",
+	} {
+		var n int32
+		h := newTestHandler(t, newTestConfig(t, newTestUpstream(t, &n), flag, "--cache-ineligible-action=reject"))
+		if rec := get(h, "/page"); rec.Code != http.StatusBadGateway {
+			t.Errorf("with %v got %d, want 502", flag, rec.Code)
+		}
+	}
+}
+
+func TestIneligibleResponsesPassed(t *testing.T) {
+	var n int32
+	h := newTestHandler(t, newTestConfig(t, newTestUpstream(t, &n), "--max-cache-object-size=4"))
+	for i := 0; i < 2; i++ {
+		if rec := get(h, "/page"); rec.Code != http.StatusOK || rec.Header().Get("x-cache") != "" {
+			t.Errorf("request %d got %d with x-cache %q, want an uncached 200", i, rec.Code, rec.Header().Get("x-cache"))
+		}
+	}
+}
+
+func TestUncacheableTTLRejected(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, "secret")
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	h := newTestHandler(t, newTestConfig(t, u, "--cache-ineligible-action=reject"))
+	if rec := get(h, "/page"); rec.Code != http.StatusBadGateway {
+		t.Errorf("no-store response got %d, want 502", rec.Code)
+	}
+}
@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	linkTagRe  = regexp.MustCompile(`(?is)<link\s[^>]*>`)
+	linkAttrRe = regexp.MustCompile(`(?is)\b(rel|href)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s>]+))`)
+)
+
+// prefetchScanLimit is how much of HTML pages is scanned for links.
+const prefetchScanLimit = 1 << 20
+
+// linkPrefetcher warms the cache with resources linked by cached pages,
+// using a bounded queue and a fixed number of workers.
+type linkPrefetcher struct {
+	// ctx stops the workers once done
+	ctx   context.Context
+	next  http.Handler
+	cache CacheManager
+	queue chan *http.Request
+}
+
+// prefetcher is used by cacheResponse when --prefetch-links is set.
+var prefetcher *linkPrefetcher
+
+func newLinkPrefetcher(ctx context.Context, next http.Handler, cache CacheManager, workers int) *linkPrefetcher {
+	p := &linkPrefetcher{ctx: ctx, next: next, cache: cache, queue: make(chan *http.Request, 1000)}
+	for i := 0; i < workers; i++ {
+		go p.run()
+	}
+	return p
+}
+
+// Enqueue schedules the same-origin links of w for prefetching. Links
+// come from Link headers and, for HTML pages, from <link rel=preload>
+// tags in body. Links are dropped if the queue is full.
+func (p *linkPrefetcher) Enqueue(w *http.Response, body []byte) {
+	if p == nil || isOffline() {
+		return
+	}
+	var links []string
+	for _, v := range w.Header.Values("Link") {
+		links = append(links, parseLinkHeader(v)...)
+	}
+	if strings.HasPrefix(w.Header.Get("Content-Type"), "text/html") {
+		links = append(links, parseLinkTags(body)...)
+	}
+	for _, l := range links {
+		uri, ok := sameOrigin(w.Request.URL, l)
+		if !ok {
+			continue
+		}
+		// Links are fetched from the same upstream
+		req, err := http.NewRequestWithContext(withUpstream(p.ctx, w.Request), http.MethodGet, uri, nil)
+		if err != nil {
+			continue
+		}
+		req.RequestURI = uri
+		select {
+		case p.queue <- req:
+		default:
+			log.Printf("[prefetch] Queue is full, dropping '%v'", uri)
+		}
+	}
+}
+
+func (p *linkPrefetcher) run() {
+	for {
+		var req *http.Request
+		select {
+		case <-p.ctx.Done():
+			return
+		case req = <-p.queue:
+		}
+		uri := req.RequestURI
+		if !cacheablePath(req) {
+			continue
+		}
+		if _, _, b, _, err := getEntry(p.cache, req); err == nil {
+			b.Close()
+			continue
+		}
+		log.Printf("[prefetch] Prefetching '%v'", uri)
+		p.next.ServeHTTP(&discardWriter{h: make(http.Header)}, req)
+	}
+}
+
+// parseLinkHeader returns the targets of preload relations in a Link
+// header value, such as `</app.css>; rel=preload; as=style`.
+func parseLinkHeader(v string) []string {
+	var links []string
+	for _, link := range strings.Split(v, ",") {
+		parts := strings.Split(link, ";")
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		for _, param := range parts[1:] {
+			param = strings.ToLower(strings.TrimSpace(param))
+			if strings.HasPrefix(param, "rel=") && hasRel(strings.Trim(param[4:], `"`), "preload") {
+				links = append(links, target[1:len(target)-1])
+			}
+		}
+	}
+	return links
+}
+
+// parseLinkTags returns the href of <link rel=preload> tags in body.
+func parseLinkTags(body []byte) []string {
+	var links []string
+	for _, tag := range linkTagRe.FindAll(body, -1) {
+		var rel, href string
+		for _, m := range linkAttrRe.FindAllSubmatch(tag, -1) {
+			v := string(m[2]) + string(m[3]) + string(m[4])
+			if strings.EqualFold(string(m[1]), "rel") {
+				rel = v
+			} else {
+				href = v
+			}
+		}
+		if href != "" && hasRel(rel, "preload") {
+			links = append(links, href)
+		}
+	}
+	return links
+}
+
+func hasRel(rel, want string) bool {
+	for _, r := range strings.Fields(rel) {
+		if strings.EqualFold(r, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// sameOrigin resolves link against base, returning its request URI only
+// if it points to the same origin.
+func sameOrigin(base *url.URL, link string) (string, bool) {
+	u, err := base.Parse(link)
+	if err != nil || u.Host != base.Host || u.Scheme != base.Scheme {
+		return "", false
+	}
+	return u.RequestURI(), true
+}
@@ -0,0 +1,825 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	CacheHit         = "HIT"
+	CacheStale       = "STALE"
+	CacheRevalidated = "REVALIDATED"
+)
+
+// ctxKey identifies request-scoped values in a context.
+type ctxKey int
+
+const (
+	// ttlKey holds the TTL requested with --allow-ttl-param.
+	ttlKey ctxKey = iota
+	// refreshKey marks requests that must skip the cache lookup and
+	// store a fresh copy of the response.
+	refreshKey
+	// latencyKey holds a *time.Duration with the upstream latency.
+	latencyKey
+	// timingKey holds the *requestTiming of the request.
+	timingKey
+	// keyURIKey holds the key URI of the request as received from the
+	// client, before --upstream-path-rewrite.
+	keyURIKey
+	// upstreamKey holds the *url.URL of the upstream the request is
+	// routed to.
+	upstreamKey
+	// acceptGzipKey records whether the client accepts gzip, with
+	// --compress.
+	acceptGzipKey
+	// accessKey holds the *accessEntry of the request, with --access-log.
+	accessKey
+	// spanKey holds the current *span of the request, with
+	// --otel-endpoint.
+	spanKey
+)
+
+// isRefresh reports whether r must bypass the cache lookup.
+func isRefresh(r *http.Request) bool {
+	v, _ := r.Context().Value(refreshKey).(bool)
+	return v
+}
+
+// cacheKey derives the cache key for uri, using the --cache-key-hash
+// algorithm. Keys longer than --max-cache-key-length, which would not fit
+// in a file name, fall back to sha256.
+func cacheKey(uri string) string {
+	switch conf.CacheKeyHash {
+	case "base64":
+		if k := base64.URLEncoding.EncodeToString([]byte(uri)); len(k) <= conf.MaxCacheKeyLength {
+			return k
+		}
+		sum := sha256.Sum256([]byte(uri))
+		return hex.EncodeToString(sum[:])
+	case "blake2b":
+		sum := blake2b.Sum256([]byte(uri))
+		return hex.EncodeToString(sum[:])
+	default:
+		sum := sha256.Sum256([]byte(uri))
+		return hex.EncodeToString(sum[:])
+	}
+}
+
+// keyURI returns the URI used to compute the cache key for r.
+//
+// Relative-form requests, as received by a reverse proxy, use the path and
+// query. Absolute-form requests, sent by clients using us as a forward
+// proxy, also include scheme, host and port, so the same path on different
+// hosts never collides.
+//
+// With --case-insensitive-paths, the path is lowercased, and with
+// --normalize-path duplicate slashes and dot segments are resolved. The
+// query follows --ignore-query-param, --ignore-query and --sort-query.
+// The request sent upstream is left untouched.
+func keyURI(r *http.Request) string {
+	if uri, ok := r.Context().Value(keyURIKey).(string); ok {
+		return uri
+	}
+	uri := r.URL.RequestURI()
+	p, query := uri, ""
+	if i := strings.Index(uri, "?"); i >= 0 {
+		p, query = uri[:i], uri[i+1:]
+	}
+	if conf.CaseInsensitivePaths {
+		p = strings.ToLower(p)
+	}
+	if conf.NormalizePath {
+		p = cleanPath(p)
+	}
+	uri = p
+	if query = keyQuery(r.URL.Path, query); query != "" {
+		uri += "?" + query
+	}
+	u, err := url.ParseRequestURI(r.RequestURI)
+	if err != nil || !u.IsAbs() {
+		return uri
+	}
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[strings.ToLower(u.Scheme)]
+	}
+	host := net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+	return strings.ToLower(u.Scheme) + "://" + host + uri
+}
+
+// cleanPath collapses duplicate slashes and resolves dot segments in p,
+// never going above the root. A trailing slash is preserved, since
+// upstreams usually tell /a/ and /a apart.
+func cleanPath(p string) string {
+	if p == "" || p[0] != '/' {
+		return p
+	}
+	cleaned := path.Clean(p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+// Handler serves cache hits straight from the cache when the stored
+// blob can be seeked, leaving everything else to the reverse proxy.
+//
+// Serving with http.ServeContent lets the server use sendfile(2) for
+// *os.File blobs and takes care of Range and conditional requests.
+type Handler struct {
+	cache CacheManager
+	next  http.Handler
+}
+
+func (c *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if conf.SlowRequestThreshold > 0 {
+		var t *requestTiming
+		r, t = withTiming(r)
+		defer func(start time.Time) {
+			t.logIfSlow(r, time.Since(start))
+		}(time.Now())
+	}
+	if conf.AllowTTLParam {
+		r = withTTLParam(r)
+	}
+	if conf.ForwardClientCert {
+		setClientCert(r)
+	}
+	if conf.AllowMethodOverride {
+		overrideMethod(r)
+	}
+	if conf.Compress {
+		r = withAcceptGzip(r)
+	}
+	if conf.RefreshToken != "" {
+		r = withRefreshToken(r)
+	}
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && !isRefresh(r) && !passthrough(r) && cacheablePath(r) && !clientNoCache(r) {
+		if c.serveCached(w, r) {
+			return
+		}
+		if r.Header.Get("Range") != "" && conf.RangeMissStrategy == "full" {
+			// Cache the whole object first, then serve the range from it.
+			c.fetchFull(r)
+			if c.serveCached(w, r) {
+				return
+			}
+		}
+	}
+	c.next.ServeHTTP(w, r)
+}
+
+// overrideMethod replaces the method of POST requests by the one in the
+// X-HTTP-Method-Override header, so routing, caching and the request sent
+// upstream all use the effective method.
+func overrideMethod(r *http.Request) {
+	m := strings.ToUpper(strings.TrimSpace(r.Header.Get("X-HTTP-Method-Override")))
+	if r.Method != http.MethodPost || m == "" {
+		return
+	}
+	switch m {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		log.Printf("[handler] Ignoring invalid method override %q", m)
+		return
+	}
+	debugf("[handler] Overriding method %v with %v for '%v'", r.Method, m, r.URL.RequestURI())
+	r.Method = m
+	r.Header.Del("X-HTTP-Method-Override")
+	if m == http.MethodGet || m == http.MethodHead {
+		r.Body.Close()
+		r.Body, r.ContentLength = http.NoBody, 0
+		r.Header.Del("Content-Length")
+		r.Header.Del("Content-Type")
+	}
+}
+
+// serveCached writes the cached response for r, if any, reporting whether
+// it did so.
+func (c *Handler) serveCached(w http.ResponseWriter, r *http.Request) bool {
+	start := time.Now()
+	k, uri, b, h, err := getEntry(c.cache, r)
+	timingOf(r).addCacheLookup(start)
+	if err != nil {
+		return false
+	}
+	defer b.Close()
+	if needsRevalidation(h) != "" || gunzipCached(r, h) {
+		// Left to the transport
+		return false
+	}
+	content, ok := b.(io.ReadSeeker)
+	if !ok {
+		return false
+	}
+
+	log.Printf("[handler] Serving '%v' from cache", r.URL.RequestURI())
+	size, _ := strconv.ParseInt(h.Get("content-length"), 10, 64)
+	events.Emit(eventHit, k, uri, size)
+	responseSizes.Observe("hit", float64(size))
+	cacheHits.Inc()
+	cacheHitBytes.Add(size)
+	xcache := CacheHit
+	if isStale(h) {
+		xcache = CacheStale
+		refresher.Refresh(r, k)
+	}
+	addHeuristicWarning(h)
+	restoreETag(h)
+	if status := cachedStatus(h); status != http.StatusOK {
+		// Negatively cached errors are replayed as they are.
+		for k, v := range h {
+			w.Header()[http.CanonicalHeaderKey(k)] = v
+		}
+		w.Header().Set("x-cache", xcache)
+		setClientCacheControl(w.Header())
+		w.WriteHeader(status)
+		if r.Method != http.MethodHead {
+			io.Copy(w, b)
+		}
+		return true
+	}
+	// Prefer the upstream Last-Modified, so it is replayed as it was
+	// sent, and conditional requests are checked against it.
+	modtime, _ := http.ParseTime(h.Get("Last-Modified"))
+	if f, ok := b.(*os.File); ok {
+		if st, err := f.Stat(); err == nil {
+			if modtime.IsZero() {
+				modtime = st.ModTime()
+			}
+			if conf.ClientCacheControl != "" && h.Get("etag") == "" {
+				h.Set("etag", fileETag(st.Size(), modtime))
+			}
+		}
+	}
+	for k, v := range h {
+		// ServeContent computes the length itself, and it may differ
+		// from the stored one when serving a range. It leaves it out
+		// for encoded bodies, though.
+		if http.CanonicalHeaderKey(k) == "Content-Length" && (h.Get("Content-Encoding") == "" || r.Header.Get("Range") != "") {
+			continue
+		}
+		w.Header()[http.CanonicalHeaderKey(k)] = v
+	}
+	w.Header().Set("x-cache", xcache)
+	setClientCacheControl(w.Header())
+	http.ServeContent(w, r, "", modtime, content)
+	return true
+}
+
+// fetchFull sends r through the proxy without its Range and conditional
+// headers, so the full object is fetched from upstream and cached.
+func (c *Handler) fetchFull(r *http.Request) {
+	req := r.Clone(context.WithValue(r.Context(), refreshKey, true))
+	req.Method = http.MethodGet
+	for _, k := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		req.Header.Del(k)
+	}
+	log.Printf("[handler] Fetching full object for range request '%v'", keyURI(r))
+	c.next.ServeHTTP(&discardWriter{h: make(http.Header)}, req)
+}
+
+// connTrace records whether upstream requests reuse idle connections.
+func connTrace(uri string) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				upstreamConnsReused.Inc()
+			} else {
+				upstreamConnsNew.Inc()
+			}
+			debugf("[transport] Connection for '%v': reused=%v idle=%v", uri, info.Reused, info.IdleTime)
+		},
+	}
+}
+
+// cachedStatus removes the stored status code from h and returns it.
+// Entries without one are regular 200 responses.
+func cachedStatus(h http.Header) int {
+	status, err := strconv.Atoi(h.Get(statusHeader))
+	h.Del(statusHeader)
+	if err != nil {
+		return http.StatusOK
+	}
+	return status
+}
+
+// errNotCacheable is reported for requests whose method is never served
+// from the cache.
+var errNotCacheable = errors.New("request method is not cacheable")
+
+// CachedTransport retrieves serves cached data if available.
+type CachedTransport struct {
+	t     http.Transport
+	cache CacheManager
+
+	// flights coalesces concurrent misses for the same key.
+	flights flightGroup
+}
+
+func (c *CachedTransport) cacheResponse(w *http.Response) error {
+	defer setClientCacheControl(w.Header)
+	defer gzipResponse(w)
+
+	// Keep redirects to the upstream within the proxy
+	rewriteLocations(w)
+	if len(conf.CookieDomainRules) > 0 || len(conf.CookiePathRules) > 0 || conf.StripCookieSecure {
+		rewriteSetCookies(w.Header)
+	}
+	if conf.EnableAccelRedirect && w.Header.Get(accelRedirectHeader) != "" {
+		return c.accelRedirect(w)
+	}
+	if xcache := w.Header.Get("x-cache"); xcache == CacheHit || xcache == CacheStale || xcache == CacheRevalidated {
+		return nil
+	}
+	if conf.RewriteBodies {
+		if err := rewriteBody(w); err != nil {
+			return err
+		}
+	}
+	if w.Request.Method != http.MethodGet {
+		// HEAD requests are served from the entries of GET ones
+		return nil
+	}
+	if passthrough(w.Request) || isEventStream(w.Header) {
+		return nil
+	}
+	if !cacheablePath(w.Request) {
+		return nil
+	}
+	if !cacheableType(w.Header) {
+		return notCacheable(w, fmt.Sprintf("content type %q is excluded", w.Header.Get("Content-Type")))
+	}
+	if conf.MaxCacheObjectSize > 0 && w.ContentLength > int64(conf.MaxCacheObjectSize) {
+		return notCacheable(w, fmt.Sprintf("%d bytes is over --max-cache-object-size", w.ContentLength))
+	}
+	errTTL, negative := negativeTTL(w)
+	if !negative && (w.StatusCode != http.StatusOK || !conf.CacheStatuses[http.StatusOK]) {
+		return nil
+	}
+	ttl, expires, reason := responseTTL(w)
+	if reason != "" {
+		return notCacheable(w, reason)
+	}
+	vary, ok := responseVary(w)
+	if !ok {
+		debugf("[transport] Not caching '%v': response varies on everything", keyURI(w.Request))
+		return nil
+	}
+	if latency, ok := w.Request.Context().Value(latencyKey).(*time.Duration); ok && conf.MinUpstreamLatency > 0 {
+		if *latency < conf.MinUpstreamLatency {
+			debugf("[transport] Upstream took %v for '%v'", *latency, keyURI(w.Request))
+			return notCacheable(w, "below --min-upstream-latency")
+		}
+		debugf("[transport] Caching '%v': upstream took %v", keyURI(w.Request), *latency)
+	}
+	if conf.DisableUpstreamCompression {
+		if err := decodeBody(w); err != nil {
+			return notCacheable(w, err.Error())
+		}
+	}
+
+	if len(conf.JSONSchemas) > 0 {
+		if err := validateResponse(w); err != nil {
+			invalidResponses.Inc()
+			log.Printf("[transport] Not caching '%v': %v", keyURI(w.Request), err)
+			return nil
+		}
+	}
+
+	if disk != nil && disk.Low() {
+		cacheWritesSkipped.Inc()
+		debugf("[transport] Not caching '%v': low free disk space", keyURI(w.Request))
+		return nil
+	}
+
+	// Protect disk I/O for hits during bursts of writes
+	if !writeSlots.Acquire() {
+		cacheWritesSkipped.Inc()
+		debugf("[transport] Not caching '%v': too many concurrent writes", keyURI(w.Request))
+		return nil
+	}
+
+	uri := keyURI(w.Request)
+	if len(vary) > 0 {
+		// Store a marker under the base key, pointing lookups to the
+		// variant selected by the request headers.
+		marker := make(http.Header)
+		marker.Set(varyHeader, strings.Join(vary, ","))
+		marker.Set(uriHeader, uri)
+		if err := c.cache.Put(requestKey(w.Request, uri), io.NopCloser(strings.NewReader("")), marker); err != nil {
+			writeSlots.Release()
+			return err
+		}
+		uri = variantURI(uri, w.Request, vary)
+	}
+	k := requestKey(w.Request, uri)
+	h := storedHeaders(w)
+	h.Set(uriHeader, uri)
+	if etag := w.Header.Get("etag"); etag != "" {
+		h.Set("etag", etag)
+	} else if conf.ClientCacheControl != "" {
+		// Let clients revalidate the entry, even if upstream did not
+		// provide a validator. It is stored apart, as the proxy itself
+		// cannot revalidate with it.
+		etag = newETag(k)
+		w.Header.Set("etag", etag)
+		h.Set(generatedETagHeader, etag)
+	}
+	if negative {
+		h.Set(statusHeader, strconv.Itoa(w.StatusCode))
+		if location := w.Header.Get("Location"); location != "" {
+			// Redirects are replayed with their target
+			h.Set("Location", location)
+		}
+		h.Set(expiresHeader, time.Now().Add(errTTL).UTC().Format(http.TimeFormat))
+	} else if expires {
+		h.Set(expiresHeader, time.Now().Add(ttl).UTC().Format(http.TimeFormat))
+		setOriginExpires(h, w)
+	}
+	if hasCacheDirective(w.Header, "must-revalidate", "proxy-revalidate") {
+		h.Set(mustRevalidateHeader, "1")
+	}
+	setStaleHeaders(h, w.Header)
+
+	// Stream the body to the cache while it is served. The entry is only
+	// committed once the body is read in full, and discarded if the client
+	// goes away or upstream fails mid-way.
+	headLimit := 0
+	if prefetcher != nil {
+		headLimit = prefetchScanLimit
+	}
+	store := func(blob io.ReadCloser) error {
+		return c.cache.Put(k, blob, h)
+	}
+	if compressible(w) {
+		h.Set("Content-Encoding", "gzip")
+		h.Set(compressedHeader, "1")
+		store = func(blob io.ReadCloser) error {
+			gz := gzipReader(blob)
+			defer gz.Close()
+			return c.cache.Put(k, gz, h)
+		}
+	}
+	put := func(blob io.ReadCloser) error {
+		_, s := startSpan(w.Request.Context(), "cache store", spanInternal)
+		s.SetAttr("simpleproxy.cache.key", k)
+		if conf.MaxCacheObjectSize > 0 {
+			// Bodies of unknown length are checked as they are stored
+			blob = limitBlob(blob, int64(conf.MaxCacheObjectSize), errTooLarge)
+		}
+		err := store(blob)
+		s.End(err)
+		return err
+	}
+	w.Body = newCacheWriter(w.Body, put, headLimit, func(n int64, head []byte, err error) {
+		defer writeSlots.Release()
+		if err != nil {
+			log.Printf("[transport] Not caching '%v': %v", uri, err)
+			return
+		}
+		events.Emit(eventStore, k, uri, n)
+		prefetcher.Enqueue(w, head)
+	})
+	return nil
+}
+
+// notCacheable handles responses that are not eligible for caching. They
+// are either passed through, or replaced by an error when running with
+// --cache-ineligible-action=reject.
+func notCacheable(w *http.Response, reason string) error {
+	log.Printf("[transport] Not caching '%v': %v", keyURI(w.Request), reason)
+	if conf.CacheIneligibleAction != "reject" {
+		return nil
+	}
+	w.Body.Close()
+	body := fmt.Sprintf("%d %s: response is not cacheable\n", conf.CacheIneligibleStatus, http.StatusText(conf.CacheIneligibleStatus))
+	w.Status = fmt.Sprintf("%d %s", conf.CacheIneligibleStatus, http.StatusText(conf.CacheIneligibleStatus))
+	w.StatusCode = conf.CacheIneligibleStatus
+	w.Header = make(http.Header)
+	w.Header.Set("content-type", "text/plain; charset=utf-8")
+	w.Header.Set("content-length", strconv.Itoa(len(body)))
+	w.Body = io.NopCloser(strings.NewReader(body))
+	w.ContentLength = int64(len(body))
+	return nil
+}
+
+// decodeBody replaces an encoded response body by its identity-encoded
+// version, in case upstream ignored our Accept-Encoding request header.
+func decodeBody(w *http.Response) error {
+	var (
+		body io.ReadCloser
+		err  error
+	)
+	switch enc := strings.ToLower(w.Header.Get("content-encoding")); enc {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		body, err = gzip.NewReader(w.Body)
+	case "deflate":
+		body, err = zlib.NewReader(w.Body)
+	default:
+		return fmt.Errorf("unsupported content-encoding %q", enc)
+	}
+	if err != nil {
+		return err
+	}
+	w.Body = &readCloser{Reader: body, closers: []io.Closer{body, w.Body}}
+	w.Header.Del("content-encoding")
+	w.Header.Del("content-length")
+	w.ContentLength = -1
+	return nil
+}
+
+// sizeRecorder records the number of bytes read from an upstream response
+// body in the size histogram once it is closed.
+type sizeRecorder struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+}
+
+func (s *sizeRecorder) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	s.n += int64(n)
+	return n, err
+}
+
+func (s *sizeRecorder) Close() error {
+	s.once.Do(func() {
+		responseSizes.Observe("miss", float64(s.n))
+		upstreamBytes.Add(s.n)
+	})
+	return s.ReadCloser.Close()
+}
+
+// readCloser reads from Reader and closes all closers when done.
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r *readCloser) Close() (err error) {
+	for _, c := range r.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// offlineMiss is the response for cache misses while running --offline.
+func offlineMiss(r *http.Request) *http.Response {
+	return gatewayTimeout(r, "not in cache and upstream is offline")
+}
+
+// gatewayTimeout returns a 504 Gateway Timeout response explaining reason.
+func gatewayTimeout(r *http.Request, reason string) *http.Response {
+	body := "504 Gateway Timeout: " + reason + "\n"
+	h := make(http.Header)
+	h.Set("content-type", "text/plain; charset=utf-8")
+	h.Set("content-length", strconv.Itoa(len(body)))
+	return &http.Response{
+		Request:       r,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		Header:        h,
+		ContentLength: int64(len(body)),
+		Status:        "504 Gateway Timeout",
+		StatusCode:    http.StatusGatewayTimeout,
+		Proto:         r.Proto,
+		ProtoMajor:    r.ProtoMajor,
+		ProtoMinor:    r.ProtoMinor,
+	}
+}
+
+func (c *CachedTransport) RoundTrip(r *http.Request) (w *http.Response, err error) {
+	var uri = keyURI(r)
+	k := requestKey(r, uri)
+
+	log.Printf("[transport] Request '%v' => '%v'", uri, k)
+	// log.Printf("[transport] Request headers: %#v", r.Header)
+
+	var (
+		b io.ReadCloser
+		h http.Header
+	)
+	if isRefresh(r) {
+		err = errRefresh
+	} else if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		err = errNotCacheable
+	} else if passthrough(r) {
+		err = errPassthrough
+	} else if !cacheablePath(r) {
+		err = errPathExcluded
+	} else {
+		start := time.Now()
+		k, uri, b, h, err = getEntry(c.cache, r)
+		timingOf(r).addCacheLookup(start)
+	}
+	if err == nil {
+		mode := needsRevalidation(h)
+		if mode == "" && clientNoCache(r) {
+			// The client must not get the entry unless upstream agrees
+			mode = revalidateMust
+		}
+		if mode != "" {
+			return c.revalidate(r, k, uri, b, h, mode)
+		}
+		log.Printf("[transport] Returning data from cache")
+		size, _ := strconv.ParseInt(h.Get("content-length"), 10, 64)
+		events.Emit(eventHit, k, uri, size)
+		xcache := CacheHit
+		if isStale(h) {
+			xcache = CacheStale
+			refresher.Refresh(r, k)
+		}
+		return cachedResponse(r, b, h, xcache), nil
+	} else {
+		log.Printf("[transport] Cache miss (err=%v)", err)
+		switch {
+		case errors.Is(err, errRefresh):
+		case errors.Is(err, errNotCacheable), errors.Is(err, errPathExcluded), errors.Is(err, errPassthrough):
+			cacheBypasses.Inc()
+		default:
+			cacheMisses.Inc()
+		}
+	}
+	revalidate := errors.Is(err, errMustRevalidate)
+
+	if isOffline() {
+		log.Printf("[transport] Offline cache miss for '%v'", uri)
+		return offlineMiss(r), nil
+	}
+	// Only one request at a time fetches full objects for a key, while
+	// others wait to be served from the entry it stores
+	coalesce := r.Method == http.MethodGet && r.Header.Get("Range") == "" && !isRefresh(r) && !errors.Is(err, errPathExcluded) && !errors.Is(err, errPassthrough)
+	if coalesce {
+		if f, leader := c.flights.Join(k); !leader {
+			if w, err := c.follow(r, f); w != nil || err != nil {
+				return w, err
+			}
+			coalesce = false
+		}
+	}
+	w, err = c.fetch(r, uri)
+	if coalesce {
+		if err != nil || w.StatusCode == http.StatusSwitchingProtocols || isEventStream(w.Header) {
+			// Streams may never end, so waiting requests go upstream
+			c.flights.Done(k)
+		} else {
+			w.Body = &flightBody{ReadCloser: w.Body, done: func() { c.flights.Done(k) }}
+		}
+	}
+	if err != nil && revalidate && r.Context().Err() == nil {
+		return revalidationFailed(r), nil
+	}
+	return w, err
+}
+
+// cachedResponse returns the response for a cache hit, with blob b and
+// headers h.
+func cachedResponse(r *http.Request, b io.ReadCloser, h http.Header, xcache string) *http.Response {
+	size, _ := strconv.ParseInt(h.Get("content-length"), 10, 64)
+	addHeuristicWarning(h)
+	restoreETag(h)
+	status := cachedStatus(h)
+	h.Set("x-cache", xcache)
+	responseSizes.Observe("hit", float64(size))
+	cacheHits.Inc()
+	cacheHitBytes.Add(size)
+	if gunzipCached(r, h) {
+		b, size = &gunzipBody{blob: b}, -1
+	}
+	// Match the client protocol, and always provide the length, so
+	// HTTP/1.0 clients get a plain, delimited body.
+	return &http.Response{
+		Request:       r,
+		Body:          b,
+		Header:        h,
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         r.Proto,
+		ProtoMajor:    r.ProtoMajor,
+		ProtoMinor:    r.ProtoMinor,
+		ContentLength: size,
+	}
+}
+
+// fetch sends r to the upstream.
+func (c *CachedTransport) fetch(r *http.Request, uri string) (w *http.Response, err error) {
+	b, err := balance(r)
+	if h := healthOf(requestUpstream(r)); err == nil && b == nil && conf.UpstreamHealthInterval > 0 && h != nil && !h.Healthy() {
+		err = errUpstreamUnhealthy
+	}
+	if err == nil {
+		err = breaker.Allow(r.URL.Host)
+	}
+	if err != nil {
+		log.Printf("[transport] Not forwarding request: %v", err)
+		return nil, err
+	}
+
+	upstreamFetches.Inc()
+	upstreamInflight.Inc()
+	latency := new(time.Duration)
+	ctx := context.WithValue(r.Context(), latencyKey, latency)
+	// Upgraded connections and event streams are meant to last
+	stopTimeout := context.CancelFunc(func() {})
+	if conf.UpstreamTimeout > 0 && !passthrough(r) {
+		ctx, stopTimeout = context.WithTimeout(ctx, conf.UpstreamTimeout)
+	}
+	// The fetch is in flight until it fails or its body is closed
+	var finished sync.Once
+	cancel := func() {
+		stopTimeout()
+		finished.Do(upstreamInflight.Dec)
+	}
+	r = r.WithContext(httptrace.WithClientTrace(ctx, connTrace(uri)))
+	start := time.Now()
+	recordUpstream(r, r.URL.Host)
+	w, err = c.roundTrip(r)
+	for b != nil {
+		b.done(r, w, err)
+		if err == nil || !retryable(r) {
+			break
+		}
+		// Failed backends are left out, so another one is tried
+		if b, _ = balance(r); b != nil {
+			log.Printf("[transport] Retrying on %v: %v", b.url, err)
+			recordUpstream(r, r.URL.Host)
+			w, err = c.roundTrip(r)
+		}
+	}
+	// Backends of pools are retried above, without waiting
+	for attempt := 1; b == nil && attempt <= conf.UpstreamRetries && retryable(r) && retryFetch(w, err); attempt++ {
+		reason := fmt.Sprint(err)
+		if err == nil {
+			reason = w.Status
+		}
+		log.Printf("[transport] Retrying '%v' (attempt %d of %d): %v", uri, attempt, conf.UpstreamRetries, reason)
+		if !backoff(r, attempt) {
+			break
+		}
+		if err == nil {
+			w.Body.Close()
+		}
+		recordUpstream(r, r.URL.Host)
+		w, err = c.roundTrip(r)
+	}
+	*latency = time.Since(start)
+	timingOf(r).addUpstream(start)
+	if err == nil {
+		upstreamLatency.Observe(r.URL.Host, latency.Seconds())
+	}
+	failed := err != nil || w.StatusCode >= 500
+	upstreamErrors.Record(failed)
+	if r.Context().Err() == nil {
+		breaker.Record(r.URL.Host, failed)
+	}
+	if failed {
+		upstreamFailures.Inc()
+	}
+	if err != nil {
+		cancel()
+		log.Printf("[transport] Error returned during request: %v", err)
+		return nil, err
+	}
+
+	log.Printf("[transport] Returned status: %v %v", w.StatusCode, w.Status)
+	if w.StatusCode == http.StatusSwitchingProtocols {
+		// Upgraded connections need the original, writable body, and
+		// never have a timeout to cancel
+		cancel()
+		return w, err
+	}
+	if conf.MaxResponseSize > 0 {
+		if err := limitResponse(w); err != nil {
+			cancel()
+			log.Printf("[transport] Refusing '%v': %v", uri, err)
+			return nil, err
+		}
+	}
+	w.Body = &sizeRecorder{ReadCloser: &readCloser{Reader: w.Body, closers: []io.Closer{w.Body, cancelOnClose(cancel)}}}
+	return w, err
+}
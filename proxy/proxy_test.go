@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKeyURIRequestForms(t *testing.T) {
+	parseTestFlags(t)
+	keys := make(map[string]string)
+	for target, want := range map[string]string{
+		"/a?x=1":                        "/a?x=1",
+		"http://Example.com/a?x=1":      "http://example.com:80/a?x=1",
+		"http://example.com:8080/a?x=1": "http://example.com:8080/a?x=1",
+		"https://example.com/a?x=1":     "https://example.com:443/a?x=1",
+		"http://other.example/a?x=1":    "http://other.example:80/a?x=1",
+	} {
+		uri := keyURI(httptest.NewRequest(http.MethodGet, target, nil))
+		if uri != want {
+			t.Errorf("keyURI(%v) = %v, want %v", target, uri, want)
+		}
+		if other, ok := keys[cacheKey(uri)]; ok {
+			t.Errorf("%v and %v share a key", target, other)
+		}
+		keys[cacheKey(uri)] = target
+	}
+}
+
+func TestForwardHostsCachedApart(t *testing.T) {
+	var n1, n2 int32
+	hosts := []string{newTestUpstream(t, &n1).String(), newTestUpstream(t, &n2).String()}
+	h := newTestHandler(t, newTestConfig(t, nil, "--mode=forward", "--forward-allow-local"))
+	for i := 0; i < 2; i++ {
+		for _, host := range hosts {
+			if rec := get(h, host+"/same"); rec.Code != http.StatusOK {
+				t.Fatalf("request for %v got %d", host, rec.Code)
+			}
+		}
+	}
+	if n1 != 1 || n2 != 1 {
+		t.Errorf("upstreams got %d and %d requests, want one each", n1, n2)
+	}
+}
+
+func TestLongURIKeys(t *testing.T) {
+	long := "/search?q=" + strings.Repeat("x", 300)
+	for _, hash := range []string{"base64", "sha256", "blake2b"} {
+		parseTestFlags(t, "--cache-key-hash="+hash)
+		if k := cacheKey(long); len(k) > 255 || len(k) > conf.MaxCacheKeyLength {
+			t.Errorf("%v key of a %d bytes URI is %d bytes long", hash, len(long), len(k))
+		}
+	}
+	parseTestFlags(t, "--cache-key-hash=base64")
+	if k := cacheKey("/short"); k != base64.URLEncoding.EncodeToString([]byte("/short")) {
+		t.Errorf("short URI key %q is not readable base64", k)
+	}
+	if cacheKey(long) == cacheKey(long+"y") {
+		t.Errorf("long URIs share a key")
+	}
+
+	var n int32
+	h := newTestHandler(t, newTestConfig(t, newTestUpstream(t, &n), "--cache-key-hash=base64"))
+	for i := 0; i < 2; i++ {
+		if rec := get(h, long); rec.Code != http.StatusOK {
+			t.Fatalf("request %d got %d", i, rec.Code)
+		}
+	}
+	if n != 1 {
+		t.Errorf("upstream got %d requests, want the long URI cached", n)
+	}
+}
+
+func TestCaseInsensitivePaths(t *testing.T) {
+	parseTestFlags(t, "--case-insensitive-paths")
+	upper := keyURI(httptest.NewRequest(http.MethodGet, "/Page?Q=A", nil))
+	if lower := keyURI(httptest.NewRequest(http.MethodGet, "/page?Q=A", nil)); upper != lower || upper != "/page?Q=A" {
+		t.Errorf("keys are %v and %v, want both /page?Q=A, keeping the query case", upper, lower)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/Page", nil)
+	keyURI(r)
+	if r.URL.Path != "/Page" {
+		t.Errorf("request path changed to %v, want the path forwarded as requested", r.URL.Path)
+	}
+
+	var n int32
+	h := newTestHandler(t, newTestConfig(t, newTestUpstream(t, &n), "--case-insensitive-paths"))
+	if rec := get(h, "/Page"); rec.Body.String() != "path=/Page" {
+		t.Errorf("upstream got %q, want the path as requested", rec.Body.String())
+	}
+	rec := get(h, "/page")
+	if rec.Header().Get("x-cache") != CacheHit || n != 1 {
+		t.Errorf("/page got x-cache %q after %d upstream requests, want a hit for /Page", rec.Header().Get("x-cache"), n)
+	}
+}
+
+func TestNormalizePath(t *testing.T) {
+	parseTestFlags(t, "--normalize-path")
+	for _, target := range []string{"/a/b", "/a//b", "/a/./b", "/a/x/../b", "//a///b", "/../a/b", "/a/../../../a/b"} {
+		if got := keyURI(httptest.NewRequest(http.MethodGet, target, nil)); got != "/a/b" {
+			t.Errorf("keyURI(%v) = %v, want /a/b", target, got)
+		}
+	}
+	for target, want := range map[string]string{"/a/b/": "/a/b/", "/a//b//": "/a/b/", "/..": "/", "/a/?q=//": "/a/?q=//"} {
+		if got := keyURI(httptest.NewRequest(http.MethodGet, target, nil)); got != want {
+			t.Errorf("keyURI(%v) = %v, want %v", target, got, want)
+		}
+	}
+	r := httptest.NewRequest(http.MethodGet, "/a//b", nil)
+	keyURI(r)
+	if r.URL.Path != "/a//b" {
+		t.Errorf("request path changed to %v, want the path forwarded as requested", r.URL.Path)
+	}
+
+	var n int32
+	h := newTestHandler(t, newTestConfig(t, newTestUpstream(t, &n), "--normalize-path"))
+	if rec := get(h, "/a//b"); rec.Body.String() != "path=/a//b" {
+		t.Errorf("upstream got %q, want the path as requested", rec.Body.String())
+	}
+	for _, target := range []string{"/a/b", "/a/./b", "/a/x/../b"} {
+		if rec := get(h, target); rec.Header().Get("x-cache") != CacheHit {
+			t.Errorf("%v got x-cache %q, want a hit for /a//b", target, rec.Header().Get("x-cache"))
+		}
+	}
+	if n != 1 {
+		t.Errorf("upstream got %d requests, want 1", n)
+	}
+}
+
+func TestHTTP10CacheHit(t *testing.T) {
+	parseTestFlags(t)
+	c := NewFsCache(t.TempDir())
+	transport := &CachedTransport{cache: c}
+	legacy := func(target string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r.Proto, r.ProtoMajor, r.ProtoMinor = "HTTP/1.0", 1, 0
+		return r
+	}
+	r := legacy("/legacy")
+	h := http.Header{"Content-Type": {"text/plain"}}
+	if err := c.Put(requestKey(r, keyURI(r)), io.NopCloser(strings.NewReader("path=/legacy")), h); err != nil {
+		t.Fatal(err)
+	}
+	w, err := transport.RoundTrip(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Header.Get("x-cache") != CacheHit {
+		t.Fatalf("got x-cache %q, want a hit", w.Header.Get("x-cache"))
+	}
+	var buf bytes.Buffer
+	if err := w.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(&buf), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if resp.ProtoMinor != 0 || len(resp.TransferEncoding) > 0 {
+		t.Errorf("got %v with transfer encoding %v, want plain HTTP/1.0", resp.Proto, resp.TransferEncoding)
+	}
+	if resp.ContentLength != int64(len(body)) || string(body) != "path=/legacy" {
+		t.Errorf("got %q with Content-Length %d", body, resp.ContentLength)
+	}
+
+	setOffline(true)
+	t.Cleanup(func() { setOffline(false) })
+	if w, err := transport.RoundTrip(legacy("/missing")); err != nil || w.ProtoMinor != 0 || w.ContentLength <= 0 {
+		t.Errorf("offline miss got %v, %v, want a delimited HTTP/1.0 response", w, err)
+	}
+}
+
+// streamingCache hides the io.Seeker of the wrapped cache blobs, so hits
+// are served by the transport instead of http.ServeContent.
+type streamingCache struct {
+	CacheManager
+}
+
+func (c streamingCache) Get(key string) (io.ReadCloser, http.Header, error) {
+	blob, h, err := c.CacheManager.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return struct{ io.ReadCloser }{blob}, h, nil
+}
+
+func TestHTTP10Clients(t *testing.T) {
+	var n int32
+	u := newTestUpstream(t, &n)
+	for name, cache := range map[string]CacheManager{
+		"seekable":  NewFsCache(t.TempDir()),
+		"streaming": streamingCache{NewFsCache(t.TempDir())},
+	} {
+		cfg := newTestConfig(t, u)
+		cfg.Cache = cache
+		srv := httptest.NewServer(newTestHandler(t, cfg))
+		for i, want := range []string{"", CacheHit} {
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.WriteString(conn, "GET /legacy HTTP/1.0\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("%v request %d: %v", name, i, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			conn.Close()
+			if got := resp.Header.Get("x-cache"); got != want {
+				t.Fatalf("%v request %d: x-cache = %q, want %q", name, i, got, want)
+			}
+			if want != CacheHit {
+				continue
+			}
+			if resp.ProtoMinor != 0 || len(resp.TransferEncoding) > 0 {
+				t.Errorf("%v hit: got %v with transfer encoding %v, want plain HTTP/1.0", name, resp.Proto, resp.TransferEncoding)
+			}
+			if resp.ContentLength != int64(len(body)) || string(body) != "path=/legacy" {
+				t.Errorf("%v hit: got %q with Content-Length %d", name, body, resp.ContentLength)
+			}
+		}
+		srv.Close()
+	}
+}
+
+func TestUpstreamInflightUntilBodyClosed(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first,")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, " last")
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	proxy := httptest.NewServer(newTestHandler(t, newTestConfig(t, u)))
+	defer proxy.Close()
+
+	before := upstreamInflight.Value()
+	resp, err := http.Get(proxy.URL + "/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.Body.Read(make([]byte, 16)); err != nil {
+		t.Fatal(err)
+	}
+	if got := upstreamInflight.Value() - before; got != 1 {
+		t.Errorf("got %d fetches in flight while reading the body, want 1", got)
+	}
+	close(release)
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	for i := 0; upstreamInflight.Value() != before && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := upstreamInflight.Value() - before; got != 0 {
+		t.Errorf("got %d fetches in flight after the body was read, want 0", got)
+	}
+}
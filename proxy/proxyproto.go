@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// proxyHeaderTimeout bounds the time a client has to send its PROXY
+// protocol header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// proxyV2Signature starts the binary PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// acceptProxyProtocol returns l reading a PROXY protocol v1 or v2 header
+// on the connections it accepts, which then report the client address in
+// the header as their RemoteAddr. With --trusted-proxy, only connections
+// from those addresses are expected to send it.
+func acceptProxyProtocol(l net.Listener) net.Listener {
+	return &proxyProtocolListener{Listener: l}
+}
+
+type proxyProtocolListener struct {
+	net.Listener
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtocolConn{Conn: c}, nil
+}
+
+// proxyProtocolConn reads the PROXY protocol header of its connection on
+// first use, outside of the accept loop, so slow clients do not hold up
+// the others.
+type proxyProtocolConn struct {
+	net.Conn
+
+	once   sync.Once
+	r      io.Reader
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyProtocolConn) init() {
+	c.once.Do(func() {
+		c.r, c.remote = c.Conn, c.Conn.RemoteAddr()
+		peer, _, err := net.SplitHostPort(c.remote.String())
+		if err != nil {
+			peer = c.remote.String()
+		}
+		if len(conf.TrustedProxies) > 0 && !conf.TrustedProxies.Contains(peer) {
+			return
+		}
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		br := bufio.NewReader(c.Conn)
+		addr, err := readProxyHeader(br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			log.Printf("[proxyproto] Closing connection from %v: %v", peer, err)
+			c.err = err
+			c.Conn.Close()
+			return
+		}
+		c.r = br
+		if addr != nil {
+			c.remote = addr
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remote
+}
+
+// readProxyHeader reads a PROXY protocol header from r, returning the
+// client address it holds, or nil for health checks of the balancer
+// itself.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case proxyV2Signature[0]:
+		return readProxyHeaderV2(r)
+	}
+	return nil, errors.New("missing PROXY protocol header")
+}
+
+// readProxyHeaderV1 reads the text header, such as
+// "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	// The header is at most 107 bytes long
+	for len(line) < 107 {
+		c, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY protocol v1 header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[0] == "PROXY" && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || fields[0] != "PROXY" || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", strings.TrimSpace(string(line)))
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 source %v:%v", fields[2], fields[4])
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyHeaderV2 reads the binary header.
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) || hdr[12]>>4 != 2 {
+		return nil, errors.New("invalid PROXY protocol v2 header")
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	// LOCAL connections come from the balancer itself
+	if hdr[12]&0xf == 0 {
+		return nil, nil
+	}
+	switch family := hdr[13]; {
+	case family == 0x11 && len(body) >= 12:
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+	case family == 0x21 && len(body) >= 36:
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+	case family>>4 == 0:
+		// Unspecified families keep the address of the peer
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported PROXY protocol v2 address family %#x", hdr[13])
+}
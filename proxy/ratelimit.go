@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// setRateLimit sets --rate-limit from v, a number of requests per second
+// or minute, as in 100r/s or 600r/m. The unit defaults to seconds.
+func (c *Config) setRateLimit(v string) error {
+	n, per := v, time.Second
+	if i := strings.Index(v, "r/"); i >= 0 {
+		switch v[i+2:] {
+		case "s":
+		case "m":
+			per = time.Minute
+		default:
+			return fmt.Errorf("invalid unit in %q, use r/s or r/m", v)
+		}
+		n = v[:i]
+	}
+	rate, err := strconv.ParseFloat(n, 64)
+	if err != nil || rate < 0 {
+		return fmt.Errorf("invalid rate %q", v)
+	}
+	c.RateLimit = rate / per.Seconds()
+	return nil
+}
+
+// rateLimiter allows each client IP address rate requests per second on
+// average, in bursts of up to burst requests, using token buckets.
+type rateLimiter struct {
+	rate, burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst <= 0 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket), swept: time.Now()}
+}
+
+// Allow takes a token from the bucket of ip. When it is empty, it returns
+// how long until the next token is available.
+func (l *rateLimiter) Allow(ip string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return time.Duration((1 - b.tokens) / l.rate * float64(time.Second)), false
+	}
+	b.tokens--
+	return 0, true
+}
+
+// sweep drops the buckets refilled by now, at most once a minute, as they
+// are the same as new ones.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// Wrap returns next rejecting requests over the limit with 429.
+func (l *rateLimiter) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if wait, ok := l.Allow(ip, time.Now()); !ok {
+			rateLimited.Inc()
+			debugf("[ratelimit] Rejecting request from %v: rate limit reached", ip)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "429 Too Many Requests: rate limit reached", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ipNets implements flag.Value, parsing repeated, or comma-separated, IP
+// addresses or CIDR ranges.
+type ipNets []*net.IPNet
+
+func (n *ipNets) String() string {
+	if n == nil {
+		return ""
+	}
+	var s []string
+	for _, ipnet := range *n {
+		s = append(s, ipnet.String())
+	}
+	return strings.Join(s, ",")
+}
+
+func (n *ipNets) Set(v string) error {
+	for _, v := range strings.Split(v, ",") {
+		if err := n.add(strings.TrimSpace(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add appends the IP address or CIDR range v.
+func (n *ipNets) add(v string) error {
+	if !strings.Contains(v, "/") {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address %q", v)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		*n = append(*n, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	_, ipnet, err := net.ParseCIDR(v)
+	if err != nil {
+		return fmt.Errorf("invalid CIDR range %q", v)
+	}
+	*n = append(*n, ipnet)
+	return nil
+}
+
+// Contains reports whether the IP address ip is in any of the ranges.
+func (n ipNets) Contains(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, ipnet := range n {
+		if ipnet.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP address of the client of r. Requests from
+// --trusted-proxy addresses are attributed to the last address before them
+// in X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	if !conf.TrustedProxies.Contains(ip) {
+		return ip
+	}
+	forwarded := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := strings.TrimSpace(forwarded[i])
+		if net.ParseIP(addr) == nil {
+			break
+		}
+		if ip = addr; !conf.TrustedProxies.Contains(ip) {
+			break
+		}
+	}
+	return ip
+}
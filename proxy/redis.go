@@ -0,0 +1,438 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisCache stores entries in Redis, so several replicas share the same
+// cache. Each entry is a hash holding its headers and body, written at
+// once. Entries expire in Redis once past their stale windows, unless they
+// may be revalidated, and memory is bounded by the Redis maxmemory policy,
+// e.g. allkeys-lru.
+//
+// Bodies are held in memory while stored and served, so only those up to
+// maxObject are cached.
+type redisCache struct {
+	addr      string
+	password  string
+	db        int
+	maxObject int64
+
+	pool chan *redisConn
+}
+
+// Ensures we implement CacheManager interface
+var _ CacheManager = &redisCache{}
+
+var errTooLarge = errors.New("entry is too large for the cache backend")
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// newRedisCache returns a cache using the server at rawURL, as in
+// redis://:password@host:6379/db.
+func newRedisCache(rawURL string, maxObject int64) (*redisCache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q: use redis://[:password@]host:port[/db]", rawURL)
+	}
+	c := &redisCache{addr: u.Host, maxObject: maxObject, pool: make(chan *redisConn, 16)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Host, "6379")
+	}
+	if u.User != nil {
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// Check verifies that the server is reachable.
+func (c *redisCache) Check() error {
+	_, err := c.do("PING")
+	return err
+}
+
+func (c *redisCache) Put(key string, blob io.ReadCloser, h http.Header) error {
+	log.Printf("[redis] Storing key=%v", key)
+	body, err := io.ReadAll(io.LimitReader(blob, c.maxObject+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > c.maxObject {
+		log.Printf("[redis] Not storing key=%v: larger than %v bytes", key, c.maxObject)
+		return errTooLarge
+	}
+	aux := h.Clone()
+	removeHopHeaders(aux)
+	hb, err := json.Marshal(aux)
+	if err != nil {
+		return err
+	}
+	stored := strconv.FormatInt(time.Now().Unix(), 10)
+	if _, err := c.do("EVAL", storeScript, "1", key, hb, body, stored, redisTTL(key, aux)); err != nil {
+		log.Printf("[redis] error storing key=%v: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+// Get returns the cached blob in memory, so it can be seeked on.
+func (c *redisCache) Get(key string) (blob io.ReadCloser, h http.Header, err error) {
+	reply, err := c.do("HMGET", key, "headers", "body")
+	if err != nil {
+		log.Printf("[redis] error reading key=%v: %v", key, err)
+		return nil, nil, err
+	}
+	fields, _ := reply.([]interface{})
+	if len(fields) != 2 || fields[0] == nil || fields[1] == nil {
+		return nil, nil, os.ErrNotExist
+	}
+	hb, _ := fields[0].([]byte)
+	body, _ := fields[1].([]byte)
+	h = make(http.Header)
+	if err = json.Unmarshal(hb, &h); err != nil {
+		log.Printf("[redis] error decoding headers: %v", err)
+		return nil, nil, err
+	}
+	switch err = checkExpiry(key, h); err {
+	case nil:
+	case errExpired:
+		events.Emit(eventEvict, key, "", int64(len(body)))
+		c.do("DEL", key)
+		return nil, nil, err
+	default:
+		return nil, nil, err
+	}
+	h.Set("content-length", strconv.Itoa(len(body)))
+	h.Del(mustRevalidateHeader)
+	h.Del(uriHeader)
+	log.Printf("[redis] Cache hit!")
+	return memBlob{bytes.NewReader(body)}, h, nil
+}
+
+// Flush removes the entry stored at key, returning an error satisfying
+// os.IsNotExist if there is none.
+func (c *redisCache) Flush(key string) error {
+	n, err := c.do("DEL", key)
+	if err != nil {
+		return err
+	}
+	if n == int64(0) {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// Scripts storing entries set their expiry from the last argument, in
+// milliseconds, as returned by redisTTL.
+const (
+	expireScript = `if ARGV[#ARGV] == "0" then redis.call("PERSIST", KEYS[1]) else redis.call("PEXPIRE", KEYS[1], ARGV[#ARGV]) end `
+	// storeScript writes the headers, body and store time of an entry.
+	storeScript = `redis.call("HSET", KEYS[1], "headers", ARGV[1], "body", ARGV[2], "stored", ARGV[3]) ` + expireScript + `return 1`
+	// updateHeadersScript replaces the headers of an entry, unless it
+	// was removed meanwhile.
+	updateHeadersScript = `if redis.call("EXISTS", KEYS[1]) == 0 then return -1 end redis.call("HSET", KEYS[1], "headers", ARGV[1]) ` + expireScript + `return 1`
+)
+
+// redisTTL returns the milliseconds the entry at key with headers h is kept
+// for, until evictAfter, or "0" to keep it until the maxmemory policy
+// evicts it.
+func redisTTL(key string, h http.Header) string {
+	t, ok := evictAfter(h)
+	if !ok || pins.Has(key, h.Get(uriHeader)) {
+		return "0"
+	}
+	ms := time.Until(t).Milliseconds()
+	if ms < 1 {
+		ms = 1
+	}
+	return strconv.FormatInt(ms, 10)
+}
+
+// UpdateHeaders replaces the stored headers of key by the result of
+// update, leaving the body untouched.
+func (c *redisCache) UpdateHeaders(key string, update func(h http.Header)) error {
+	reply, err := c.do("HGET", key, "headers")
+	if err != nil {
+		return err
+	}
+	hb, ok := reply.([]byte)
+	if !ok {
+		return os.ErrNotExist
+	}
+	h := make(http.Header)
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return err
+	}
+	update(h)
+	if hb, err = json.Marshal(h); err != nil {
+		return err
+	}
+	n, err := c.do("EVAL", updateHeadersScript, "1", key, hb, redisTTL(key, h))
+	if err == nil && n == int64(-1) {
+		err = os.ErrNotExist
+	}
+	return err
+}
+
+// FlushTenant removes all entries stored for tenant.
+func (c *redisCache) FlushTenant(tenant string) error {
+	match := globEscape(tenantDir(tenant)) + "/*"
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "MATCH", match, "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		page, _ := reply.([]interface{})
+		if len(page) != 2 {
+			return errors.New("redis: unexpected SCAN reply")
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		if len(keys) > 0 {
+			if _, err := c.do(append([]interface{}{"DEL"}, keys...)...); err != nil {
+				return err
+			}
+		}
+		if cursor = string(next); cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// Entries scans the database, skipping keys other than cache entries.
+func (c *redisCache) Entries(fn func(e cacheEntry) error) error {
+	cursor := "0"
+	for {
+		reply, err := c.do("SCAN", cursor, "COUNT", "1000")
+		if err != nil {
+			return err
+		}
+		page, _ := reply.([]interface{})
+		if len(page) != 2 {
+			return errors.New("redis: unexpected SCAN reply")
+		}
+		next, _ := page[0].([]byte)
+		keys, _ := page[1].([]interface{})
+		for _, k := range keys {
+			key, _ := k.([]byte)
+			e, ok := c.entry(string(key))
+			if !ok {
+				continue
+			}
+			if err := fn(e); err == errStopListing {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if cursor = string(next); cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// entry describes the entry at key, if it is one.
+func (c *redisCache) entry(key string) (cacheEntry, bool) {
+	reply, err := c.do("HMGET", key, "headers", "stored")
+	fields, _ := reply.([]interface{})
+	if err != nil || len(fields) != 2 || fields[0] == nil {
+		return cacheEntry{}, false
+	}
+	h := make(http.Header)
+	if err := json.Unmarshal(fields[0].([]byte), &h); err != nil {
+		return cacheEntry{}, false
+	}
+	size, err := c.do("HSTRLEN", key, "body")
+	if err != nil {
+		return cacheEntry{}, false
+	}
+	var stored time.Time
+	if b, ok := fields[1].([]byte); ok {
+		if sec, err := strconv.ParseInt(string(b), 10, 64); err == nil {
+			stored = time.Unix(sec, 0)
+		}
+	}
+	n, _ := size.(int64)
+	return newCacheEntry(key, h, n, stored), true
+}
+
+// URI returns the URI of the entry stored at key.
+func (c *redisCache) URI(key string) (string, error) {
+	if !validKey(key) {
+		return "", errInvalidKey
+	}
+	reply, err := c.do("HGET", key, "headers")
+	if err != nil {
+		return "", err
+	}
+	hb, ok := reply.([]byte)
+	if !ok {
+		return "", os.ErrNotExist
+	}
+	h := make(http.Header)
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return "", err
+	}
+	if uri := h.Get(uriHeader); uri != "" {
+		return uri, nil
+	}
+	return "", errors.New("entry was stored without its URI")
+}
+
+// globEscape quotes the Redis glob metacharacters in s.
+func globEscape(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`*?[]\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// redisConn is a connection to the server, speaking RESP.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// do sends a command, with string or []byte arguments, returning its reply:
+// a string, an int64, a []byte (nil if missing) or a []interface{} of
+// those. Connections are reused unless they failed.
+func (c *redisCache) do(args ...interface{}) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-c.pool:
+	default:
+		var err error
+		if conn, err = c.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := conn.do(args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.pool <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisCache) dial() (*redisConn, error) {
+	nc, err := net.DialTimeout("tcp", c.addr, conf.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc), w: bufio.NewWriter(nc)}
+	if c.password != "" {
+		if _, err := conn.do("AUTH", c.password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (conn *redisConn) do(args ...interface{}) (interface{}, error) {
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+	fmt.Fprintf(conn.w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var b []byte
+		switch v := arg.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		default:
+			return nil, fmt.Errorf("redis: invalid argument type %T", arg)
+		}
+		fmt.Fprintf(conn.w, "$%d\r\n", len(b))
+		conn.w.Write(b)
+		conn.w.WriteString("\r\n")
+	}
+	if err := conn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return conn.read()
+}
+
+func (conn *redisConn) read() (interface{}, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("redis: invalid reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = conn.read(); err != nil {
+				if _, ok := err.(redisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply type %q", kind)
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newFakeRedis returns a cache talking RESP over a pipe to a server
+// answering each command, given with its arguments, with the raw reply
+// returned by reply. Commands are sent one at a time, on one connection.
+func newFakeRedis(t *testing.T, reply func(args []string) string) *redisCache {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			args, err := readRedisCommand(r)
+			if err != nil {
+				return
+			}
+			if _, err := io.WriteString(server, reply(args)); err != nil {
+				return
+			}
+		}
+	}()
+	c := &redisCache{maxObject: 1 << 20, pool: make(chan *redisConn, 1)}
+	c.pool <- &redisConn{Conn: client, r: bufio.NewReader(client), w: bufio.NewWriter(client)}
+	return c
+}
+
+// readRedisCommand reads a command, sent as an array of bulk strings.
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	readLen := func(prefix byte) (int, error) {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return 0, err
+		}
+		if line[0] != prefix || !strings.HasSuffix(line, "\r\n") {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return strconv.Atoi(line[1 : len(line)-2])
+	}
+	n, err := readLen('*')
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readLen('$')
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func TestRedisReplies(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  interface{}
+		err   error
+	}{
+		{"+OK\r\n", "OK", nil},
+		{":42\r\n", int64(42), nil},
+		{"$5\r\nhello\r\n", []byte("hello"), nil},
+		{"$0\r\n\r\n", []byte{}, nil},
+		{"$-1\r\n", nil, nil},
+		// The connection is kept after error replies
+		{"-ERR unknown command\r\n", nil, redisError("ERR unknown command")},
+		{"*3\r\n$1\r\na\r\n$-1\r\n:1\r\n", []interface{}{[]byte("a"), nil, int64(1)}, nil},
+		{"*2\r\n*1\r\n+x\r\n-ERR in array\r\n", []interface{}{[]interface{}{"x"}, nil}, nil},
+		{"*0\r\n", []interface{}{}, nil},
+	}
+	i := 0
+	c := newFakeRedis(t, func(args []string) string {
+		if len(args) != 2 || args[0] != "ECHO" || args[1] != strconv.Itoa(i) {
+			t.Errorf("reply %d: got command %q", i, args)
+		}
+		i++
+		return tests[i-1].reply
+	})
+	for n, tc := range tests {
+		got, err := c.do("ECHO", strconv.Itoa(n))
+		if err != tc.err || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %#v, %v, want %#v, %v", tc.reply, got, err, tc.want, tc.err)
+		}
+	}
+}
+
+func TestRedisCacheExpiry(t *testing.T) {
+	parseTestFlags(t)
+	var ttls []string
+	c := newFakeRedis(t, func(args []string) string {
+		switch {
+		case args[0] == "EVAL" && args[1] == storeScript:
+			if len(args) != 8 || args[3] != "key" || args[5] != "body" {
+				t.Errorf("stored with %q", args)
+			}
+			ttls = append(ttls, args[len(args)-1])
+			return ":1\r\n"
+		case args[0] == "HMGET" && args[1] == "key":
+			h := `{"Content-Type":["text/plain"]}`
+			return "*2\r\n$" + strconv.Itoa(len(h)) + "\r\n" + h + "\r\n$4\r\nbody\r\n"
+		case args[0] == "HMGET":
+			return "*2\r\n$-1\r\n$-1\r\n"
+		}
+		t.Errorf("unexpected command %q", args)
+		return "-ERR unexpected\r\n"
+	})
+
+	expires := time.Now().Add(time.Minute).UTC().Format(http.TimeFormat)
+	for _, h := range []http.Header{
+		{expiresHeader: {expires}},
+		{expiresHeader: {expires}, staleWhileRevalidateHeader: {"60"}},
+		{expiresHeader: {expires}, "Etag": {`"v1"`}},
+		{},
+	} {
+		if err := c.Put("key", io.NopCloser(strings.NewReader("body")), h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ttls) != 4 {
+		t.Fatalf("stored %d entries, want 4", len(ttls))
+	}
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute} {
+		ms, _ := strconv.ParseInt(ttls[i], 10, 64)
+		if got := time.Duration(ms) * time.Millisecond; got <= want-2*time.Second || got > want {
+			t.Errorf("entry %d expires in %v, want %v", i, got, want)
+		}
+	}
+	if ttls[2] != "0" || ttls[3] != "0" {
+		t.Errorf("entries with validators or without expiry have TTLs %v and %v, want none", ttls[2], ttls[3])
+	}
+
+	blob, h, err := c.Get("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(blob)
+	if string(body) != "body" || h.Get("Content-Type") != "text/plain" || h.Get("Content-Length") != "4" {
+		t.Errorf("got %q with headers %v", body, h)
+	}
+	if _, _, err := c.Get("missing"); !os.IsNotExist(err) {
+		t.Errorf("missing entry got %v, want not exist", err)
+	}
+}
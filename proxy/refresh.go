@@ -0,0 +1,37 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+)
+
+// withRefreshToken returns r marked to skip the cache lookup, so its entry
+// is fetched again and replaced, if it carries the --refresh-header with
+// the --refresh-token. The header is never sent upstream.
+func withRefreshToken(r *http.Request) *http.Request {
+	token := r.Header.Get(conf.RefreshHeader)
+	if token == "" {
+		return r
+	}
+	r.Header.Del(conf.RefreshHeader)
+	if !secureCompare(token, conf.RefreshToken) {
+		log.Printf("[handler] Ignoring invalid %v from %v", conf.RefreshHeader, clientIP(r))
+		return r
+	}
+	log.Printf("[handler] Refreshing '%v' as requested by %v", keyURI(r), clientIP(r))
+	return r.WithContext(context.WithValue(r.Context(), refreshKey, true))
+}
+
+// clientNoCache reports whether, with --honor-client-no-cache, the client
+// of r asks for its cached entry to be revalidated upstream first, with
+// Cache-Control: no-cache, or Pragma: no-cache from HTTP/1.0 clients.
+func clientNoCache(r *http.Request) bool {
+	if !conf.HonorClientNoCache {
+		return false
+	}
+	if r.Header.Get("Cache-Control") == "" {
+		return hasPragmaNoCache(r.Header)
+	}
+	return hasCacheDirective(r.Header, "no-cache")
+}
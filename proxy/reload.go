@@ -0,0 +1,275 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+const (
+	// listenFdsEnv lists the addresses of the listeners passed to workers,
+	// one per line, as file descriptors from 3 on, followed by the one to
+	// report readiness on.
+	listenFdsEnv = "SIMPLEPROXY_LISTEN_FDS"
+	// reloadedEnv is set for workers replacing another one, still running.
+	reloadedEnv = "SIMPLEPROXY_RELOADED"
+)
+
+// With --config, simpleproxy runs as a supervisor holding the listeners,
+// and serves requests from a worker process inheriting them. On SIGHUP, a
+// new worker is started with the reloaded configuration, and once it is
+// ready, the previous one drains its requests as on SIGTERM, so no
+// connection is dropped. If the new worker fails to start, the previous one
+// keeps running.
+type supervisor struct {
+	path      string
+	listeners map[string]net.Listener
+	current   *worker
+	draining  []*worker
+}
+
+// worker is a process serving requests for the supervisor.
+type worker struct {
+	cmd  *exec.Cmd
+	done chan struct{} // closed once it exits
+	err  error
+}
+
+// supervise runs the supervisor with the configuration at path, returning
+// only once the worker exited.
+func supervise(path string) {
+	s := &supervisor{path: path, listeners: make(map[string]net.Listener)}
+	if err := s.start(false); err != nil {
+		log.Fatalf("[supervisor] Error starting: %v", err)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, os.Interrupt, syscall.SIGTERM)
+	for {
+		select {
+		case sg := <-sig:
+			if sg == syscall.SIGHUP {
+				log.Printf("[supervisor] Received %v, reloading %v", sg, path)
+				if err := s.start(true); err != nil {
+					log.Printf("[supervisor] Reload failed, keeping the current configuration: %v", err)
+				}
+				continue
+			}
+			log.Printf("[supervisor] Received %v, stopping workers", sg)
+			for _, w := range append(s.draining, s.current) {
+				w.cmd.Process.Signal(syscall.SIGTERM)
+			}
+			for _, w := range s.draining {
+				<-w.done
+			}
+			<-s.current.done
+			os.Exit(s.current.cmd.ProcessState.ExitCode())
+		case <-s.current.done:
+			log.Fatalf("[supervisor] Worker exited unexpectedly: %v", s.current.err)
+		}
+	}
+}
+
+// start reads the configuration, opening the listeners it needs, and
+// starts a worker with them. Once it is ready, the current worker, if any,
+// is stopped, and listeners no longer used are closed.
+func (s *supervisor) start(reload bool) error {
+	entries, err := readConfig(s.path)
+	if err != nil {
+		return err
+	}
+	addrs, err := supervisedAddrs(entries)
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, addr := range addrs {
+		l, ok := s.listeners[addr]
+		if !ok {
+			if l, err = listen(addr); err != nil {
+				s.closeUnused(nil)
+				return err
+			}
+			s.listeners[addr] = l
+		}
+		f, err := l.(interface{ File() (*os.File, error) }).File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), listenFdsEnv+"="+strings.Join(addrs, "\n"))
+	if reload {
+		cmd.Env = append(cmd.Env, reloadedEnv+"=1")
+	}
+	cmd.ExtraFiles = append(files, readyW)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		s.closeUnused(addrs)
+		return err
+	}
+	w := &worker{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		w.err = cmd.Wait()
+		close(w.done)
+	}()
+	// Reads nothing if the worker exits first
+	if n, _ := ready.Read(make([]byte, 1)); n == 0 {
+		<-w.done
+		s.closeUnused(nil)
+		return fmt.Errorf("worker exited before serving: %v", w.err)
+	}
+	log.Printf("[supervisor] Worker %d is serving", cmd.Process.Pid)
+
+	if old := s.current; old != nil {
+		log.Printf("[supervisor] Stopping worker %d", old.cmd.Process.Pid)
+		old.cmd.Process.Signal(syscall.SIGTERM)
+		s.draining = append(s.draining, old)
+		go func() {
+			<-old.done
+			log.Printf("[supervisor] Worker %d exited", old.cmd.Process.Pid)
+		}()
+	}
+	s.current = w
+	s.closeUnused(addrs)
+	return nil
+}
+
+// closeUnused closes the listeners neither in addrs nor used by the current
+// worker.
+func (s *supervisor) closeUnused(addrs []string) {
+	used := make(map[string]bool)
+	for _, addr := range addrs {
+		used[addr] = true
+	}
+	if s.current != nil {
+		for _, addr := range strings.Split(envValue(s.current.cmd.Env, listenFdsEnv), "\n") {
+			used[addr] = true
+		}
+	}
+	for addr, l := range s.listeners {
+		if !used[addr] {
+			l.Close()
+			delete(s.listeners, addr)
+		}
+	}
+}
+
+// envValue returns the value of name in env, as in os.Getenv.
+func envValue(env []string, name string) string {
+	for i := len(env) - 1; i >= 0; i-- {
+		if strings.HasPrefix(env[i], name+"=") {
+			return env[i][len(name)+1:]
+		}
+	}
+	return ""
+}
+
+// supervisedAddrs returns the addresses of the listeners of a worker with
+// the configuration in entries, as the worker opens them: --listen,
+// --http-redirect, --admin-addr and --metrics-addr.
+func supervisedAddrs(entries []configEntry) ([]string, error) {
+	listens := []string(conf.Listen)
+	if !cmdlineFlags()["listen"] {
+		listens = nil
+		for _, v := range configValues(entries, "listen") {
+			addr, err := normalizeListenAddr(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid listen address %q: %v", v, err)
+			}
+			listens = append(listens, addr)
+		}
+	}
+	if len(listens) == 0 {
+		listens = []string{":8080"}
+		if len(configValues(entries, "tls-cert")) > 0 {
+			listens = []string{":443"}
+		}
+	}
+	addrs := append([]string(nil), listens...)
+	for _, v := range configValues(entries, "http-redirect") {
+		addr, err := normalizeListenAddr(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid http-redirect address %q: %v", v, err)
+		}
+		addrs = append(addrs, addr)
+	}
+	addrs = append(addrs, configValues(entries, "admin-addr")...)
+	addrs = append(addrs, configValues(entries, "metrics-addr")...)
+	seen := make(map[string]bool)
+	unique := addrs[:0]
+	for _, addr := range addrs {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			unique = append(unique, addr)
+		}
+	}
+	return unique, nil
+}
+
+// inherited holds the listeners passed by the supervisor, by address, used
+// by listen instead of opening new ones.
+var inherited map[string]net.Listener
+
+// readyPipe reports to the supervisor that the worker is serving.
+var readyPipe *os.File
+
+// inheritListeners takes the listeners passed by the supervisor, if any.
+// Workers ignore SIGHUP, handled by the supervisor.
+func inheritListeners() error {
+	v, ok := os.LookupEnv(listenFdsEnv)
+	if !ok {
+		return nil
+	}
+	signal.Ignore(syscall.SIGHUP)
+	addrs := strings.Split(v, "\n")
+	inherited = make(map[string]net.Listener)
+	for i, addr := range addrs {
+		f := os.NewFile(uintptr(3+i), addr)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("inheriting listener %v: %v", addr, err)
+		}
+		inherited[addr] = l
+	}
+	readyPipe = os.NewFile(uintptr(3+len(addrs)), "ready")
+	if readyPipe == nil {
+		return errors.New("missing readiness pipe")
+	}
+	return nil
+}
+
+// notifyReady tells the supervisor that the worker is serving, so the
+// previous one can be stopped.
+func notifyReady() {
+	if readyPipe == nil {
+		return
+	}
+	readyPipe.Write([]byte{1})
+	readyPipe.Close()
+	readyPipe = nil
+}
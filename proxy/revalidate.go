@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// mustRevalidateHeader is stored along with the cached headers of
+// responses with the must-revalidate or proxy-revalidate directives. It is
+// never sent to clients.
+const mustRevalidateHeader = "X-Simpleproxy-Must-Revalidate"
+
+// revalidateHeader is set by caches on entries returned past their
+// expiration, which must be revalidated with a conditional request before
+// being served. It is never stored.
+const revalidateHeader = "X-Simpleproxy-Revalidate"
+
+const (
+	// revalidateMust marks entries that cannot be served stale when
+	// revalidation fails.
+	revalidateMust = "must"
+	// revalidateMay marks entries served stale when revalidation fails.
+	revalidateMay = "may"
+	// revalidateOnError marks entries also served stale when upstream
+	// returns a 5xx status, with --serve-stale-on-error or stale-if-error.
+	revalidateOnError = "error"
+)
+
+// errMustRevalidate is returned for expired entries that cannot be served
+// stale, and must be fetched again from upstream.
+var errMustRevalidate = errors.New("cache entry expired and must be revalidated")
+
+// hasCacheDirective reports whether the Cache-Control header in h has any
+// of the given directives.
+func hasCacheDirective(h http.Header, directives ...string) bool {
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			name := strings.TrimSpace(d)
+			if i := strings.Index(name, "="); i >= 0 {
+				name = strings.TrimSpace(name[:i])
+			}
+			for _, directive := range directives {
+				if strings.EqualFold(name, directive) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// revalidationFailed is the response for expired must-revalidate entries
+// that could not be fetched again, since they must never be served stale.
+func revalidationFailed(r *http.Request) *http.Response {
+	return gatewayTimeout(r, "cache entry must be revalidated and upstream is unavailable")
+}
+
+// hasValidators reports whether the cached headers h allow a conditional
+// request.
+func hasValidators(h http.Header) bool {
+	return h.Get("ETag") != "" || h.Get("Last-Modified") != ""
+}
+
+// needsRevalidation removes the revalidation mark from h, returning it.
+func needsRevalidation(h http.Header) string {
+	v := h.Get(revalidateHeader)
+	h.Del(revalidateHeader)
+	return v
+}
+
+// headerUpdater is implemented by caches that can update the headers of an
+// entry without rewriting its blob.
+type headerUpdater interface {
+	UpdateHeaders(key string, update func(h http.Header)) error
+}
+
+// revalidate sends a conditional request upstream for the expired entry of
+// r, with blob b and headers h. A 304 Not Modified response extends the
+// entry freshness and serves b, without downloading the body again; any
+// other response is returned to replace the entry. Entries without
+// validators are just fetched again.
+func (c *CachedTransport) revalidate(r *http.Request, key, uri string, b io.ReadCloser, h http.Header, mode string) (*http.Response, error) {
+	stale := func(err error) (*http.Response, error) {
+		if mode == revalidateMust {
+			b.Close()
+			return revalidationFailed(r), nil
+		}
+		log.Printf("[transport] Serving stale '%v': %v", uri, err)
+		isStale(h)
+		return cachedResponse(r, b, h, CacheStale), nil
+	}
+	if isOffline() {
+		return stale(errors.New("upstream is offline"))
+	}
+
+	req := r.Clone(r.Context())
+	req.Method = http.MethodGet
+	for _, k := range []string{"Range", "If-Range", "If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since"} {
+		req.Header.Del(k)
+	}
+	if etag := h.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lm := h.Get("Last-Modified"); lm != "" {
+		req.Header.Set("If-Modified-Since", lm)
+	}
+	debugf("[transport] Revalidating '%v'", uri)
+	w, err := c.fetch(req, uri)
+	if err != nil {
+		if r.Context().Err() != nil {
+			b.Close()
+			return nil, err
+		}
+		return stale(err)
+	}
+	if mode == revalidateOnError && w.StatusCode >= 500 {
+		w.Body.Close()
+		return stale(fmt.Errorf("upstream returned %v", w.Status))
+	}
+	if w.StatusCode != http.StatusNotModified {
+		// Changed: the new response replaces the entry
+		b.Close()
+		return w, nil
+	}
+	w.Body.Close()
+
+	// Not modified: refresh the stored headers and the expiration
+	for _, name := range conf.CacheHeaders {
+		if v := w.Header.Values(name); len(v) > 0 {
+			h[name] = append([]string(nil), v...)
+		}
+	}
+	ttl, expires, reason := responseTTL(&http.Response{Header: h, Request: req})
+	update := func(stored http.Header) {
+		for _, name := range conf.CacheHeaders {
+			if v := w.Header.Values(name); len(v) > 0 {
+				stored[name] = append([]string(nil), v...)
+			}
+		}
+		setStaleHeaders(stored, w.Header)
+		stored.Del(expiresHeader)
+		if expires {
+			stored.Set(expiresHeader, time.Now().Add(ttl).UTC().Format(http.TimeFormat))
+		}
+	}
+	if u, ok := c.cache.(headerUpdater); !ok || reason != "" {
+		// Cannot keep it fresh: served this time only
+		c.cache.Flush(key)
+	} else if err := u.UpdateHeaders(key, update); err != nil {
+		log.Printf("[transport] error updating '%v': %v", uri, err)
+	}
+	log.Printf("[transport] Revalidated '%v'", uri)
+	h.Del(expiresHeader)
+	return cachedResponse(r, b, h, CacheRevalidated), nil
+}
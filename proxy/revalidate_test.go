@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMustRevalidateEntries(t *testing.T) {
+	parseTestFlags(t, "--stale-grace=1h")
+	c := NewFsCache(t.TempDir())
+	expired := time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+	for key, must := range map[string]bool{"ordinary": false, "must": true} {
+		h := http.Header{expiresHeader: {expired}}
+		if must {
+			h.Set(mustRevalidateHeader, "1")
+		}
+		if err := c.Put(key, io.NopCloser(strings.NewReader("stored")), h); err != nil {
+			t.Fatal(err)
+		}
+		b, got, err := c.Get(key)
+		if must {
+			if !errors.Is(err, errMustRevalidate) {
+				t.Errorf("must-revalidate entry got %v, want %v", err, errMustRevalidate)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("ordinary entry got %v, want it served stale", err)
+		}
+		b.Close()
+		if got.Get(mustRevalidateHeader) != "" {
+			t.Errorf("%v sent to the client", mustRevalidateHeader)
+		}
+	}
+	if w := revalidationFailed(httptest.NewRequest(http.MethodGet, "/must", nil)); w.StatusCode != http.StatusGatewayTimeout {
+		t.Errorf("failed revalidation got %d, want 504", w.StatusCode)
+	}
+}
+
+func TestHasCacheDirective(t *testing.T) {
+	for v, want := range map[string]bool{
+		"must-revalidate":             true,
+		"max-age=60, Must-Revalidate": true,
+		"proxy-revalidate":            true,
+		"max-age=60":                  false,
+		"":                            false,
+	} {
+		h := http.Header{"Cache-Control": {v}}
+		if got := hasCacheDirective(h, "must-revalidate", "proxy-revalidate"); got != want {
+			t.Errorf("hasCacheDirective(%q) = %v, want %v", v, got, want)
+		}
+	}
+}
+
+// expiredCache stores every entry as already expired.
+type expiredCache struct {
+	CacheManager
+}
+
+func (c expiredCache) Put(key string, blob io.ReadCloser, h http.Header) error {
+	if h.Get(expiresHeader) != "" {
+		h.Set(expiresHeader, time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat))
+	}
+	return c.CacheManager.Put(key, blob, h)
+}
+
+func TestMustRevalidateOnError(t *testing.T) {
+	for _, tc := range []struct {
+		cacheControl string
+		etag         string
+		wantCode     int
+	}{
+		{"max-age=60", "", http.StatusOK},
+		{"max-age=60", `"v1"`, http.StatusOK},
+		{"max-age=60, must-revalidate", "", http.StatusGatewayTimeout},
+		{"max-age=60, must-revalidate", `"v1"`, http.StatusGatewayTimeout},
+		{"max-age=60, proxy-revalidate", "", http.StatusGatewayTimeout},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", tc.cacheControl)
+			if tc.etag != "" {
+				w.Header().Set("ETag", tc.etag)
+			}
+			w.Write([]byte("stored"))
+		}))
+		u, _ := url.Parse(srv.URL)
+		cfg := newTestConfig(t, u, "--serve-stale-on-error")
+		cfg.Cache = expiredCache{NewFsCache(t.TempDir())}
+		h := newTestHandler(t, cfg)
+		if rec := get(h, "/page"); rec.Code != http.StatusOK {
+			t.Fatalf("%v: first request got %d", tc.cacheControl, rec.Code)
+		}
+		srv.Close()
+		rec := get(h, "/page")
+		if rec.Code != tc.wantCode {
+			t.Errorf("%v with etag %v: got %d %q with upstream down, want %d", tc.cacheControl, tc.etag, rec.Code, rec.Body.String(), tc.wantCode)
+		}
+		if rec.Code == http.StatusOK && rec.Body.String() != "stored" {
+			t.Errorf("%v with etag %v: got %q, want the stale entry", tc.cacheControl, tc.etag, rec.Body.String())
+		}
+	}
+}
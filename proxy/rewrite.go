@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// pathRewriteRule replaces upstream request paths matching pattern.
+type pathRewriteRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// pathRewriteRules implements flag.Value, parsing repeated
+// PATTERN=>REPLACEMENT values.
+type pathRewriteRules []pathRewriteRule
+
+func (p *pathRewriteRules) String() string {
+	if p == nil {
+		return ""
+	}
+	var s []string
+	for _, r := range *p {
+		s = append(s, r.pattern.String()+"=>"+r.replacement)
+	}
+	return strings.Join(s, ",")
+}
+
+func (p *pathRewriteRules) Set(v string) error {
+	i := strings.Index(v, "=>")
+	if i < 0 {
+		return fmt.Errorf("missing replacement in %q, use PATTERN=>REPLACEMENT", v)
+	}
+	re, err := regexp.Compile(v[:i])
+	if err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", v[:i], err)
+	}
+	*p = append(*p, pathRewriteRule{pattern: re, replacement: v[i+2:]})
+	return nil
+}
+
+// rewritePath applies every --upstream-path-rewrite rule to the path of
+// the request sent upstream, in order.
+func rewritePath(r *http.Request) {
+	p := r.URL.Path
+	for _, rule := range conf.PathRewrites {
+		p = rule.pattern.ReplaceAllString(p, rule.replacement)
+	}
+	if p != r.URL.Path {
+		debugf("[rewrite] Rewriting path '%v' to '%v'", r.URL.Path, p)
+		r.URL.Path, r.URL.RawPath = p, ""
+	}
+}
+
+// keepKeyURI records the cache key URI of requests before they reach next,
+// so entries are stored under the public path even when the path sent
+// upstream is rewritten.
+func keepKeyURI(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(keyURIKey).(string); !ok {
+			r = r.WithContext(context.WithValue(r.Context(), keyURIKey, keyURI(r)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,479 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Cache stores entries in an S3 compatible bucket, such as Amazon S3,
+// or Google Cloud Storage with HMAC keys, suited for large and immutable
+// artifacts. Each entry is the body object at its key, and its headers in
+// a key.headers object, written last. Bodies are read lazily, so range
+// requests only download the bytes served.
+//
+// Requests are signed with AWS Signature Version 4, and objects addressed
+// by path: endpoint/bucket/prefix/key.
+type s3Cache struct {
+	endpoint *url.URL
+	bucket   string
+	prefix   string
+	region   string
+
+	accessKey    string
+	secretKey    string
+	sessionToken string
+
+	client *http.Client
+}
+
+// Ensures we implement CacheManager interface
+var _ CacheManager = &s3Cache{}
+
+// newS3Cache returns a cache storing objects under rawURL, as in
+// https://s3.us-east-1.amazonaws.com/bucket/prefix. Credentials default
+// to the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+// environment variables.
+func newS3Cache(rawURL, region, accessKey, secretKey string) (*s3Cache, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(strings.Trim(u.Path, "/"), "/", 2)
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || parts[0] == "" {
+		return nil, fmt.Errorf("invalid S3 URL %q: use https://endpoint/bucket[/prefix]", rawURL)
+	}
+	c := &s3Cache{
+		endpoint:     &url.URL{Scheme: u.Scheme, Host: u.Host},
+		bucket:       parts[0],
+		region:       region,
+		accessKey:    accessKey,
+		secretKey:    secretKey,
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{},
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		c.prefix = parts[1] + "/"
+	}
+	if c.accessKey == "" {
+		c.accessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if c.secretKey == "" {
+		c.secretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if c.accessKey == "" || c.secretKey == "" {
+		return nil, errors.New("missing S3 credentials: use --s3-access-key and --s3-secret-key")
+	}
+	return c, nil
+}
+
+// Check verifies that the bucket is reachable with the credentials.
+func (c *s3Cache) Check() error {
+	_, _, err := c.list("", "", 1)
+	return err
+}
+
+// Put uploads the blob from a temporary file, as the length of objects
+// must be known in advance, then its headers.
+func (c *s3Cache) Put(key string, blob io.ReadCloser, h http.Header) error {
+	log.Printf("[s3] Storing key=%v", key)
+	fd, err := os.CreateTemp("", "simpleproxy-s3-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+	size, err := io.Copy(fd, blob)
+	if err == nil {
+		_, err = fd.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.put(key, fd, size); err != nil {
+		log.Printf("[s3] error storing key=%v: %v", key, err)
+		return err
+	}
+	aux := h.Clone()
+	removeHopHeaders(aux)
+	aux.Set("Content-Length", strconv.FormatInt(size, 10))
+	if err := c.putHeaders(key, aux); err != nil {
+		log.Printf("[s3] error storing key=%v: %v", key, err)
+		return err
+	}
+	return nil
+}
+
+// Get returns the blob without downloading it, as it is fetched when read.
+func (c *s3Cache) Get(key string) (blob io.ReadCloser, h http.Header, err error) {
+	h, err = c.getHeaders(key)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[s3] error reading key=%v: %v", key, err)
+		}
+		return nil, nil, err
+	}
+	size, _ := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+	switch err = checkExpiry(key, h); err {
+	case nil:
+	case errExpired:
+		events.Emit(eventEvict, key, "", size)
+		c.Flush(key)
+		return nil, nil, err
+	default:
+		return nil, nil, err
+	}
+	h.Del(mustRevalidateHeader)
+	h.Del(uriHeader)
+	log.Printf("[s3] Cache hit!")
+	return &s3Blob{c: c, key: key, size: size}, h, nil
+}
+
+// Flush removes the entry stored at key, returning an error satisfying
+// os.IsNotExist if there is none.
+func (c *s3Cache) Flush(key string) error {
+	resp, err := c.do(http.MethodHead, c.objectPath(key+".headers"), "", nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// Headers go first, so readers never find a partial entry
+	for _, name := range []string{key + ".headers", key} {
+		resp, err := c.do(http.MethodDelete, c.objectPath(name), "", nil, 0, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// UpdateHeaders replaces the stored headers of key by the result of
+// update, leaving the body untouched.
+func (c *s3Cache) UpdateHeaders(key string, update func(h http.Header)) error {
+	h, err := c.getHeaders(key)
+	if err != nil {
+		return err
+	}
+	update(h)
+	return c.putHeaders(key, h)
+}
+
+// FlushTenant removes all entries stored for tenant.
+func (c *s3Cache) FlushTenant(tenant string) error {
+	for {
+		objs, _, err := c.list(tenantDir(tenant)+"/", "", 1000)
+		if err != nil || len(objs) == 0 {
+			return err
+		}
+		for _, obj := range objs {
+			resp, err := c.do(http.MethodDelete, "/"+c.bucket+"/"+obj.Key, "", nil, 0, nil)
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+		}
+	}
+}
+
+// URI returns the URI of the entry stored at key.
+func (c *s3Cache) URI(key string) (string, error) {
+	if !validKey(key) {
+		return "", errInvalidKey
+	}
+	h, err := c.getHeaders(key)
+	if err != nil {
+		return "", err
+	}
+	if uri := h.Get(uriHeader); uri != "" {
+		return uri, nil
+	}
+	return "", errors.New("entry was stored without its URI")
+}
+
+func (c *s3Cache) objectPath(key string) string {
+	return "/" + c.bucket + "/" + c.prefix + key
+}
+
+func (c *s3Cache) put(key string, body io.Reader, size int64) error {
+	resp, err := c.do(http.MethodPut, c.objectPath(key), "", body, size, nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *s3Cache) putHeaders(key string, h http.Header) error {
+	b, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	return c.put(key+".headers", bytes.NewReader(b), int64(len(b)))
+}
+
+func (c *s3Cache) getHeaders(key string) (http.Header, error) {
+	resp, err := c.do(http.MethodGet, c.objectPath(key+".headers"), "", nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	h := make(http.Header)
+	if err := json.NewDecoder(resp.Body).Decode(&h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// s3Object is an object in a listing, with its key relative to the bucket.
+type s3Object struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// list returns up to max objects under prefix, starting at the
+// continuation token, and the token of the next page, if any.
+func (c *s3Cache) list(prefix, token string, max int) (objs []s3Object, next string, err error) {
+	q := url.Values{
+		"list-type": {"2"},
+		"prefix":    {c.prefix + prefix},
+		"max-keys":  {strconv.Itoa(max)},
+	}
+	if token != "" {
+		q.Set("continuation-token", token)
+	}
+	resp, err := c.do(http.MethodGet, "/"+c.bucket, s3Query(q), nil, 0, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Contents              []s3Object
+		IsTruncated           bool
+		NextContinuationToken string
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, "", err
+	}
+	if result.IsTruncated {
+		next = result.NextContinuationToken
+	}
+	return result.Contents, next, nil
+}
+
+// Entries lists the bucket, reading the headers of each entry.
+func (c *s3Cache) Entries(fn func(e cacheEntry) error) error {
+	token := ""
+	for {
+		objs, next, err := c.list("", token, 1000)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objs {
+			if !strings.HasSuffix(obj.Key, ".headers") {
+				continue
+			}
+			key := strings.TrimSuffix(strings.TrimPrefix(obj.Key, c.prefix), ".headers")
+			h, err := c.getHeaders(key)
+			if err != nil {
+				continue
+			}
+			size, _ := strconv.ParseInt(h.Get("Content-Length"), 10, 64)
+			if err := fn(newCacheEntry(key, h, size, obj.LastModified)); err == errStopListing {
+				return nil
+			} else if err != nil {
+				return err
+			}
+		}
+		if token = next; token == "" {
+			return nil
+		}
+	}
+}
+
+// do sends a signed request, returning an error satisfying os.IsNotExist
+// for missing objects, and for any other non 2xx response.
+func (c *s3Cache) do(method, path, query string, body io.Reader, size int64, h http.Header) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path, u.RawPath, u.RawQuery = path, s3Escape(path, true), query
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+		if size == 0 {
+			req.Body = http.NoBody
+		}
+	}
+	c.sign(req, time.Now())
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, os.ErrNotExist
+		}
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("s3: %v %v: %v %s", method, path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// sign adds the AWS Signature Version 4 authorization to req. Payloads are
+// left unsigned, so bodies are streamed, unless req has their hash in
+// X-Amz-Content-Sha256.
+func (c *s3Cache) sign(req *http.Request, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	}
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	names := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if name == "range" || strings.HasPrefix(name, "x-amz-") {
+			names = append(names, name)
+			values[name] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	sort.Strings(names)
+	var headers strings.Builder
+	for _, name := range names {
+		headers.WriteString(name + ":" + values[name] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signed,
+		req.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%x",
+		c.accessKey, scope, signed, hmacSHA256(key, toSign)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	m := hmac.New(sha256.New, key)
+	m.Write([]byte(data))
+	return m.Sum(nil)
+}
+
+// s3Escape percent-encodes s as required by Signature Version 4: all but
+// the unreserved characters, and slashes if keepSlash is set.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~', ch == '/' && keepSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes q sorted by name, as required by Signature Version 4.
+func s3Query(q url.Values) string {
+	var names []string
+	for name := range q {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var parts []string
+	for _, name := range names {
+		for _, v := range q[name] {
+			parts = append(parts, s3Escape(name, false)+"="+s3Escape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Blob reads an object lazily, from the current offset, so seeking to
+// serve a range only downloads the bytes in it.
+type s3Blob struct {
+	c    *s3Cache
+	key  string
+	size int64
+	off  int64
+	body io.ReadCloser
+}
+
+func (b *s3Blob) Read(p []byte) (int, error) {
+	if b.off >= b.size {
+		return 0, io.EOF
+	}
+	if b.body == nil {
+		h := http.Header{"Range": {fmt.Sprintf("bytes=%d-", b.off)}}
+		resp, err := b.c.do(http.MethodGet, b.c.objectPath(b.key), "", nil, 0, h)
+		if err != nil {
+			return 0, err
+		}
+		b.body = resp.Body
+	}
+	n, err := b.body.Read(p)
+	b.off += int64(n)
+	return n, err
+}
+
+func (b *s3Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.off
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return 0, errors.New("s3: negative position")
+	}
+	if offset != b.off {
+		b.Close()
+		b.off = offset
+	}
+	return offset, nil
+}
+
+func (b *s3Blob) Close() error {
+	if b.body == nil {
+		return nil
+	}
+	err := b.body.Close()
+	b.body = nil
+	return err
+}
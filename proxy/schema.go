@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// schemaRule validates JSON responses for paths matching pattern against
+// schema.
+type schemaRule struct {
+	pattern, file string
+	schema        map[string]interface{}
+}
+
+// schemaRules implements flag.Value, parsing repeated PATTERN=FILE values
+// and loading the JSON schema in FILE.
+type schemaRules []schemaRule
+
+func (s *schemaRules) String() string {
+	if s == nil {
+		return ""
+	}
+	var v []string
+	for _, r := range *s {
+		v = append(v, r.pattern+"="+r.file)
+	}
+	return strings.Join(v, ",")
+}
+
+func (s *schemaRules) Set(v string) error {
+	i := strings.Index(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid rule %q, use PATTERN=FILE", v)
+	}
+	pattern, file := v[:i], v[i+1:]
+	if _, err := path.Match(pattern, ""); err != nil {
+		return fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	var schema map[string]interface{}
+	if err := json.Unmarshal(b, &schema); err != nil {
+		return fmt.Errorf("invalid schema %v: %v", file, err)
+	}
+	*s = append(*s, schemaRule{pattern: pattern, file: file, schema: schema})
+	return nil
+}
+
+// isJSON reports whether the media type in contentType is JSON.
+func isJSON(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mt == "application/json" || strings.HasSuffix(mt, "+json"))
+}
+
+// validateResponse checks JSON responses against the first
+// --validate-json-schema rule matching their path. The body is read in
+// full, and replaced so it can still be served.
+func validateResponse(w *http.Response) error {
+	if !isJSON(w.Header.Get("content-type")) {
+		return nil
+	}
+	for _, rule := range conf.JSONSchemas {
+		if ok, _ := path.Match(rule.pattern, w.Request.URL.Path); !ok {
+			continue
+		}
+		b, err := io.ReadAll(w.Body)
+		w.Body.Close()
+		w.Body = io.NopCloser(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		var v interface{}
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.UseNumber()
+		if err := d.Decode(&v); err != nil {
+			return fmt.Errorf("invalid JSON: %v", err)
+		}
+		if err := validateSchema(rule.schema, v, "$"); err != nil {
+			return fmt.Errorf("does not match %v: %v", rule.file, err)
+		}
+		return nil
+	}
+	return nil
+}
+
+// validateSchema validates v against a subset of JSON Schema: type, enum,
+// const, required, properties, additionalProperties, items, minimum,
+// maximum, minLength, maxLength, minItems and maxItems.
+func validateSchema(schema map[string]interface{}, v interface{}, at string) error {
+	if t, ok := schema["type"]; ok {
+		types, ok := t.([]interface{})
+		if !ok {
+			types = []interface{}{t}
+		}
+		match := false
+		for _, t := range types {
+			if s, _ := t.(string); hasType(v, s) {
+				match = true
+			}
+		}
+		if !match {
+			return fmt.Errorf("%v: expected type %v", at, t)
+		}
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		match := false
+		for _, e := range enum {
+			if jsonEqual(e, v) {
+				match = true
+			}
+		}
+		if !match {
+			return fmt.Errorf("%v: not one of %v", at, enum)
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, v) {
+		return fmt.Errorf("%v: expected %v", at, c)
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, r := range required {
+				if name, _ := r.(string); name != "" {
+					if _, ok := v[name]; !ok {
+						return fmt.Errorf("%v: missing property %q", at, name)
+					}
+				}
+			}
+		}
+		props, _ := schema["properties"].(map[string]interface{})
+		for name, value := range v {
+			if p, ok := props[name].(map[string]interface{}); ok {
+				if err := validateSchema(p, value, at+"."+name); err != nil {
+					return err
+				}
+			} else if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				return fmt.Errorf("%v: unexpected property %q", at, name)
+			}
+		}
+	case []interface{}:
+		if err := checkBounds(schema, "minItems", "maxItems", float64(len(v)), at); err != nil {
+			return err
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range v {
+				if err := validateSchema(items, item, fmt.Sprintf("%v[%d]", at, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case string:
+		return checkBounds(schema, "minLength", "maxLength", float64(len([]rune(v))), at)
+	case json.Number:
+		f, _ := v.Float64()
+		return checkBounds(schema, "minimum", "maximum", f, at)
+	}
+	return nil
+}
+
+// hasType reports whether v is of the JSON Schema type t.
+func hasType(v interface{}, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case []interface{}:
+		return t == "array"
+	case map[string]interface{}:
+		return t == "object"
+	case json.Number:
+		if t == "number" {
+			return true
+		}
+		f, err := v.Float64()
+		return t == "integer" && err == nil && f == math.Trunc(f)
+	}
+	return false
+}
+
+// checkBounds validates n against the min and max keywords of schema.
+func checkBounds(schema map[string]interface{}, min, max string, n float64, at string) error {
+	if m, ok := schema[min].(float64); ok && n < m {
+		return fmt.Errorf("%v: %v is below %v %v", at, n, min, m)
+	}
+	if m, ok := schema[max].(float64); ok && n > m {
+		return fmt.Errorf("%v: %v is above %v %v", at, n, max, m)
+	}
+	return nil
+}
+
+// jsonEqual compares decoded JSON values, where numbers in v may be
+// json.Number.
+func jsonEqual(a, v interface{}) bool {
+	if n, ok := v.(json.Number); ok {
+		f, _ := n.Float64()
+		v = f
+	}
+	ab, _ := json.Marshal(a)
+	vb, _ := json.Marshal(v)
+	return bytes.Equal(ab, vb)
+}
@@ -0,0 +1,144 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errRefresh = errors.New("refreshing cache entry")
+
+// The stale-while-revalidate and stale-if-error windows set by upstream,
+// in seconds, are stored with the entry. They are never sent to clients.
+const (
+	staleWhileRevalidateHeader = "X-Simpleproxy-Stale-While-Revalidate"
+	staleIfErrorHeader         = "X-Simpleproxy-Stale-If-Error"
+)
+
+// setStaleHeaders stores in h the stale-while-revalidate and stale-if-error
+// directives of the upstream response headers from.
+func setStaleHeaders(h, from http.Header) {
+	for directive, name := range map[string]string{
+		"stale-while-revalidate": staleWhileRevalidateHeader,
+		"stale-if-error":         staleIfErrorHeader,
+	} {
+		h.Del(name)
+		if s, ok := cacheDirectiveSeconds(from, directive); ok && s > 0 {
+			h.Set(name, strconv.Itoa(s))
+		}
+	}
+}
+
+// staleWindows removes the stored stale windows from h, returning how long
+// the entry can be served stale while refreshed, --stale-grace or the
+// upstream stale-while-revalidate, whichever is longer, and for how long on
+// upstream errors with stale-if-error.
+func staleWindows(h http.Header) (grace, ifError time.Duration) {
+	grace = conf.StaleGrace
+	if s, err := strconv.Atoi(h.Get(staleWhileRevalidateHeader)); err == nil && time.Duration(s)*time.Second > grace {
+		grace = time.Duration(s) * time.Second
+	}
+	if s, err := strconv.Atoi(h.Get(staleIfErrorHeader)); err == nil {
+		ifError = time.Duration(s) * time.Second
+	}
+	h.Del(staleWhileRevalidateHeader)
+	h.Del(staleIfErrorHeader)
+	return grace, ifError
+}
+
+// cacheDirectiveSeconds returns the value of the Cache-Control directive
+// name in h, in seconds.
+func cacheDirectiveSeconds(h http.Header, name string) (int, bool) {
+	for _, v := range h.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			i := strings.Index(d, "=")
+			if i < 0 || !strings.EqualFold(strings.TrimSpace(d[:i]), name) {
+				continue
+			}
+			s, err := strconv.Atoi(strings.Trim(strings.TrimSpace(d[i+1:]), `"`))
+			return s, err == nil
+		}
+	}
+	return 0, false
+}
+
+// isStale removes the stored expiration from h and reports whether the
+// entry has already expired.
+func isStale(h http.Header) bool {
+	e := h.Get(expiresHeader)
+	h.Del(expiresHeader)
+	t, err := http.ParseTime(e)
+	return err == nil && time.Now().After(t)
+}
+
+// backgroundRefresher fetches fresh copies of stale entries in the
+// background, with at most one refresh per key at a time.
+type backgroundRefresher struct {
+	// ctx ends the refreshes once done
+	ctx  context.Context
+	next http.Handler
+
+	mu       sync.Mutex
+	inflight map[string]bool
+	wg       sync.WaitGroup
+}
+
+// refresher is used to refresh entries served within --stale-grace.
+var refresher = &backgroundRefresher{inflight: make(map[string]bool)}
+
+// Refresh sends a copy of r through the proxy, bypassing the cache
+// lookup, so the response replaces the stored entry at key. Tenants and
+// variants of the same URI have keys, and refreshes, of their own.
+func (b *backgroundRefresher) Refresh(r *http.Request, key string) {
+	if b.next == nil || isOffline() {
+		return
+	}
+	uri := keyURI(r)
+	b.mu.Lock()
+	if b.inflight[key] || b.ctx.Err() != nil {
+		b.mu.Unlock()
+		return
+	}
+	b.inflight[key] = true
+	b.wg.Add(1)
+	b.mu.Unlock()
+
+	req := r.Clone(context.WithValue(withUpstream(b.ctx, r), refreshKey, true))
+	req.Method = http.MethodGet
+	for _, k := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since"} {
+		req.Header.Del(k)
+	}
+	go func() {
+		defer b.wg.Done()
+		defer func() {
+			b.mu.Lock()
+			delete(b.inflight, key)
+			b.mu.Unlock()
+		}()
+		log.Printf("[refresh] Refreshing stale entry '%v'", uri)
+		b.next.ServeHTTP(&discardWriter{h: make(http.Header)}, req)
+	}()
+}
+
+// Wait waits for the refreshes in progress to finish, once its context
+// is done.
+func (b *backgroundRefresher) Wait() {
+	// Refreshes are started holding mu, after checking the context
+	b.mu.Lock()
+	b.mu.Unlock()
+	b.wg.Wait()
+}
+
+// discardWriter is a http.ResponseWriter that ignores the response.
+type discardWriter struct {
+	h http.Header
+}
+
+func (d *discardWriter) Header() http.Header         { return d.h }
+func (d *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardWriter) WriteHeader(int)             {}
@@ -0,0 +1,33 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRefreshesByKey(t *testing.T) {
+	var n int32
+	release := make(chan struct{})
+	b := &backgroundRefresher{
+		ctx:      context.Background(),
+		inflight: make(map[string]bool),
+		next: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&n, 1)
+			<-release
+		}),
+	}
+	r := httptest.NewRequest(http.MethodGet, "/page", nil)
+	// Tenants and variants of /page are refreshed on their own, but
+	// only once while in progress
+	for _, key := range []string{"a/page", "b/page", "a/page", "page\nAccept: */*"} {
+		b.Refresh(r, key)
+	}
+	close(release)
+	b.Wait()
+	if n != 3 {
+		t.Errorf("upstream got %d refreshes, want one per key", n)
+	}
+}
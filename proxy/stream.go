@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// errWriteAborted is reported to the cache when the response is not read
+// in full, so the partially written entry is discarded.
+var errWriteAborted = errors.New("response was not read in full")
+
+// pendingWrites tracks the cache writes in progress, so they can finish
+// before exiting.
+var pendingWrites sync.WaitGroup
+
+// waitWrites waits for the pending cache writes, until ctx is done.
+func waitWrites(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		pendingWrites.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cacheWriter streams an upstream response body to the client, copying it
+// to the cache as it is read. The entry is only committed once the body
+// is read in full; closing it earlier aborts the write.
+type cacheWriter struct {
+	body io.ReadCloser
+	pw   *io.PipeWriter
+	done chan error
+
+	// head keeps up to headLimit bytes of the body, for the prefetcher.
+	head      *bytes.Buffer
+	headLimit int
+
+	n      int64
+	eof    bool
+	failed bool
+	once   sync.Once
+	onDone func(n int64, head []byte, err error)
+}
+
+// newCacheWriter starts storing body with put, calling onDone with the
+// result once the body is closed.
+func newCacheWriter(body io.ReadCloser, put func(blob io.ReadCloser) error, headLimit int, onDone func(n int64, head []byte, err error)) *cacheWriter {
+	pr, pw := io.Pipe()
+	c := &cacheWriter{
+		body:      body,
+		pw:        pw,
+		done:      make(chan error, 1),
+		head:      &bytes.Buffer{},
+		headLimit: headLimit,
+		onDone:    onDone,
+	}
+	pendingWrites.Add(1)
+	go func() {
+		defer pendingWrites.Done()
+		err := put(pr)
+		// Unblock the writer if put failed early
+		pr.CloseWithError(err)
+		c.done <- err
+	}()
+	return c
+}
+
+func (c *cacheWriter) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if n > 0 {
+		c.n += int64(n)
+		if room := c.headLimit - c.head.Len(); room > 0 {
+			if room > n {
+				room = n
+			}
+			c.head.Write(p[:room])
+		}
+		// Failures to write to the cache never affect the client
+		if !c.failed {
+			if _, werr := c.pw.Write(p[:n]); werr != nil {
+				c.failed = true
+			}
+		}
+	}
+	if err == io.EOF {
+		c.eof = true
+	}
+	return n, err
+}
+
+// Close finishes the cache write, waiting for the entry to be committed
+// when the body was read in full.
+func (c *cacheWriter) Close() error {
+	c.once.Do(func() {
+		if c.eof && !c.failed {
+			c.pw.Close()
+		} else {
+			c.pw.CloseWithError(errWriteAborted)
+		}
+		err := <-c.done
+		if err == nil && !c.eof {
+			err = errWriteAborted
+		}
+		c.onDone(c.n, c.head.Bytes(), err)
+	})
+	return c.body.Close()
+}
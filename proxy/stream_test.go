@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheWriter(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		readAll  bool
+		wantErr  error
+		wantBlob string
+	}{
+		{"read in full", true, nil, "first,second"},
+		{"closed early", false, errWriteAborted, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var blob string
+			var done error
+			put := func(r io.ReadCloser) error {
+				b, err := io.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				blob = string(b)
+				return nil
+			}
+			body := io.NopCloser(strings.NewReader("first,second"))
+			w := newCacheWriter(body, put, 5, func(n int64, head []byte, err error) {
+				done = err
+				if tc.readAll && string(head) != "first" {
+					t.Errorf("head = %q, want %q", head, "first")
+				}
+			})
+			if tc.readAll {
+				if _, err := io.ReadAll(w); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				buf := make([]byte, 6)
+				if _, err := w.Read(buf); err != nil {
+					t.Fatal(err)
+				}
+			}
+			w.Close()
+			if !errors.Is(done, tc.wantErr) {
+				t.Errorf("got %v, want %v", done, tc.wantErr)
+			}
+			if blob != tc.wantBlob {
+				t.Errorf("stored %q, want %q", blob, tc.wantBlob)
+			}
+		})
+	}
+}
+
+func TestClientCancelAbortsUpstream(t *testing.T) {
+	var n int32
+	cancelled := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "first half,")
+		if atomic.AddInt32(&n, 1) > 1 {
+			fmt.Fprint(w, " second half")
+			return
+		}
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	proxy := httptest.NewServer(newTestHandler(t, newTestConfig(t, u)))
+	defer proxy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, proxy.URL+"/slow", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := resp.Body.Read(make([]byte, 64)); err != nil {
+		t.Fatalf("reading the first half: %v", err)
+	}
+	cancel()
+	resp.Body.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(3 * time.Second):
+		t.Fatal("upstream request not cancelled after the client went away")
+	}
+
+	wait, done := context.WithTimeout(context.Background(), 3*time.Second)
+	defer done()
+	if err := waitWrites(wait); err != nil {
+		t.Fatalf("cache write still pending: %v", err)
+	}
+	rec := get(proxy.Config.Handler, "/slow")
+	if rec.Header().Get("x-cache") == CacheHit {
+		t.Errorf("got a cache hit with %q, want the partial entry discarded", rec.Body.String())
+	}
+	if body, _ := io.ReadAll(rec.Body); string(body) != "first half, second half" {
+		t.Errorf("got %q, want the full body", body)
+	}
+}
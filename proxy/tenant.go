@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"regexp"
+)
+
+// defaultTenant is the bucket for requests without the tenant header.
+const defaultTenant = "_default"
+
+var validTenant = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+
+// tenantFlusher is implemented by caches that can remove all entries of a
+// tenant at once.
+type tenantFlusher interface {
+	FlushTenant(tenant string) error
+}
+
+var errNoTenants = errors.New("cache does not support tenants")
+
+// tenantDir returns the directory name holding the entries of tenant.
+// Names that are not safe as a directory are hashed.
+func tenantDir(tenant string) string {
+	if tenant == "" {
+		return defaultTenant
+	}
+	if validTenant.MatchString(tenant) {
+		return tenant
+	}
+	sum := sha256.Sum256([]byte(tenant))
+	return "_" + hex.EncodeToString(sum[:16])
+}
+
+// requestKey returns the cache key for uri, as requested by r, including
+// the values of --cache-key-headers. With --tenant-header, keys are grouped
+// in one directory per tenant, and with routed upstreams, in one directory
+// per upstream.
+func requestKey(r *http.Request, uri string) string {
+	key := cacheKey(keyHeadersURI(uri, r))
+	if len(conf.UpstreamRoutes) > 0 {
+		key = upstreamDir(requestUpstream(r)) + "/" + key
+	}
+	if conf.TenantHeader == "" {
+		return key
+	}
+	return tenantDir(r.Header.Get(conf.TenantHeader)) + "/" + key
+}
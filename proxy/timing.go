@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// requestTiming accumulates how long a request spent on each phase, to
+// report slow requests.
+type requestTiming struct {
+	cacheLookup int64 // time.Duration
+	upstream    int64 // time.Duration
+}
+
+func withTiming(r *http.Request) (*http.Request, *requestTiming) {
+	t := &requestTiming{}
+	return r.WithContext(context.WithValue(r.Context(), timingKey, t)), t
+}
+
+// timingOf returns the timing of r, or nil if it is not being timed.
+func timingOf(r *http.Request) *requestTiming {
+	t, _ := r.Context().Value(timingKey).(*requestTiming)
+	return t
+}
+
+// addCacheLookup adds the time since start to the cache lookup phase.
+func (t *requestTiming) addCacheLookup(start time.Time) {
+	if t != nil {
+		atomic.AddInt64(&t.cacheLookup, int64(time.Since(start)))
+	}
+}
+
+// addUpstream adds the time since start to the upstream phase.
+func (t *requestTiming) addUpstream(start time.Time) {
+	if t != nil {
+		atomic.AddInt64(&t.upstream, int64(time.Since(start)))
+	}
+}
+
+// logIfSlow logs requests that took longer than --slow-request-threshold,
+// with the time spent on each phase.
+func (t *requestTiming) logIfSlow(r *http.Request, total time.Duration) {
+	if conf.SlowRequestThreshold <= 0 || total < conf.SlowRequestThreshold {
+		return
+	}
+	log.Printf("[slow] WARNING: %v '%v' took %v (cache lookup=%v, upstream=%v)",
+		r.Method, r.URL.RequestURI(), total,
+		time.Duration(atomic.LoadInt64(&t.cacheLookup)),
+		time.Duration(atomic.LoadInt64(&t.upstream)))
+}
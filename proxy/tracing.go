@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Span kinds, as defined by OTLP.
+const (
+	spanInternal = 1
+	spanServer   = 2
+	spanClient   = 3
+)
+
+// traceBatchSize is how many spans are sent at most in each export.
+const traceBatchSize = 512
+
+// span is an operation traced for the request it belongs to.
+type span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	kind     int
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      string
+}
+
+// traceExporter sends spans to an OTLP/HTTP collector, as JSON, in the
+// background. Like the event webhook, export is best-effort: spans are
+// dropped when the queue is full or the collector fails.
+type traceExporter struct {
+	url     string
+	service string
+	client  *http.Client
+	queue   chan *span
+
+	exported int64
+	dropped  int64
+	failed   int64
+}
+
+// tracer exports spans with --otel-endpoint, or is nil.
+var tracer *traceExporter
+
+// newTraceExporter returns an exporter to the collector at endpoint, such
+// as http://collector:4318, sending spans to its /v1/traces path until ctx
+// is done.
+func newTraceExporter(ctx context.Context, endpoint, service string) *traceExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	t := &traceExporter{
+		url:     url,
+		service: service,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan *span, 4*traceBatchSize),
+	}
+	go t.run(ctx)
+	return t
+}
+
+// startSpan starts a span named name, as a child of the span in ctx, or of
+// a new trace, returning a context holding it. Without --otel-endpoint, it
+// returns a nil span, which ignores every call.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: make(map[string]interface{})}
+	if parent, ok := ctx.Value(spanKey).(*span); ok {
+		s.traceID, s.parentID = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey, s), s
+}
+
+// SetAttr records the attribute key of s, a string, int64 or bool.
+func (s *span) SetAttr(key string, v interface{}) {
+	if s != nil {
+		s.attrs[key] = v
+	}
+}
+
+// End finishes s, as failed if err is not nil, and queues it for export.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	if err != nil {
+		s.err = err.Error()
+	}
+	select {
+	case tracer.queue <- s:
+	default:
+		atomic.AddInt64(&tracer.dropped, 1)
+	}
+}
+
+// traceparent returns the W3C Trace Context header for requests sent
+// within s.
+func (s *span) traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", s.traceID, s.spanID)
+}
+
+// remoteSpan returns the parent span in the traceparent header of r, if
+// any, so the spans of r join the trace of the client.
+func remoteSpan(r *http.Request) (*span, bool) {
+	parts := strings.Split(strings.TrimSpace(r.Header.Get("Traceparent")), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil, false
+	}
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil || s.traceID == [16]byte{} {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil || s.spanID == [8]byte{} {
+		return nil, false
+	}
+	return s, true
+}
+
+// traceRequests records a server span for each request served by next,
+// continuing the trace in its traceparent header, if any.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, ok := remoteSpan(r); ok {
+			ctx = context.WithValue(ctx, spanKey, parent)
+		}
+		ctx, s := startSpan(ctx, r.Method, spanServer)
+		s.SetAttr("http.request.method", r.Method)
+		s.SetAttr("url.path", r.URL.Path)
+		s.SetAttr("server.address", r.Host)
+		s.SetAttr("client.address", clientIP(r))
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		if rec.code == 0 {
+			rec.code = http.StatusOK
+		}
+		s.SetAttr("http.response.status_code", int64(rec.code))
+		if xcache := rec.Header().Get("X-Cache"); xcache != "" {
+			s.SetAttr("simpleproxy.cache", xcache)
+		}
+		var err error
+		if rec.code >= 500 {
+			err = fmt.Errorf("%d %s", rec.code, http.StatusText(rec.code))
+		}
+		s.End(err)
+	})
+}
+
+// roundTrip sends r upstream within a client span, propagating it to the
+// upstream in the traceparent header.
+func (c *CachedTransport) roundTrip(r *http.Request) (*http.Response, error) {
+	ctx, s := startSpan(r.Context(), r.Method, spanClient)
+	if s == nil {
+		return c.t.RoundTrip(r)
+	}
+	r.Header.Set("Traceparent", s.traceparent())
+	s.SetAttr("http.request.method", r.Method)
+	s.SetAttr("server.address", r.URL.Host)
+	s.SetAttr("url.full", r.URL.String())
+	w, err := c.t.RoundTrip(r.WithContext(ctx))
+	failed := err
+	if err == nil {
+		// Later spans, as the cache store, are not part of this one
+		w.Request = r
+		s.SetAttr("http.response.status_code", int64(w.StatusCode))
+		if w.StatusCode >= 500 {
+			failed = fmt.Errorf("upstream returned %v", w.Status)
+		}
+	}
+	s.End(failed)
+	return w, err
+}
+
+func (t *traceExporter) run(ctx context.Context) {
+	var batch []*span
+	flush := time.NewTicker(5 * time.Second)
+	defer flush.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			if len(batch) > 0 {
+				t.export(batch)
+			}
+			return
+		case s := <-t.queue:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-flush.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		t.export(batch)
+		batch = nil
+	}
+}
+
+// export posts batch to the collector.
+func (t *traceExporter) export(batch []*span) {
+	b, err := json.Marshal(t.encode(batch))
+	if err != nil {
+		log.Printf("[tracing] error encoding spans: %v", err)
+		return
+	}
+	resp, err := t.client.Post(t.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		atomic.AddInt64(&t.failed, int64(len(batch)))
+		log.Printf("[tracing] error exporting spans: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		atomic.AddInt64(&t.failed, int64(len(batch)))
+		log.Printf("[tracing] collector returned %v", resp.Status)
+		return
+	}
+	atomic.AddInt64(&t.exported, int64(len(batch)))
+}
+
+// encode returns batch as an OTLP ExportTraceServiceRequest, in its JSON
+// encoding.
+func (t *traceExporter) encode(batch []*span) map[string]interface{} {
+	spans := make([]map[string]interface{}, 0, len(batch))
+	for _, s := range batch {
+		js := map[string]interface{}{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.spanID[:]),
+			"name":              s.name,
+			"kind":              s.kind,
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs),
+		}
+		if s.parentID != [8]byte{} {
+			js["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != "" {
+			js["status"] = map[string]interface{}{"code": 2, "message": s.err}
+		}
+		spans = append(spans, js)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{"service.name": t.service}),
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "simpleproxy"},
+				"spans": spans,
+			}},
+		}},
+	}
+}
+
+// otlpAttributes returns attrs as OTLP key-values.
+func otlpAttributes(attrs map[string]interface{}) []interface{} {
+	kvs := make([]interface{}, 0, len(attrs))
+	for k, v := range attrs {
+		var value map[string]interface{}
+		switch v := v.(type) {
+		case int64:
+			value = map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+		case bool:
+			value = map[string]interface{}{"boolValue": v}
+		default:
+			value = map[string]interface{}{"stringValue": fmt.Sprint(v)}
+		}
+		kvs = append(kvs, map[string]interface{}{"key": k, "value": value})
+	}
+	return kvs
+}
+
+// Stats returns the export counters of the spans.
+func (t *traceExporter) Stats() map[string]int64 {
+	return map[string]int64{
+		"queued":   int64(len(t.queue)),
+		"exported": atomic.LoadInt64(&t.exported),
+		"dropped":  atomic.LoadInt64(&t.dropped),
+		"failed":   atomic.LoadInt64(&t.failed),
+	}
+}
@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// withTTLParam removes the TTL query parameter from r, so it is neither
+// forwarded upstream nor part of the cache key, and returns a request
+// carrying the requested TTL in its context.
+func withTTLParam(r *http.Request) *http.Request {
+	if r.URL.RawQuery == "" {
+		return r
+	}
+	// Drop the parameter from the raw query, leaving the others exactly
+	// as sent, in their order and escaping.
+	var v string
+	found := false
+	params := strings.Split(r.URL.RawQuery, "&")
+	kept := params[:0]
+	for _, param := range params {
+		name, value, _ := strings.Cut(param, "=")
+		if name, err := url.QueryUnescape(name); err != nil || name != conf.TTLParam {
+			kept = append(kept, param)
+			continue
+		}
+		if !found {
+			v, _ = url.QueryUnescape(value)
+			found = true
+		}
+	}
+	if !found {
+		return r
+	}
+	r.URL.RawQuery = strings.Join(kept, "&")
+	if r.URL.IsAbs() {
+		r.RequestURI = r.URL.String()
+	} else {
+		r.RequestURI = r.URL.RequestURI()
+	}
+
+	ttl, err := parseTTL(v)
+	if err == nil && ttl < 0 {
+		err = errors.New("negative TTL")
+	}
+	if err != nil {
+		log.Printf("[ttl] Ignoring invalid %v=%q: %v", conf.TTLParam, v, err)
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), ttlKey, clampTTL(ttl)))
+}
+
+// requestTTL returns the TTL requested for r, if any.
+func requestTTL(r *http.Request) (time.Duration, bool) {
+	ttl, ok := r.Context().Value(ttlKey).(time.Duration)
+	return ttl, ok
+}
+
+// parseTTL parses v either as a number of seconds or as a time.Duration.
+func parseTTL(v string) (time.Duration, error) {
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second, nil
+	}
+	return time.ParseDuration(v)
+}
+
+// clampTTL bounds ttl by the --min-ttl and --max-ttl flags.
+func clampTTL(ttl time.Duration) time.Duration {
+	if conf.MinTTL > 0 && ttl < conf.MinTTL {
+		ttl = conf.MinTTL
+	}
+	if conf.MaxTTL > 0 && ttl > conf.MaxTTL {
+		ttl = conf.MaxTTL
+	}
+	return ttl
+}
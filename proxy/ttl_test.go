@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithTTLParam(t *testing.T) {
+	parseTestFlags(t, "--allow-ttl-param")
+	for _, tc := range []struct {
+		target, wantURI string
+		wantTTL         time.Duration
+		ok              bool
+	}{
+		{"/page", "/page", 0, false},
+		{"/page?__ttl=30", "/page", 30 * time.Second, true},
+		{"/page?b=2&__ttl=5m&a=1", "/page?b=2&a=1", 5 * time.Minute, true},
+		{"/page?q=a%2Fb+c&x=%7E&__ttl=1", "/page?q=a%2Fb+c&x=%7E", time.Second, true},
+		{"/page?a=1&a=2&__ttl=1&__ttl=2", "/page?a=1&a=2", time.Second, true},
+		{"/page?%5F_ttl=10", "/page", 10 * time.Second, true},
+		{"/page?a&__ttl=1", "/page?a", time.Second, true},
+		{"/page?__ttl=-30", "/page", 0, false},
+		{"/page?__ttl=-1m&a=1", "/page?a=1", 0, false},
+		{"/page?__ttl=soon", "/page", 0, false},
+		{"/page?__ttl=0", "/page", 0, true},
+		{"/page?__ttlx=1", "/page?__ttlx=1", 0, false},
+	} {
+		r := withTTLParam(httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if r.RequestURI != tc.wantURI || r.URL.RequestURI() != tc.wantURI {
+			t.Errorf("%v: got request URI %v and URL %v, want %v", tc.target, r.RequestURI, r.URL.RequestURI(), tc.wantURI)
+		}
+		if ttl, ok := requestTTL(r); ttl != tc.wantTTL || ok != tc.ok {
+			t.Errorf("%v: got TTL %v, %v, want %v, %v", tc.target, ttl, ok, tc.wantTTL, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// errPassthrough is reported for requests never served from the cache
+// because they open a long-lived connection.
+var errPassthrough = errors.New("connection upgrade or event stream")
+
+// passthrough reports whether r asks to upgrade the connection, as
+// WebSocket clients do, or for a Server-Sent Events stream. Such requests
+// bypass the cache, and are never coalesced, going straight upstream.
+func passthrough(r *http.Request) bool {
+	if r.Header.Get("Upgrade") != "" && hasToken(r.Header, "Connection", "upgrade") {
+		return true
+	}
+	return hasToken(r.Header, "Accept", "text/event-stream")
+}
+
+// isEventStream reports whether h is the header of a Server-Sent Events
+// response, which never ends while the client is connected.
+func isEventStream(h http.Header) bool {
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	return mt == "text/event-stream"
+}
+
+// hasToken reports whether the comma-separated values of the header name
+// in h include token, ignoring case and parameters.
+func hasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if i := strings.Index(t, ";"); i >= 0 {
+				t = t[:i]
+			}
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
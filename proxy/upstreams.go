@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// hostRoutes maps inbound hosts, and path prefixes, which always start
+// with '/', to their upstream.
+type hostRoutes map[string]*url.URL
+
+// upstreamFlag implements flag.Value, parsing repeated --upstream values
+// into c. HOST=URL pairs route requests for HOST to URL, and /PREFIX=URL
+// pairs the requests for paths under PREFIX, while a plain URL sets the
+// default upstream. Repeating any of them adds a backend to balance its
+// requests with.
+type upstreamFlag struct {
+	c *Config
+}
+
+func (f upstreamFlag) String() string {
+	if f.c == nil {
+		return ""
+	}
+	var s []string
+	if f.c.Upstream != "" {
+		s = append(s, f.c.Upstream)
+	}
+	for _, u := range f.c.UpstreamBackends[""] {
+		s = append(s, u.String())
+	}
+	for _, host := range f.c.UpstreamRoutes.Hosts() {
+		s = append(s, host+"="+f.c.UpstreamRoutes[host].String())
+		for _, u := range f.c.UpstreamBackends[host] {
+			s = append(s, host+"="+u.String())
+		}
+	}
+	return strings.Join(s, ",")
+}
+
+func (f upstreamFlag) Set(v string) error {
+	host, raw := "", v
+	// URLs may have '=' in their query, but hosts never have a '/'
+	if i := strings.Index(v, "="); i >= 0 && !strings.Contains(v[:i], "/") {
+		host, raw = strings.ToLower(v[:i]), v[i+1:]
+	} else if strings.HasPrefix(v, "/") && i >= 0 {
+		host, raw = v[:i], v[i+1:]
+		if host != "/" {
+			host = strings.TrimSuffix(host, "/")
+		}
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute URL, as in https://example.com", raw)
+	}
+	c := f.c
+	switch {
+	case host == "" && c.Upstream == "":
+		c.Upstream = raw
+	case host != "" && c.UpstreamRoutes[host] == nil:
+		c.UpstreamRoutes[host] = u
+	default:
+		c.UpstreamBackends[host] = append(c.UpstreamBackends[host], u)
+	}
+	return nil
+}
+
+// Hosts returns the routed hosts and path prefixes, sorted.
+func (h hostRoutes) Hosts() []string {
+	hosts := make([]string, 0, len(h))
+	for host := range h {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// requestUpstream returns the upstream r was routed to, or the one routed
+// for its Host header, with or without the port, then for the longest
+// prefix of its path. Other requests use the default upstream, which may
+// be nil. In forward mode, the upstream is the origin of the request URL.
+func requestUpstream(r *http.Request) *url.URL {
+	if u, ok := r.Context().Value(upstreamKey).(*url.URL); ok {
+		return u
+	}
+	if forwardMode() {
+		return forwardOrigin(r)
+	}
+	host := strings.ToLower(r.Host)
+	if u, ok := conf.UpstreamRoutes[host]; ok {
+		return u
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if u, ok := conf.UpstreamRoutes[h]; ok {
+			return u
+		}
+	}
+	if prefix := routePrefix(r.URL.Path); prefix != "" {
+		return conf.UpstreamRoutes[prefix]
+	}
+	return upstreamUrl
+}
+
+// routePrefix returns the longest routed prefix of path, matching whole
+// segments, so /api matches /api and /api/users, but not /apis.
+func routePrefix(path string) string {
+	best := ""
+	for prefix := range conf.UpstreamRoutes {
+		if !strings.HasPrefix(prefix, "/") || len(prefix) <= len(best) {
+			continue
+		}
+		if path == prefix || prefix == "/" || strings.HasPrefix(path, prefix+"/") {
+			best = prefix
+		}
+	}
+	return best
+}
+
+// routedPath replaces the route prefix of the path of r by the path of its
+// upstream u, if it has one: with /api=https://api.internal/v2, /api/users
+// is sent as /v2/users, while with /api=https://api.internal it is sent as
+// it is.
+func routedPath(r *http.Request, u *url.URL) {
+	prefix := routePrefix(r.URL.Path)
+	if prefix == "" || conf.UpstreamRoutes[prefix] != u || u.Path == "" {
+		return
+	}
+	replace := func(p, with string) string {
+		p = strings.TrimSuffix(with, "/") + strings.TrimPrefix(p, strings.TrimSuffix(prefix, "/"))
+		if !strings.HasPrefix(p, "/") {
+			p = "/" + p
+		}
+		return p
+	}
+	if r.URL.RawPath != "" && strings.HasPrefix(r.URL.RawPath, prefix) {
+		r.URL.RawPath = replace(r.URL.RawPath, u.EscapedPath())
+	} else {
+		r.URL.RawPath = ""
+	}
+	r.URL.Path = replace(r.URL.Path, u.Path)
+}
+
+// rewritesRoutedPaths reports whether a path prefix is routed to an
+// upstream with a path, which routedPath replaces it with.
+func rewritesRoutedPaths() bool {
+	for prefix, u := range conf.UpstreamRoutes {
+		if strings.HasPrefix(prefix, "/") && u.Path != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// routedPrefix returns the path prefix routed to u, if any.
+func routedPrefix(u *url.URL) string {
+	for prefix, routed := range conf.UpstreamRoutes {
+		if routed == u && strings.HasPrefix(prefix, "/") {
+			return prefix
+		}
+	}
+	return ""
+}
+
+// withUpstream returns a copy of ctx routed to the same upstream as r.
+func withUpstream(ctx context.Context, r *http.Request) context.Context {
+	if u := requestUpstream(r); u != nil {
+		return context.WithValue(ctx, upstreamKey, u)
+	}
+	return ctx
+}
+
+// routeUpstream records the upstream of requests before they reach next,
+// so it is known once the Host header is rewritten. Requests for hosts
+// without an upstream get a 421 Misdirected Request.
+func routeUpstream(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(upstreamKey).(*url.URL); !ok {
+			u := requestUpstream(r)
+			if u == nil {
+				log.Printf("[router] No upstream for host %q", r.Host)
+				http.Error(w, "421 Misdirected Request", http.StatusMisdirectedRequest)
+				return
+			}
+			r = r.WithContext(context.WithValue(r.Context(), upstreamKey, u))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// upstreamDir returns the directory name holding the entries fetched from
+// u, so origins sharing paths never share entries. Names that are not
+// safe as a directory are hashed.
+func upstreamDir(u *url.URL) string {
+	name := strings.ReplaceAll(strings.ToLower(u.Host), ":", "_")
+	if validTenant.MatchString(name) {
+		return "@" + name
+	}
+	sum := sha256.Sum256([]byte(u.Host))
+	return "@_" + hex.EncodeToString(sum[:16])
+}
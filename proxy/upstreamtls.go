@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+)
+
+// upstreamTLS is the TLS configuration of connections to HTTPS upstreams,
+// or nil for the defaults.
+var upstreamTLS *tls.Config
+
+// upstreamTLSConfig returns the TLS configuration set by --upstream-ca,
+// --upstream-client-cert and --upstream-insecure-skip-verify, or nil if
+// none of them is set.
+func upstreamTLSConfig() (*tls.Config, error) {
+	if conf.UpstreamCA == "" && conf.UpstreamClientCert == "" && conf.UpstreamClientKey == "" && !conf.UpstreamInsecureSkipVerify {
+		return nil, nil
+	}
+	c := &tls.Config{}
+	if conf.UpstreamCA != "" {
+		b, err := os.ReadFile(conf.UpstreamCA)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --upstream-ca: %v", err)
+		}
+		c.RootCAs = x509.NewCertPool()
+		if !c.RootCAs.AppendCertsFromPEM(b) {
+			return nil, fmt.Errorf("invalid --upstream-ca: no PEM certificates in %v", conf.UpstreamCA)
+		}
+	}
+	if (conf.UpstreamClientCert == "") != (conf.UpstreamClientKey == "") {
+		return nil, errors.New("--upstream-client-cert and --upstream-client-key must be set together")
+	}
+	if conf.UpstreamClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(conf.UpstreamClientCert, conf.UpstreamClientKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream client certificate: %v", err)
+		}
+		c.Certificates = []tls.Certificate{cert}
+	}
+	if conf.UpstreamInsecureSkipVerify {
+		log.Printf("WARNING: upstream TLS certificates are not verified")
+		c.InsecureSkipVerify = true
+	}
+	return c, nil
+}
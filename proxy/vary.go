@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// varyHeader is stored in marker entries, saved under the base key of
+// responses with a Vary header. It lists the request headers selecting
+// the variant, whose entry is stored under a key derived from their
+// values.
+const varyHeader = "X-Simpleproxy-Vary"
+
+// responseVary returns the request headers listed in the Vary header of w,
+// which are folded into the cache key. It reports false for responses
+// varying on everything (Vary: *), which cannot be cached.
+func responseVary(w *http.Response) ([]string, bool) {
+	var vary []string
+	seen := make(map[string]bool)
+	for _, v := range w.Header.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			switch {
+			case name == "*":
+				return nil, false
+			case name == "", seen[name]:
+				continue
+			case name == "Accept-Encoding" && conf.DisableUpstreamCompression:
+				// Cached blobs are always identity-encoded
+				continue
+			}
+			seen[name] = true
+			vary = append(vary, name)
+		}
+	}
+	sort.Strings(vary)
+	return vary, true
+}
+
+// variantURI extends uri with the normalized values of the vary request
+// headers of r.
+func variantURI(uri string, r *http.Request, vary []string) string {
+	var b strings.Builder
+	b.WriteString(uri)
+	for _, name := range vary {
+		v := strings.Join(r.Header.Values(name), ",")
+		switch name {
+		case "Accept":
+			v = normalizeAccept(v)
+		case "Accept-Encoding":
+			v = normalizeAcceptEncoding(v)
+		default:
+			v = strings.TrimSpace(v)
+		}
+		b.WriteString("\n" + name + ": " + v)
+	}
+	return b.String()
+}
+
+// getEntry looks up the cached entry for r, following the vary marker
+// stored under the base key, if any. It also returns the key and the URI
+// used to derive it.
+func getEntry(c CacheManager, r *http.Request) (key, uri string, b io.ReadCloser, h http.Header, err error) {
+	_, s := startSpan(r.Context(), "cache lookup", spanInternal)
+	defer func() {
+		s.SetAttr("simpleproxy.cache.key", key)
+		s.SetAttr("simpleproxy.cache.hit", err == nil)
+		s.End(nil)
+	}()
+	uri = keyURI(r)
+	key = requestKey(r, uri)
+	b, h, err = c.Get(key)
+	if err != nil || h.Get(varyHeader) == "" {
+		return key, uri, b, h, err
+	}
+	b.Close()
+	uri = variantURI(uri, r, strings.Split(h.Get(varyHeader), ","))
+	key = requestKey(r, uri)
+	b, h, err = c.Get(key)
+	return key, uri, b, h, err
+}
+
+// normalizeAccept reduces an Accept header to the list of media ranges
+// the client accepts, with their quality, so equivalent headers share the
+// same cache entry while different fallbacks get their own. Ranges are
+// ordered by quality, then by specificity, then by name, and parameters
+// other than q are dropped, as are refused ranges, with a zero quality.
+// Empty headers are equivalent to */*.
+func normalizeAccept(accept string) string {
+	type mediaRange struct {
+		media string
+		q     float64
+		spec  int
+	}
+	var ranges []mediaRange
+	seen := make(map[string]int)
+	empty := true
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		media := strings.ToLower(strings.TrimSpace(params[0]))
+		if media == "" {
+			continue
+		}
+		empty = false
+		q := 1.0
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(strings.ToLower(p), "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		spec := 2
+		switch {
+		case media == "*/*":
+			spec = 0
+		case strings.HasSuffix(media, "/*"):
+			spec = 1
+		}
+		// Repeated ranges keep their highest quality
+		if i, ok := seen[media]; ok {
+			if q > ranges[i].q {
+				ranges[i].q = q
+			}
+			continue
+		}
+		seen[media] = len(ranges)
+		ranges = append(ranges, mediaRange{media, q, spec})
+	}
+	if empty {
+		return "*/*"
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		a, b := ranges[i], ranges[j]
+		if a.q != b.q {
+			return a.q > b.q
+		}
+		if a.spec != b.spec {
+			return a.spec > b.spec
+		}
+		return a.media < b.media
+	})
+	list := make([]string, len(ranges))
+	for i, r := range ranges {
+		list[i] = r.media
+		if r.q != 1 {
+			list[i] += ";q=" + strconv.FormatFloat(r.q, 'g', -1, 64)
+		}
+	}
+	return strings.Join(list, ",")
+}
+
+// normalizeAcceptEncoding reduces an Accept-Encoding header to the sorted
+// list of codings the client accepts, so equivalent headers share the same
+// cache entry.
+func normalizeAcceptEncoding(accept string) string {
+	var codings []string
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding == "" {
+			continue
+		}
+		accepted := true
+		for _, p := range params[1:] {
+			p = strings.TrimSpace(p)
+			if strings.HasPrefix(strings.ToLower(p), "q=") {
+				if v, err := strconv.ParseFloat(p[2:], 64); err == nil && v <= 0 {
+					accepted = false
+				}
+			}
+		}
+		if accepted {
+			codings = append(codings, coding)
+		}
+	}
+	sort.Strings(codings)
+	return strings.Join(codings, ",")
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestNormalizeAccept(t *testing.T) {
+	for _, tc := range []struct {
+		accept, want string
+	}{
+		{"", "*/*"},
+		{"*/*", "*/*"},
+		{"application/json", "application/json"},
+		{"Application/JSON", "application/json"},
+		{"application/json; charset=utf-8", "application/json"},
+		{"application/json;q=1.0", "application/json"},
+		{"application/xml;q=0.9, application/json", "application/json,application/xml;q=0.9"},
+		{"application/json;q=0.5, application/xml;q=0.8", "application/xml;q=0.8,application/json;q=0.5"},
+		{"application/json;q=0.50", "application/json;q=0.5"},
+		{"text/*, text/html", "text/html,text/*"},
+		{"*/*, application/json", "application/json,*/*"},
+		{"*/*;q=0.8, text/*;q=0.8", "text/*;q=0.8,*/*;q=0.8"},
+		{"application/json, application/xml", "application/json,application/xml"},
+		{"application/xml, application/json", "application/json,application/xml"},
+		{"application/json;q=0.5, application/json", "application/json"},
+		{"application/json;q=0, application/xml;q=0.1", "application/xml;q=0.1"},
+		{"application/json;q=0", ""},
+		{"application/json;q=invalid", "application/json"},
+		{" , ,application/json", "application/json"},
+		{"text/html, application/xhtml+xml, application/xml;q=0.9, */*;q=0.8", "application/xhtml+xml,text/html,application/xml;q=0.9,*/*;q=0.8"},
+	} {
+		if got := normalizeAccept(tc.accept); got != tc.want {
+			t.Errorf("normalizeAccept(%q) = %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeAcceptEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		accept, want string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br,deflate,gzip"},
+		{"br, GZIP, deflate", "br,deflate,gzip"},
+		{"gzip;q=1.0, identity;q=0", "gzip"},
+		{"gzip;q=0.5, br;q=0.9", "br,gzip"},
+	} {
+		if got := normalizeAcceptEncoding(tc.accept); got != tc.want {
+			t.Errorf("normalizeAcceptEncoding(%q) = %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+}
+
+func TestVaryAcceptFallbacks(t *testing.T) {
+	var n int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&n, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept")
+		// HTML is never available, only the fallbacks
+		if strings.Contains(r.Header.Get("Accept"), "application/json") {
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, `{"ok":true}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/xml")
+		io.WriteString(w, "<ok/>")
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+	h := newTestHandler(t, newTestConfig(t, u))
+	accept := func(accept string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/data", nil)
+		r.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		for ac, want := range map[string]string{
+			"text/html, application/json;q=0.5": `{"ok":true}`,
+			"text/html, application/xml;q=0.5":  "<ok/>",
+		} {
+			if rec := accept(ac); rec.Body.String() != want {
+				t.Errorf("request %d with Accept %q got %q, want %q", i, ac, rec.Body.String(), want)
+			}
+		}
+	}
+	if rec := accept("application/json;q=0.5, text/html"); rec.Header().Get("x-cache") != CacheHit {
+		t.Errorf("reordered Accept got x-cache %q, want a hit", rec.Header().Get("x-cache"))
+	}
+	if n != 2 {
+		t.Errorf("upstream got %d requests, want one per variant", n)
+	}
+}
@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// cacheWarmer fetches lists of URIs into the cache, so a fresh node can be
+// primed with hot content before it is put into rotation.
+type cacheWarmer struct {
+	next  http.Handler
+	cache CacheManager
+}
+
+// warmer serves the warm command and /admin/warm; it is set up by
+// newHandler.
+var warmer = &cacheWarmer{}
+
+// warmResult counts the warmed URIs, listing the failed ones.
+type warmResult struct {
+	Fetched int      `json:"fetched"`
+	Cached  int      `json:"cached"`
+	Failed  []string `json:"failed"`
+}
+
+// Warm fetches uris, with up to concurrency requests at the same time.
+// URIs are paths, or absolute URLs whose host selects the routed upstream.
+// Those already cached are not fetched again.
+func (c *cacheWarmer) Warm(ctx context.Context, uris []string, concurrency int) *warmResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	res := &warmResult{Failed: []string{}}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uri := range queue {
+				cached, err := c.fetch(ctx, uri)
+				mu.Lock()
+				switch {
+				case err != nil:
+					log.Printf("[warm] Failed to warm '%v': %v", uri, err)
+					res.Failed = append(res.Failed, uri)
+				case cached:
+					res.Cached++
+				default:
+					res.Fetched++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, uri := range uris {
+		if ctx.Err() != nil {
+			break
+		}
+		queue <- uri
+	}
+	close(queue)
+	wg.Wait()
+	return res
+}
+
+// fetch warms uri, reporting whether it was already cached.
+func (c *cacheWarmer) fetch(ctx context.Context, uri string) (bool, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.RequestURI(), nil)
+	if err != nil {
+		return false, err
+	}
+	req.Host = u.Host
+	req.RequestURI = u.RequestURI()
+	if !cacheablePath(req) {
+		return false, errors.New("not cacheable")
+	}
+	if _, _, b, _, err := getEntry(c.cache, req); err == nil {
+		b.Close()
+		return true, nil
+	}
+	debugf("[warm] Warming '%v'", uri)
+	rec := &statusRecorder{ResponseWriter: &discardWriter{h: make(http.Header)}}
+	c.next.ServeHTTP(rec, req)
+	if rec.code >= 400 {
+		return false, fmt.Errorf("status %d", rec.code)
+	}
+	return false, ctx.Err()
+}
+
+// readURIList returns the URIs in r, one per line, skipping blank lines
+// and # comments.
+func readURIList(r io.Reader) ([]string, error) {
+	var uris []string
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		uris = append(uris, line)
+	}
+	return uris, s.Err()
+}
+
+// Warm fetches the URIs listed in list, one per line, into the cache of a
+// Proxy set by cfg, with up to --warm-concurrency requests at the same
+// time. It fails if any of them could not be fetched.
+func Warm(cfg *Config, list io.Reader) error {
+	conf = cfg
+	if conf.ConfigFile != "" {
+		if err := loadConfig(conf.ConfigFile); err != nil {
+			return fmt.Errorf("invalid --config: %v", err)
+		}
+	}
+	if conf.Offline {
+		return errors.New("--offline never fetches, so it can't warm the cache")
+	}
+	uris, err := readURIList(list)
+	if err != nil {
+		return err
+	}
+	p, err := New(conf)
+	if err != nil {
+		return err
+	}
+	defer p.Close()
+	res := warmer.Warm(context.Background(), uris, conf.WarmConcurrency)
+	log.Printf("[warm] Fetched %d URIs, %d already cached, %d failed", res.Fetched, res.Cached, len(res.Failed))
+	if len(res.Failed) > 0 {
+		return fmt.Errorf("failed to warm %d of %d URIs", len(res.Failed), len(uris))
+	}
+	return nil
+}
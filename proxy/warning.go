@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+)
+
+// originExpiresHeader is stored along with the cached headers when
+// --min-ttl keeps an entry longer than the origin intended, recording when
+// the origin considers it stale. It is never sent to clients.
+const originExpiresHeader = "X-Simpleproxy-Origin-Expires"
+
+// heuristicWarning is the RFC 7234 warning for responses served past their
+// origin freshness lifetime.
+const heuristicWarning = `113 - "Heuristic Expiration"`
+
+// setOriginExpires records in h when the origin considers w stale, if
+// --min-ttl keeps the entry for longer than that.
+func setOriginExpires(h http.Header, w *http.Response) {
+	if conf.MinTTL <= 0 {
+		return
+	}
+	if ttl, ok := originTTL(w); ok && ttl < conf.MinTTL {
+		h.Set(originExpiresHeader, time.Now().Add(ttl).UTC().Format(http.TimeFormat))
+	}
+}
+
+// addHeuristicWarning removes the stored origin expiration from h and,
+// with --heuristic-expiration-warning, adds a Warning header when serving
+// content the origin already considers stale.
+func addHeuristicWarning(h http.Header) {
+	e := h.Get(originExpiresHeader)
+	h.Del(originExpiresHeader)
+	if !conf.HeuristicExpirationWarning || e == "" {
+		return
+	}
+	if t, err := http.ParseTime(e); err == nil && time.Now().After(t) {
+		h.Add("Warning", heuristicWarning)
+	}
+}
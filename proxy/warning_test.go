@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHeuristicExpirationWarning(t *testing.T) {
+	now := time.Now().UTC()
+	// Already stale for the origin, kept for an hour by --min-ttl
+	clamped := http.Header{"Date": {now.Format(http.TimeFormat)}, "Expires": {now.Add(-time.Minute).Format(http.TimeFormat)}}
+	unclamped := http.Header{"Cache-Control": {"max-age=7200"}}
+	for _, tc := range []struct {
+		header http.Header
+		warn   bool
+		want   string
+	}{
+		{clamped, true, heuristicWarning},
+		{unclamped, true, ""},
+		{clamped, false, ""},
+	} {
+		parseTestFlags(t, "--min-ttl=1h", "--heuristic-expiration-warning="+strconv.FormatBool(tc.warn))
+		h := make(http.Header)
+		setOriginExpires(h, &http.Response{Header: tc.header})
+		addHeuristicWarning(h)
+		if got := h.Get("Warning"); got != tc.want {
+			t.Errorf("%v with the warning %v: Warning = %q, want %q", tc.header, tc.warn, got, tc.want)
+		}
+		if got := h.Get(originExpiresHeader); got != "" {
+			t.Errorf("%v with the warning %v: %v = %q left for the client", tc.header, tc.warn, originExpiresHeader, got)
+		}
+	}
+}
+
+func TestHeuristicExpirationWarningOnHits(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/clamped":
+			// Already stale for the origin, kept for an hour by --min-ttl
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.Header().Set("Age", "120")
+		case "/unclamped":
+			w.Header().Set("Cache-Control", "max-age=7200")
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	for _, tc := range []struct {
+		flags []string
+		path  string
+		want  string
+	}{
+		{[]string{"--min-ttl=1h", "--heuristic-expiration-warning"}, "/clamped", heuristicWarning},
+		{[]string{"--min-ttl=1h", "--heuristic-expiration-warning"}, "/unclamped", ""},
+		{[]string{"--min-ttl=1h"}, "/clamped", ""},
+	} {
+		h := newTestHandler(t, newTestConfig(t, u, tc.flags...))
+		get(h, tc.path)
+		rec := get(h, tc.path)
+		if rec.Header().Get("x-cache") != CacheHit {
+			t.Fatalf("%v with %v: got x-cache %q, want a hit", tc.path, tc.flags, rec.Header().Get("x-cache"))
+		}
+		if got := rec.Header().Get("Warning"); got != tc.want {
+			t.Errorf("%v with %v: Warning = %q, want %q", tc.path, tc.flags, got, tc.want)
+		}
+		if got := rec.Header().Get(originExpiresHeader); got != "" {
+			t.Errorf("%v with %v: %v = %q sent to the client", tc.path, tc.flags, originExpiresHeader, got)
+		}
+	}
+}
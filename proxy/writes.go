@@ -0,0 +1,38 @@
+package proxy
+
+// writeLimiter bounds the number of concurrent cache writes, so bursts of
+// misses do not saturate the disk and slow down cache hits. A nil
+// limiter only keeps track of the writes in progress.
+type writeLimiter chan struct{}
+
+// writeSlots limits the writes done by cacheResponse.
+var writeSlots writeLimiter
+
+func newWriteLimiter(n int) writeLimiter {
+	if n <= 0 {
+		return nil
+	}
+	return make(writeLimiter, n)
+}
+
+// Acquire takes a write slot without blocking, reporting whether one was
+// available.
+func (l writeLimiter) Acquire() bool {
+	if l != nil {
+		select {
+		case l <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	cacheWritesInflight.Inc()
+	return true
+}
+
+// Release frees a slot taken by Acquire.
+func (l writeLimiter) Release() {
+	cacheWritesInflight.Dec()
+	if l != nil {
+		<-l
+	}
+}
@@ -0,0 +1,29 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+const xfccHeader = "X-Forwarded-Client-Cert"
+
+// setClientCert replaces the X-Forwarded-Client-Cert header of r with the
+// details of the client certificate presented during the TLS handshake,
+// using the Envoy format:
+//
+//	Hash=<sha256 of the DER certificate>;Subject="<subject DN>"
+//
+// Values sent by the client itself are always dropped, so they cannot be
+// spoofed.
+func setClientCert(r *http.Request) {
+	r.Header.Del(xfccHeader)
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return
+	}
+	cert := r.TLS.PeerCertificates[0]
+	sum := sha256.Sum256(cert.Raw)
+	subject := strings.ReplaceAll(cert.Subject.String(), `"`, `\"`)
+	r.Header.Set(xfccHeader, "Hash="+hex.EncodeToString(sum[:])+`;Subject="`+subject+`"`)
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newClientCert returns a self-signed client certificate for cn.
+func newClientCert(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn, Organization: []string{"Example"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestSetClientCert(t *testing.T) {
+	cert := newClientCert(t, "client-one")
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	for _, tc := range []struct {
+		state *tls.ConnectionState
+		want  string
+	}{
+		{&tls.ConnectionState{PeerCertificates: []*x509.Certificate{parsed}}, "Hash=" + hex.EncodeToString(sum[:]) + `;Subject="CN=client-one,O=Example"`},
+		{&tls.ConnectionState{}, ""},
+		{nil, ""},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+		r.TLS = tc.state
+		// Never trusted from clients
+		r.Header.Set(xfccHeader, `Hash=spoofed;Subject="CN=admin"`)
+		setClientCert(r)
+		if got := r.Header.Get(xfccHeader); got != tc.want {
+			t.Errorf("with TLS state %v, got %s %q, want %q", tc.state != nil, xfccHeader, got, tc.want)
+		}
+	}
+}
+
+func TestForwardClientCert(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		io.WriteString(w, r.Header.Get(xfccHeader))
+	}))
+	defer upstream.Close()
+	u, _ := url.Parse(upstream.URL)
+	srv := httptest.NewUnstartedServer(newTestHandler(t, newTestConfig(t, u, "--forward-client-cert")))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	cert := newClientCert(t, "client-one")
+	sum := sha256.Sum256(cert.Certificate[0])
+	for _, tc := range []struct {
+		certs []tls.Certificate
+		want  string
+	}{
+		{[]tls.Certificate{cert}, "Hash=" + hex.EncodeToString(sum[:]) + `;Subject="CN=client-one,O=Example"`},
+		{nil, ""},
+	} {
+		// A new connection for each client certificate
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		transport.TLSClientConfig.Certificates = tc.certs
+		client := &http.Client{Transport: transport}
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/whoami", nil)
+		// Never trusted from clients
+		req.Header.Set(xfccHeader, `Hash=spoofed;Subject="CN=admin"`)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(b) != tc.want {
+			t.Errorf("with %d client certificates, upstream got %s %q, want %q", len(tc.certs), xfccHeader, b, tc.want)
+		}
+	}
+}